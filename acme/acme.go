@@ -0,0 +1,228 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package acme answers ACME TLS-ALPN-01 challenges (RFC 8737), using key
+// authorizations provided by an external ACME client.
+package acme
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ALPN protocol used by TLS-ALPN-01 challenges.
+const Protocol = "acme-tls/1"
+
+// Extension holding the hash of the key authorization (id-pe-acmeIdentifier).
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// Time allowed to complete a challenge handshake.
+const handshakeTimeout = 10 * time.Second
+
+// Responder answers TLS-ALPN-01 challenges. Challenges are read from a
+// directory, holding one file per domain named after it. Files contain the
+// key authorization of the challenge, or only its token if the account key is
+// known.
+type Responder struct {
+	// Directory the challenges are read from.
+	Dir        string
+	// JWK thumbprint of the account key, if known.
+	Thumbprint string
+
+	// Key of the validation certificates.
+	key        *ecdsa.PrivateKey
+}
+
+// Returns a new responder reading challenges from dir. The account key is
+// optional.
+func NewResponder(dir, accountKey string) (*Responder, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate a key (%s)", err)
+	}
+	r := &Responder{ Dir: dir, key: key }
+
+	if accountKey != "" {
+		pub, err := readPublicKey(accountKey)
+		if err != nil {
+			return nil, err
+		}
+		if r.Thumbprint, err = thumbprint(pub); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Completes a TLS handshake with a client, whose ClientHello was already read,
+// presenting the validation certificate of the requested domain. The
+// connection is not closed.
+func (r *Responder) Serve(conn net.Conn, hello []byte, domain string) error {
+	cert, err := r.Certificate(domain)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	server := tls.Server(&replayConn{ conn, io.MultiReader(bytes.NewReader(hello), conn) }, &tls.Config{
+		Certificates: []tls.Certificate{ *cert },
+		NextProtos: []string{ Protocol },
+	})
+	if err := server.Handshake(); err != nil {
+		return fmt.Errorf("Could not complete the ACME handshake for %s (%s)", domain, err)
+	}
+	return nil
+}
+
+// Returns the validation certificate of a domain.
+func (r *Responder) Certificate(domain string) (*tls.Certificate, error) {
+	auth, err := r.keyAuthorization(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(auth))
+	value, err := asn1.Marshal(hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode the key authorization (%s)", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Could not generate a serial number (%s)", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{ CommonName: "ACME challenge" },
+		NotBefore: now.Add(-time.Hour),
+		NotAfter: now.Add(24 * time.Hour),
+		DNSNames: []string{ domain },
+		ExtraExtensions: []pkix.Extension{
+			{ Id: idPeAcmeIdentifier, Critical: true, Value: value },
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &r.key.PublicKey, r.key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create the certificate for %s (%s)", domain, err)
+	}
+
+	return &tls.Certificate{ Certificate: [][]byte{ der }, PrivateKey: r.key }, nil
+}
+
+// Returns the key authorization of the pending challenge of a domain.
+func (r *Responder) keyAuthorization(domain string) (string, error) {
+	// The domain comes from the client, do not let it escape the
+	// challenges directory.
+	if domain == "" || strings.HasPrefix(domain, ".") || strings.ContainsAny(domain, `/\`) {
+		return "", fmt.Errorf("Invalid ACME domain %q", domain)
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.Dir, domain))
+	if err != nil {
+		return "", fmt.Errorf("Could not read the ACME challenge of %s (%s)", domain, err)
+	}
+
+	auth := strings.TrimSpace(string(data))
+	if r.Thumbprint != "" && !strings.Contains(auth, ".") {
+		auth += "." + r.Thumbprint
+	}
+	return auth, nil
+}
+
+// Reads the public part of a PEM encoded private key.
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the account key (%s)", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Could not decode the account key (%s)", path)
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer.Public(), nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key.Public(), nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key.Public(), nil
+	}
+	return nil, fmt.Errorf("Could not parse the account key (%s)", path)
+}
+
+// Returns the JWK thumbprint (RFC 7638) of a public key.
+func thumbprint(pub crypto.PublicKey) (string, error) {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	var jwk string
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		e := big.NewInt(int64(key.E)).Bytes()
+		jwk = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, b64(e), b64(key.N.Bytes()))
+		break
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		x := make([]byte, size)
+		y := make([]byte, size)
+		key.X.FillBytes(x)
+		key.Y.FillBytes(y)
+		jwk = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, key.Curve.Params().Name, b64(x), b64(y))
+		break
+	default:
+		return "", fmt.Errorf("Unsupported account key type %T", pub)
+	}
+
+	hash := sha256.Sum256([]byte(jwk))
+	return b64(hash[:]), nil
+}
+
+// Connection replaying data already read before reading from the connection.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
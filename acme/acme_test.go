@@ -0,0 +1,130 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package acme
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/atenart/sniproxy/clienthello"
+)
+
+func TestThumbprint(t *testing.T) {
+	// Example from RFC 7638, section 3.1.
+	n, _ := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	key := &rsa.PublicKey{ N: new(big.Int).SetBytes(n), E: 65537 }
+
+	got, err := thumbprint(key)
+	if err != nil || got != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("Wrong thumbprint: %s (%v)", got, err)
+	}
+}
+
+func TestKeyAuthorization(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "example.net"), []byte("token\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "example.com"), []byte("token.other"), 0644)
+
+	r, err := NewResponder(dir, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.Thumbprint = "thumb"
+
+	tests := []struct {
+		domain string
+		auth   string
+		err    bool
+	}{
+		{ "example.net", "token.thumb", false },
+		{ "example.com", "token.other", false },
+		{ "example.org", "", true },
+		{ "../example.net", "", true },
+		{ "", "", true },
+	}
+	for _, test := range(tests) {
+		auth, err := r.keyAuthorization(test.domain)
+		if (err != nil) != test.err || auth != test.auth {
+			t.Errorf("%q: got %q (%v), wanted %q", test.domain, auth, err, test.auth)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "example.net"), []byte("token.thumb"), 0644)
+
+	r, err := NewResponder(dir, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error)
+	go func() {
+		info, hello, err := clienthello.Parse(server)
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- r.Serve(server, hello, info.SNI)
+	}()
+
+	conn := tls.Client(client, &tls.Config{
+		ServerName: "example.net",
+		NextProtos: []string{ Protocol },
+		InsecureSkipVerify: true,
+	})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != Protocol {
+		t.Errorf("Wrong protocol: %q", state.NegotiatedProtocol)
+	}
+
+	cert := state.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "example.net" {
+		t.Errorf("Wrong names: %v", cert.DNSNames)
+	}
+
+	hash := sha256.Sum256([]byte("token.thumb"))
+	want, _ := asn1.Marshal(hash[:])
+	found := false
+	for _, ext := range(cert.Extensions) {
+		if ext.Id.Equal(idPeAcmeIdentifier) {
+			found = ext.Critical && string(ext.Value) == string(want)
+		}
+	}
+	if !found {
+		t.Errorf("Missing or wrong acmeIdentifier extension")
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Traffic of a route, over all the connections matching it which are closed.
+type RouteStats struct {
+	Connections   uint64            `json:"connections"`
+	BytesSent     int64             `json:"bytes_sent"`
+	BytesReceived int64             `json:"bytes_received"`
+	// Annotations of the route in the current configuration, if any.
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// State of a backend of the current configuration.
+type BackendStats struct {
+	Route       string `json:"route"`
+	Address     string `json:"address"`
+	Healthy     bool   `json:"healthy"`
+	ActiveConns int    `json:"active_connections"`
+}
+
+// Snapshot of the proxy state, served by the admin endpoint.
+type Stats struct {
+	ActiveConns int                    `json:"active_connections"`
+	MaxConns    int                    `json:"max_connections,omitempty"`
+	Routes      map[string]*RouteStats `json:"routes"`
+	Backends    []BackendStats         `json:"backends"`
+	// Routes of the current configuration in maintenance.
+	Maintenance []string               `json:"maintenance,omitempty"`
+}
+
+// Traffic per route pattern, since the proxy started.
+var routeStats = &routeRegistry{ routes: make(map[string]*RouteStats) }
+
+type routeRegistry struct {
+	mu     sync.Mutex
+	routes map[string]*RouteStats
+}
+
+// Accounts for a closed connection.
+func (r *routeRegistry) record(e *AccessEntry) {
+	if e.Route == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.routes[e.Route]
+	if !ok {
+		s = &RouteStats{}
+		r.routes[e.Route] = s
+	}
+	s.Connections++
+	s.BytesSent += e.BytesSent
+	s.BytesReceived += e.BytesReceived
+}
+
+// Returns a copy of the traffic per route.
+func (r *routeRegistry) snapshot() map[string]*RouteStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	routes := make(map[string]*RouteStats, len(r.routes))
+	for pattern, s := range(r.routes) {
+		s := *s
+		routes[pattern] = &s
+	}
+	return routes
+}
+
+// Returns a snapshot of the proxy state.
+func (p *Proxy) Stats() *Stats {
+	p.connMu.Lock()
+	stats := &Stats{
+		ActiveConns: len(p.conns),
+		Routes: routeStats.snapshot(),
+	}
+	p.connMu.Unlock()
+
+	c := p.currentConfig()
+	if c == nil {
+		return stats
+	}
+	stats.MaxConns = c.MaxConns
+
+	routes := c.Routes
+	if c.NoSNI != nil && c.NoSNI != c.Default {
+		routes = append(routes[:len(routes):len(routes)], c.NoSNI)
+	}
+	if c.NonTLS != nil && c.NonTLS != c.Default {
+		routes = append(routes[:len(routes):len(routes)], c.NonTLS)
+	}
+	for _, route := range(routes) {
+		name := "no-sni"
+		if len(route.Domains) > 0 {
+			name = route.Domains[0].Pattern
+		} else if route == c.NonTLS {
+			name = "non-tls"
+		}
+		if route.Maintenance {
+			stats.Maintenance = append(stats.Maintenance, name)
+		}
+		if len(route.Annotations) > 0 {
+			s, ok := stats.Routes[name]
+			if !ok {
+				s = &RouteStats{}
+				stats.Routes[name] = s
+			}
+			s.Annotations = route.Annotations
+		}
+
+		backends := route.Backends
+		if route.ACME != nil {
+			backends = append(backends[:len(backends):len(backends)], route.ACME)
+		}
+		for _, b := range(backends) {
+			stats.Backends = append(stats.Backends, BackendStats{
+				Route: name,
+				Address: b.Address,
+				Healthy: b.Healthy(),
+				ActiveConns: b.ActiveConns(),
+			})
+		}
+	}
+	return stats
+}
+
+// Returns an HTTP handler serving a JSON snapshot of the proxy state.
+func newStatsHandler(p *Proxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(p.Stats())
+	}
+}
+
+// Outcome of a configuration reload requested through the admin endpoint.
+type ReloadSummary struct {
+	File   string `json:"file"`
+	Routes int    `json:"routes"`
+}
+
+// Header reload requests must carry. Web pages can't send it cross-site
+// without a CORS preflight, which isn't answered, so visiting a page can't
+// trigger reloads.
+const reloadHeader = "X-Sniproxy-Reload"
+
+// Returns an HTTP handler reloading the configuration from a file, as done on
+// SIGHUP. Invalid configurations are reported and the current one is kept.
+func newReloadHandler(p *Proxy, file string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get(reloadHeader) == "" {
+			http.Error(w, "Missing " + reloadHeader + " header", http.StatusForbidden)
+			return
+		}
+		if file == "-" {
+			http.Error(w, "Configuration read from stdin can't be reloaded", http.StatusBadRequest)
+			return
+		}
+		if err := reloadConfig(p, file); err != nil {
+			// Invalid configurations are reported as bad requests,
+			// files that can't be read as server errors.
+			status := http.StatusInternalServerError
+			var perr *config.ParseError
+			if errors.As(err, &perr) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&ReloadSummary{
+			File:   file,
+			Routes: len(p.currentConfig().Routes),
+		})
+	}
+}
+
+// Serves the admin endpoint on a dedicated HTTP server. The configuration can
+// be reloaded from file.
+func serveAdmin(bind string, p *Proxy, file string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/stats", newStatsHandler(p))
+	mux.Handle("/reload", newReloadHandler(p, file))
+
+	srv := &http.Server{
+		Addr: bind,
+		Handler: mux,
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+func TestStatsHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sniproxy.conf")
+	os.WriteFile(path, []byte(`
+# @owner team-x
+# @ticket OPS-42
+example.net {
+	backend 1.2.3.4:443, 1.2.3.5:443
+	acme 1.2.3.6:443
+}
+example.org {
+	backend 1.2.3.7:443
+	maintenance
+}
+`), 0644)
+	c := &config.Config{}
+	if err := c.ReadFile(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c.Routes[0].Backends[1].SetHealthy(false)
+	p := &Proxy{ Config: c }
+
+	routeStats = &routeRegistry{ routes: make(map[string]*RouteStats) }
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			routeStats.record(&AccessEntry{ Route: "example.net", BytesSent: 10, BytesReceived: 100 })
+		}()
+	}
+	wg.Wait()
+	routeStats.record(&AccessEntry{ Reason: "invalid handshake" })
+
+	w := httptest.NewRecorder()
+	newStatsHandler(p)(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status: %d", w.Code)
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Invalid JSON (%s)", err)
+	}
+	if len(stats.Routes) != 1 {
+		t.Errorf("Wrong routes: %v", stats.Routes)
+	} else if s := stats.Routes["example.net"]; s.Connections != 10 || s.BytesSent != 100 || s.BytesReceived != 1000 {
+		t.Errorf("Wrong route stats: %+v", s)
+	} else if s.Annotations["owner"] != "team-x" || s.Annotations["ticket"] != "OPS-42" {
+		t.Errorf("Wrong route annotations: %v", s.Annotations)
+	}
+	if len(stats.Backends) != 4 || !stats.Backends[0].Healthy || stats.Backends[1].Healthy ||
+	   stats.Backends[2].Address != "1.2.3.6:443" {
+		t.Errorf("Wrong backends: %+v", stats.Backends)
+	}
+	if len(stats.Maintenance) != 1 || stats.Maintenance[0] != "example.org" {
+		t.Errorf("Wrong routes in maintenance: %v", stats.Maintenance)
+	}
+
+	w = httptest.NewRecorder()
+	newStatsHandler(p)(w, httptest.NewRequest(http.MethodPost, "/stats", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Wrong status for a POST request: %d", w.Code)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sniproxy.conf")
+	os.WriteFile(path, []byte("example.net {\n\tbackend 1.2.3.4:443\n}\n"), 0644)
+	p := &Proxy{}
+
+	reload := func(method, file string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/reload", nil)
+		r.Header.Set(reloadHeader, "1")
+		w := httptest.NewRecorder()
+		newReloadHandler(p, file)(w, r)
+		return w
+	}
+
+	w := reload(http.MethodPost, path)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Wrong status: %d (%s)", w.Code, w.Body.String())
+	}
+	var summary ReloadSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("Invalid JSON (%s)", err)
+	}
+	if summary.File != path || summary.Routes != 1 {
+		t.Errorf("Wrong summary: %+v", summary)
+	}
+	c := p.currentConfig()
+
+	os.WriteFile(path, []byte("example.net {\n\tbackend\n}\n"), 0644)
+	if w := reload(http.MethodPost, path); w.Code != http.StatusBadRequest || w.Body.Len() == 0 {
+		t.Errorf("Wrong status for an invalid config: %d (%s)", w.Code, w.Body.String())
+	}
+	if p.currentConfig() != c {
+		t.Errorf("Config was replaced by an invalid one")
+	}
+
+	if w := reload(http.MethodPost, path + ".missing"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Wrong status for a missing file: %d", w.Code)
+	}
+	if w := reload(http.MethodPost, "-"); w.Code != http.StatusBadRequest {
+		t.Errorf("Wrong status for stdin: %d", w.Code)
+	}
+	if w := reload(http.MethodGet, path); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Errorf("Wrong status for GET: %d", w.Code)
+	}
+
+	// Requests web pages can send cross-site without a preflight, i.e.
+	// without custom headers, are refused.
+	w = httptest.NewRecorder()
+	newReloadHandler(p, path)(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Wrong status without the %s header: %d", reloadHeader, w.Code)
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package clienthello extracts information from TLS ClientHello messages, such
+// as the requested server name (SNI), without terminating the TLS connection.
+package clienthello
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Info holds the information extracted from a TLS ClientHello.
+type Info struct {
+	SNI      string
+	// Whether the SNI extension was present. It can be present but not
+	// contain a host name, in which case SNI is empty.
+	HasSNI   bool
+	// Protocols advertised in the ALPN extension, in the client's order of
+	// preference.
+	ALPN     []string
+	// Highest TLS version offered, from the supported_versions extension
+	// if present or from the legacy version field otherwise.
+	Version  uint16
+	// Fields identifying the client software, nil if they could not be
+	// parsed.
+	Hello    *Hello
+	helloErr error
+}
+
+// Checks if the client advertised acme-tls/1.
+func (info *Info) ACME() bool {
+	for _, proto := range info.ALPN {
+		if proto == "acme-tls/1" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of the highest TLS version offered, eg. "TLS 1.3".
+func (info *Info) VersionName() string {
+	return tls.VersionName(info.Version)
+}
+
+// Reads the TLS records holding a ClientHello from r and returns the requested
+// server name. The bytes read are returned as well, even on error, so they can
+// be replayed to a backend. Nothing is read past the ClientHello.
+func ParseSNI(r io.Reader) (string, []byte, error) {
+	info, peeked, err := Parse(r)
+	if err != nil {
+		return "", peeked, err
+	}
+	return info.SNI, peeked, nil
+}
+
+// Maximum length of a ClientHello spanning multiple records.
+const maxHelloLength = 64 * 1024
+
+// Reads the TLS records holding a ClientHello from r and returns the
+// information extracted from it. The bytes read are returned as well, even on
+// error, so they can be replayed to a backend. Nothing is read past the
+// ClientHello.
+func Parse(r io.Reader) (*Info, []byte, error) {
+	var peeked bytes.Buffer
+	payload, err := readMessage(io.TeeReader(r, &peeked))
+	if err != nil {
+		return nil, peeked.Bytes(), err
+	}
+
+	info, err := parseInfo(payload)
+	return info, peeked.Bytes(), err
+}
+
+// Reads the TLS records holding a ClientHello from r and returns the handshake
+// message they carry. Nothing is read past the ClientHello.
+func readMessage(r io.Reader) ([]byte, error) {
+	// A ClientHello can be fragmented across multiple records, accumulate
+	// their payload until the full message is read.
+	var payload []byte
+	for {
+		length, err := parseRecord(r)
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			return nil, fmt.Errorf("Empty TLS handshake record")
+		}
+
+		record := make([]byte, length)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return nil, fmt.Errorf("Could not read TLS record (%w)", err)
+		}
+		payload = append(payload, record...)
+
+		// The handshake header itself can be fragmented.
+		if len(payload) < 4 {
+			continue
+		}
+
+		msgLength, err := parseHandshake(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if msgLength > maxHelloLength {
+			return nil, fmt.Errorf("ClientHello length exceed maximum (%d > %d)", msgLength, maxHelloLength)
+		}
+		if len(payload) >= 4 + int(msgLength) {
+			return payload, nil
+		}
+	}
+}
+
+// Parses a ClientHello handshake message which is not wrapped in TLS records,
+// as carried by QUIC.
+func ParseMessage(msg []byte) (*Info, error) {
+	return parseInfo(msg)
+}
+
+// Parses a TLS handshake message holding a ClientHello.
+func parseInfo(payload []byte) (*Info, error) {
+	r := bytes.NewReader(payload)
+
+	length, err := parseHandshake(r)
+	if err != nil {
+		return nil, err
+	}
+	if int(length) > r.Len() {
+		return nil, fmt.Errorf("ClientHello is truncated")
+	}
+	// Only parse the message itself.
+	r = bytes.NewReader(payload[4:4+length])
+
+	hello, err := parseClientHello(r)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &Info{ Version: hello.Version, Hello: hello }
+
+	// Parse the TLS extension, looking for a server name indication.
+	b, err := parseVector(r, 2)
+	if err != nil {
+		// No extension (not an error).
+		if err == io.EOF {
+			return info, nil
+		}
+		return nil, err
+	}
+
+	// Loop over the TLS extensions.
+	for len(b) >= 4 {
+		extType := binary.BigEndian.Uint16(b[:2])
+		length := binary.BigEndian.Uint16(b[2:4])
+		b = b[4:]
+
+		if int(length) > len(b) {
+			return nil, fmt.Errorf("TLS extension is too short.")
+		}
+
+		switch(extType) {
+		// SNI.
+		case 0:
+			info.HasSNI = true
+			info.SNI, err = parseSNI(b[:length])
+		// ALPN.
+		case 16:
+			info.ALPN, err = parseALPN(b[:length])
+		// Supported versions, superseding the legacy version field.
+		case 43:
+			var v uint16
+			if v, err = parseSupportedVersions(b[:length]); v != 0 {
+				info.Version = v
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Failing to fingerprint the client does not prevent routing
+		// it.
+		if info.helloErr == nil {
+			info.helloErr = hello.addExtension(extType, b[:length])
+		}
+
+		b = b[length:]
+	}
+
+	if info.helloErr != nil {
+		info.Hello = nil
+	}
+	return info, nil
+}
+
+// Parse a TLS Plaintext record header and returns the length of its payload.
+func parseRecord(r io.Reader) (uint16, error) {
+	var record struct {
+		Type          uint8
+		Major, Minor  uint8
+		Length        uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &record); err != nil {
+		return 0, fmt.Errorf("Could not read TLS handshake (%w)", err)
+	}
+
+	// Check if record type is 22, aka handshake.
+	if record.Type != 22 {
+		return 0, fmt.Errorf("Record is not a TLS handshake")
+	}
+
+	// Checks the TLS version is supported:
+	// 3.1: TLS 1.0, 3.2: TLS 1.1, 3.3: TLS 1.2 & TLS 1.3
+	if record.Major != 3 {
+		return 0, fmt.Errorf("TLS version not supported (%d.%d)", record.Major, record.Minor)
+	}
+	switch (record.Minor) {
+	default:
+		return 0, fmt.Errorf("TLS version not supported (%d.%d)", record.Major, record.Minor)
+	case 1,2,3:
+	}
+
+	// Check the handshake does not exceed the max authorized.
+	if record.Length > (16 * 1024) {
+		return 0, fmt.Errorf("TLS record length exceed maximum (%d > 2^14)", record.Length)
+	}
+
+	return record.Length, nil
+}
+
+// Parse a TLS handshake message header and returns the message length.
+func parseHandshake(r io.Reader) (uint32, error) {
+	var handshake struct {
+		MessageType   uint8
+		MessageLength [3]byte
+	}
+	if err := binary.Read(r, binary.BigEndian, &handshake); err != nil {
+		return 0, fmt.Errorf("Could not read TLS message header (%w)", err)
+	}
+
+	// Check if the message type is ClientHello.
+	if handshake.MessageType != 1 {
+		return 0, fmt.Errorf("TLS handshake is not a ClientHello message (%d)", handshake.MessageType)
+	}
+
+	length := uint32(handshake.MessageLength[0]) << 16 |
+		  uint32(handshake.MessageLength[1]) << 8 |
+		  uint32(handshake.MessageLength[2])
+	return length, nil
+}
+
+// Parse a TLS ClientHello message up to its extensions and returns its legacy
+// version and cipher suites.
+func parseClientHello(r io.Reader) (*Hello, error) {
+	var hello struct {
+		Version uint16
+		Random  [32]byte
+	}
+	if err := binary.Read(r, binary.BigEndian, &hello); err != nil {
+		return nil, fmt.Errorf("Could not read TLS ClientHello message (%w)", err)
+	}
+
+	// Checks the version:
+	// 0x301: TLS 1.0, 0x302: TLS 1.1, 0x303 after TLS 1.2.
+	switch (hello.Version) {
+	default:
+		return nil, fmt.Errorf("ClientHello version is not 0x303 (%#x)", hello.Version)
+	case 0x301, 0x302, 0x303:
+	}
+
+	// We do not check other fields strictly, but reading them ensure they
+	// are present (ie. the message seems to be a valid ClientHello).
+
+	// SessionID.
+	b, err := parseVector(r, 1)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read ClientHello session ID (%w)", err)
+	}
+	if len(b) > 32 {
+		return nil, fmt.Errorf("ClientHello SessionID has an invalid length (%d)", len(b))
+	}
+
+	// Cipher Suites.
+	b, err = parseVector(r, 2)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read ClientHello cipher suites (%w)", err)
+	}
+	if len(b) < 2 || len(b) % 2 != 0 {
+		return nil, fmt.Errorf("ClientHello cipher suites has an invalid length (%d)", len(b))
+	}
+	h := &Hello{ Version: hello.Version }
+	h.CipherSuites, _ = parseValues(b)
+
+	// Compression methods.
+	b, err = parseVector(r, 1)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read ClientHello compression methods (%w)", err)
+	}
+	if len(b) < 1 {
+		return nil, fmt.Errorf("ClientHello compression methods has an invalid length (%d)", len(b))
+	}
+
+	// We reached the extensions (or none, which is valid).
+	return h, nil
+}
+
+// Parse the SNI from an SNI extension.
+func parseSNI(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", fmt.Errorf("SNI extension is empty.")
+	}
+
+	length := binary.BigEndian.Uint16(b[:2])
+	if int(length) > len(b[2:]) {
+		return "", fmt.Errorf("SNI extension is too short.")
+	}
+
+	b = b[2:2+length]
+
+	for len(b) >= 3 {
+		nameType := b[0]
+		vectLength := binary.BigEndian.Uint16(b[1:3])
+		if int(vectLength) > len(b[3:]) {
+			return "", fmt.Errorf("SNI vector is too short.")
+		}
+
+		if nameType != 0 {
+			b = b[3+vectLength:]
+			continue
+		}
+
+		// A trailing dot (fully qualified name) is equivalent, remove
+		// it so the SNI matches the configured domains.
+		return strings.TrimSuffix(string(b[3 : 3+vectLength]), "."), nil
+	}
+
+	// No DNS-based SNI.
+	return "", nil
+}
+
+// Parse a vector and returns a byte array. Takes the length of the len field as
+// an argument.
+func parseVector(r io.Reader, l uint) ([]byte, error) {
+	rawLen := make([]byte, l)
+	if err := binary.Read(r, binary.BigEndian, &rawLen); err != nil {
+		// No data to read. This can be valid.
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Could not read the vector length (%w)", err)
+	}
+
+	var length uint = 0
+	for _, b := range rawLen {
+		length = (length << 8) + uint(b)
+	}
+
+	if length == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, length)
+	if err := binary.Read(r, binary.BigEndian, &data); err != nil {
+		return nil, fmt.Errorf("Could not read the vector data (%w)", err)
+	}
+
+	return data, nil
+}
+
+// Parse an ALPN extension and returns the list of advertised protocols.
+func parseALPN(b []byte) ([]string, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("ALPN extension is empty.")
+	}
+
+	length := binary.BigEndian.Uint16(b[:2])
+	if int(length) > len(b[2:]) {
+		return nil, fmt.Errorf("ALPN extension is too short.")
+	}
+
+	b = b[2:2+length]
+
+	var protos []string
+	for len(b) > 0 {
+		stringLen := int(b[0])
+
+		b = b[1:]
+		if stringLen == 0 || stringLen > len(b) {
+			return nil, fmt.Errorf("ALPN string length overflowed")
+		}
+
+		protos = append(protos, string(b[:stringLen]))
+		b = b[stringLen:]
+	}
+
+	return protos, nil
+}
+
+// Parse a supported_versions extension and returns the highest version
+// offered, or 0 if none is known. GREASE values are ignored.
+func parseSupportedVersions(b []byte) (uint16, error) {
+	if len(b) < 1 {
+		return 0, fmt.Errorf("Supported versions extension is empty.")
+	}
+
+	length := int(b[0])
+	if length > len(b[1:]) || length % 2 != 0 {
+		return 0, fmt.Errorf("Supported versions extension has an invalid length (%d)", length)
+	}
+
+	var max uint16
+	for b = b[1:1+length]; len(b) > 0; b = b[2:] {
+		v := binary.BigEndian.Uint16(b[:2])
+		if isGREASE(v) {
+			continue
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return max, nil
+}
+
+// Reports whether a value is a GREASE one (RFC 8701), of the form 0x?a?a.
+func isGREASE(v uint16) bool {
+	return v & 0x0f0f == 0x0a0a && v >> 8 == v & 0xff
+}
@@ -0,0 +1,730 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package clienthello
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func craft(bs ...[]byte) []byte {
+	var packet []byte
+	for _, b := range(bs) {
+		packet = append(packet, b...)
+	}
+	return packet
+}
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      []byte
+		success bool
+	}{
+		{
+			"Empty message",
+			[]byte{},
+			false,
+		},
+		{
+			"Truncated message #0",
+			[]byte{22},
+			false,
+		},
+		{
+			"Truncated message #2",
+			[]byte{22, 3},
+			false,
+		},
+		{
+			"Truncated message #3",
+			[]byte{22, 3, 2},
+			false,
+		},
+		{
+			"Truncated message #4",
+			[]byte{22, 3, 2, 0},
+			false,
+		},
+		{
+			"SSL 3.0",
+			[]byte{22, 3, 0, 0, 0},
+			false,
+		},
+		{
+			"TLS 1.0, empty payload",
+			[]byte{22, 3, 1, 0, 0},
+			true,
+		},
+		{
+			"TLS 1.1, empty payload",
+			[]byte{22, 3, 2, 0, 0},
+			true,
+		},
+		{
+			"TLS 1.2 or later, empty payload",
+			[]byte{22, 3, 3, 0, 0},
+			true,
+		},
+		{
+			"TLS 1.2 or later, 1b payload",
+			[]byte{22, 3, 3, 0, 1, 0},
+			true,
+		},
+		{
+			"TLS 1.2 or later, max message length payload",
+			[]byte{22, 3, 3, 64, 0},
+			true,
+		},
+		{
+			"TLS 1.2 or later, (max message length + 1) payload",
+			[]byte{22, 3, 3, 64, 1},
+			false,
+		},
+		{
+			"Wrong TLS content type",
+			[]byte{99, 3, 2, 0, 0},
+			false,
+		},
+		{
+			"Wrong TLS major version",
+			[]byte{22, 4, 2, 0, 0},
+			false,
+		},
+		{
+			"Wrong TLS minor version",
+			[]byte{22, 3, 99, 0, 0},
+			false,
+		},
+	}
+
+	for _, test := range(tests) {
+		_, err := parseRecord(bytes.NewBuffer(test.in))
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Errorf(test.desc)
+		}
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      []byte
+		success bool
+	}{
+		{
+			"Empty handshake",
+			[]byte{},
+			false,
+		},
+		{
+			"Truncated handshake #0",
+			[]byte{1, 0},
+			false,
+		},
+		{
+			"Truncated handshake #1",
+			[]byte{1, 0, 0},
+			false,
+		},
+		{
+			"Wrong message type",
+			[]byte{99, 0, 0, 0},
+			false,
+		},
+		{
+			"ClientHello handshake, no payload",
+			[]byte{1, 0, 0, 0},
+			true,
+		},
+		{
+			"ClientHello handshake, 34b payload",
+			[]byte{1, 0, 0, 34},
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		_, err := parseHandshake(bytes.NewBuffer(test.in))
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Errorf(test.desc)
+		}
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      []byte
+		success bool
+	}{
+		{
+			"Empty message",
+			[]byte{},
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, no payload",
+			craft([]byte{3, 3}, make([]byte, 32)),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, 0'ed payload",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 0, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS1.0, valid payload",
+			craft([]byte{3, 1}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			true,
+		},
+		{
+			"ClientHello TLS1.1, valid payload",
+			craft([]byte{3, 2}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			true,
+		},
+		{
+			"ClientHello TLS 1.2 or later, valid payload",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			true,
+		},
+		{
+			"ClientHello wrong TLS major version",
+			craft([]byte{4, 2}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello wrong TLS minor version",
+			craft([]byte{3, 99}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, max session ID length",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{32}, make([]byte, 32),
+			      []byte{0, 2, 0, 0, 1, 0}),
+			true,
+		},
+		{
+			"ClientHello TLS 1.2 or later, (max + 1) session ID length",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{33}, make([]byte, 33),
+			      []byte{0, 2, 0, 0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, invalid cipher suites length #0",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 1, 0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, invalid cipher suites length #1",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 33}, make([]byte, 33),
+			      []byte{0, 1, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, invalid compression methods length",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 1, 0, 0}),
+			false,
+		},
+		{
+			"ClientHello TLS 1.2 or later, valid payload, max size",
+			craft([]byte{3, 3}, make([]byte, 32), []byte{32}, make([]byte, 32),
+			      []byte{0xff, 0xfe}, make([]byte, 0xfffe),
+			      []byte{0xff}, make([]byte, 0xff)),
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		_, err := parseClientHello(bytes.NewBuffer(test.in))
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Errorf(test.desc)
+		}
+	}
+}
+
+func TestParseSNI(t *testing.T) {
+	tests := []struct{
+		desc    string
+		in      []byte
+		out     string
+		success bool
+	}{
+		{
+			"Empty SNI extension",
+			[]byte{},
+			"",
+			false,
+		},
+		{
+			"Invalid SNI extension vector",
+			[]byte{0},
+			"",
+			false,
+		},
+		{
+			"Empty SNI extension",
+			[]byte{0, 0},
+			"",
+			true,
+		},
+		{
+			"Invalid SNI vector",
+			[]byte{0, 2, 0, 0},
+			"",
+			true,
+		},
+		{
+			"Empty SNI vector",
+			[]byte{0, 3, 0, 0, 0},
+			"",
+			true,
+		},
+		{
+			"Invalid name type",
+			[]byte{0, 6, 1, 0, 3, 1, 2, 3},
+			"",
+			true,
+		},
+		{
+			"Valid SNI",
+			craft([]byte{0, 14, 0, 0, 11}, []byte("example.net")),
+			"example.net",
+			true,
+		},
+		{
+			"Fully qualified SNI",
+			craft([]byte{0, 15, 0, 0, 12}, []byte("example.net.")),
+			"example.net",
+			true,
+		},
+		{
+			"Root SNI",
+			craft([]byte{0, 4, 0, 0, 1}, []byte(".")),
+			"",
+			true,
+		},
+		{
+			"Multiple SNI vectors",
+			craft([]byte{0, 28, 0, 0, 11}, []byte("example.net"),
+			      []byte{0, 0, 11}, []byte("example.org")),
+			"example.net",
+			true,
+		},
+		{
+			"SNI in second vector",
+			craft([]byte{0, 22, 1, 0, 5, 1, 2, 3, 4, 5},
+			      []byte{0, 0, 11}, []byte("example.net")),
+			"example.net",
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		sni, err := parseSNI(test.in)
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Errorf(test.desc)
+		}
+		if sni != test.out {
+			t.Errorf("%s: wrong SNI: got '%s', wanted '%s'", test.desc, sni, test.out)
+		}
+	}
+}
+
+func TestParseALPN(t *testing.T) {
+	tests := []struct{
+		desc    string
+		in      []byte
+		out     []string
+		success bool
+	}{
+		{
+			"Empty ALPN extension",
+			[]byte{},
+			nil,
+			false,
+		},
+		{
+			"Invalid ALPN extension vector",
+			[]byte{0, 4, 2},
+			nil,
+			false,
+		},
+		{
+			"Invalid protocol length",
+			craft([]byte{0, 3, 3}, []byte("h2")),
+			nil,
+			false,
+		},
+		{
+			"Single protocol",
+			craft([]byte{0, 3, 2}, []byte("h2")),
+			[]string{"h2"},
+			true,
+		},
+		{
+			"Multiple protocols",
+			craft([]byte{0, 23, 2}, []byte("h2"), []byte{8}, []byte("http/1.1"),
+			      []byte{10}, []byte("acme-tls/1")),
+			[]string{"h2", "http/1.1", "acme-tls/1"},
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		protos, err := parseALPN(test.in)
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Errorf(test.desc)
+		}
+		if strings.Join(protos, ",") != strings.Join(test.out, ",") {
+			t.Errorf("%s: wrong protocols: got %v, wanted %v", test.desc, protos, test.out)
+		}
+	}
+}
+
+func TestParseSupportedVersions(t *testing.T) {
+	tests := []struct{
+		desc    string
+		in      []byte
+		out     uint16
+		success bool
+	}{
+		{
+			"Empty extension",
+			[]byte{},
+			0,
+			false,
+		},
+		{
+			"Truncated version list",
+			[]byte{4, 3, 4},
+			0,
+			false,
+		},
+		{
+			"Odd version list length",
+			[]byte{1, 3},
+			0,
+			false,
+		},
+		{
+			"TLS 1.3 and TLS 1.2",
+			[]byte{4, 3, 4, 3, 3},
+			0x304,
+			true,
+		},
+		{
+			"Unordered versions",
+			[]byte{6, 3, 1, 3, 4, 3, 2},
+			0x304,
+			true,
+		},
+		{
+			"GREASE values ignored",
+			[]byte{6, 0xfa, 0xfa, 3, 4, 0x3a, 0x3a},
+			0x304,
+			true,
+		},
+		{
+			"Only GREASE values",
+			[]byte{2, 0x0a, 0x0a},
+			0,
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		v, err := parseSupportedVersions(test.in)
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Errorf(test.desc)
+		}
+		if v != test.out {
+			t.Errorf("%s: wrong version: got %#x, wanted %#x", test.desc, v, test.out)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	hello := craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0})
+
+	tests := []struct {
+		desc    string
+		in      []byte
+		version uint16
+		name    string
+	}{
+		{
+			"Legacy version only",
+			record(hello),
+			0x303,
+			"TLS 1.2",
+		},
+		{
+			"TLS 1.3 advertised in supported_versions",
+			record(craft(hello, []byte{0, 11, 0, 43, 0, 7, 6, 0x2a, 0x2a, 3, 4, 3, 3})),
+			0x304,
+			"TLS 1.3",
+		},
+		{
+			"TLS 1.0 ClientHello",
+			record(craft([]byte{3, 1}, hello[2:])),
+			0x301,
+			"TLS 1.0",
+		},
+	}
+
+	for _, test := range(tests) {
+		info, _, err := Parse(bytes.NewBuffer(test.in))
+		if err != nil {
+			t.Errorf("%s: unexpected error (%s)", test.desc, err)
+			continue
+		}
+		if info.Version != test.version || info.VersionName() != test.name {
+			t.Errorf("%s: got %#x/%q, wanted %#x/%q", test.desc, info.Version, info.VersionName(), test.version, test.name)
+		}
+	}
+}
+
+// Wraps a ClientHello body into a handshake message and a TLS record.
+func record(hello []byte) []byte {
+	n := len(hello)
+	return craft([]byte{22, 3, 1, byte((n + 4) >> 8), byte(n + 4)},
+		     []byte{1, byte(n >> 16), byte(n >> 8), byte(n)}, hello)
+}
+
+// Returns the content of a captured ClientHello fixture.
+func fixture(t *testing.T, name string) []byte {
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Splits a ClientHello record into multiple records, each fragment containing
+// at most size bytes of the handshake message.
+func fragment(in []byte, size int) []byte {
+	var out []byte
+	for payload := in[5:]; len(payload) > 0; {
+		n := size
+		if n > len(payload) {
+			n = len(payload)
+		}
+		out = craft(out, []byte{22, 3, 1, byte(n >> 8), byte(n)}, payload[:n])
+		payload = payload[n:]
+	}
+	return out
+}
+
+func TestParseSNIPresence(t *testing.T) {
+	hello := craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 2, 0, 0, 1, 0})
+
+	tests := []struct {
+		desc   string
+		in     []byte
+		hasSNI bool
+		sni    string
+	}{
+		{
+			"No extension",
+			record(hello),
+			false,
+			"",
+		},
+		{
+			"No SNI extension",
+			record(craft(hello, []byte{0, 6, 0, 16, 0, 2, 0, 0})),
+			false,
+			"",
+		},
+		{
+			"SNI extension without a host name",
+			record(craft(hello, []byte{0, 9, 0, 0, 0, 5, 0, 3, 1, 0, 0})),
+			true,
+			"",
+		},
+		{
+			"SNI extension with a host name",
+			record(craft(hello, []byte{0, 10, 0, 0, 0, 6, 0, 4, 0, 0, 1, 'a'})),
+			true,
+			"a",
+		},
+	}
+
+	for _, test := range(tests) {
+		info, _, err := Parse(bytes.NewBuffer(test.in))
+		if err != nil {
+			t.Errorf("%s: unexpected error (%s)", test.desc, err)
+			continue
+		}
+		if info.HasSNI != test.hasSNI || info.SNI != test.sni {
+			t.Errorf("%s: got %v/%q, wanted %v/%q", test.desc, info.HasSNI, info.SNI, test.hasSNI, test.sni)
+		}
+	}
+}
+
+func TestParseFixtures(t *testing.T) {
+	tests := []struct {
+		desc    string
+		file    string
+		sni     string
+		alpn    []string
+		version uint16
+	}{
+		{
+			"TLS 1.3 ClientHello with SNI and ALPN",
+			"sni-alpn.bin",
+			"example.net",
+			[]string{"h2", "http/1.1"},
+			0x304,
+		},
+		{
+			"TLS 1.3 ClientHello without SNI",
+			"no-sni.bin",
+			"",
+			nil,
+			0x304,
+		},
+		{
+			"TLS 1.2 ClientHello",
+			"tls12.bin",
+			"www.example.com",
+			nil,
+			0x303,
+		},
+	}
+
+	for _, test := range(tests) {
+		in := fixture(t, test.file)
+
+		// Data following the ClientHello must not be consumed.
+		r := bytes.NewBuffer(craft(in, []byte("trailing")))
+		info, peeked, err := Parse(r)
+		if err != nil {
+			t.Errorf("%s: unexpected error (%s)", test.desc, err)
+			continue
+		}
+		if info.SNI != test.sni || info.HasSNI != (test.sni != "") {
+			t.Errorf("%s: wrong SNI: got %q, wanted %q", test.desc, info.SNI, test.sni)
+		}
+		if strings.Join(info.ALPN, ",") != strings.Join(test.alpn, ",") {
+			t.Errorf("%s: wrong protocols: got %v, wanted %v", test.desc, info.ALPN, test.alpn)
+		}
+		if info.Version != test.version {
+			t.Errorf("%s: wrong version: got %#x, wanted %#x", test.desc, info.Version, test.version)
+		}
+		if !bytes.Equal(peeked, in) || r.String() != "trailing" {
+			t.Errorf("%s: wrong bytes consumed", test.desc)
+		}
+
+		sni, peeked, err := ParseSNI(bytes.NewBuffer(in))
+		if err != nil || sni != test.sni || !bytes.Equal(peeked, in) {
+			t.Errorf("%s: ParseSNI mismatch (%v)", test.desc, err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	in := fixture(t, "sni-alpn.bin")
+
+	// Follow the first fragment of a ClientHello with a non-handshake
+	// record.
+	fragmented := craft(fragment(in, 100)[:105], []byte{23, 3, 1, 0, 1, 0})
+
+	tests := []struct {
+		desc   string
+		in     []byte
+		peeked int
+	}{
+		{
+			"Truncated record",
+			in[:100],
+			100,
+		},
+		{
+			"Not a handshake",
+			craft([]byte{23}, in[1:]),
+			5,
+		},
+		{
+			"Empty record",
+			craft([]byte{22, 3, 1, 0, 0}, in),
+			5,
+		},
+		{
+			"Fragmented ClientHello followed by a non-handshake record",
+			fragmented,
+			110,
+		},
+		{
+			"ClientHello length exceeding the maximum",
+			[]byte{22, 3, 1, 0, 4, 1, 1, 0, 1},
+			9,
+		},
+	}
+
+	for _, test := range(tests) {
+		_, peeked, err := Parse(bytes.NewBuffer(test.in))
+		if err == nil {
+			t.Errorf("%s: expected an error", test.desc)
+		}
+		// Bytes read must be returned so they can still be replayed.
+		if !bytes.Equal(peeked, test.in[:test.peeked]) {
+			t.Errorf("%s: got %d peeked bytes, wanted %d", test.desc, len(peeked), test.peeked)
+		}
+	}
+}
+
+func TestParseFragmented(t *testing.T) {
+	in := fixture(t, "sni-alpn.bin")
+
+	tests := []struct {
+		desc string
+		in   []byte
+	}{
+		{
+			"ClientHello split into two records",
+			fragment(in, 200),
+		},
+		{
+			"Handshake header split across records",
+			fragment(in, 2),
+		},
+		{
+			"ClientHello split into many records",
+			fragment(in, 50),
+		},
+	}
+
+	for _, test := range(tests) {
+		r := bytes.NewBuffer(craft(test.in, []byte("trailing")))
+		info, peeked, err := Parse(r)
+		if err != nil {
+			t.Errorf("%s: unexpected error (%s)", test.desc, err)
+			continue
+		}
+		if info.SNI != "example.net" {
+			t.Errorf("%s: wrong SNI: got %q", test.desc, info.SNI)
+		}
+		// All records must be forwarded verbatim.
+		if !bytes.Equal(peeked, test.in) || r.String() != "trailing" {
+			t.Errorf("%s: wrong bytes consumed", test.desc)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package clienthello
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Hello holds the ClientHello fields identifying the client software, in the
+// client's order. GREASE values are left out.
+type Hello struct {
+	// Legacy version field.
+	Version             uint16
+	CipherSuites        []uint16
+	// Types of the extensions.
+	Extensions          []uint16
+	// Groups from the supported_groups extension.
+	Groups              []uint16
+	// Formats from the ec_point_formats extension.
+	PointFormats        []uint8
+	// Algorithms from the signature_algorithms extension.
+	SignatureAlgorithms []uint16
+	// Groups of the key shares sent in the key_share extension.
+	KeyShares           []uint16
+}
+
+// Returns the JA3 string of a ClientHello: the version, cipher suites,
+// extensions, groups and point formats, in decimal.
+func (h *Hello) JA3() string {
+	formats := make([]uint16, len(h.PointFormats))
+	for i, f := range(h.PointFormats) {
+		formats[i] = uint16(f)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinValues(h.CipherSuites),
+		joinValues(h.Extensions),
+		joinValues(h.Groups),
+		joinValues(formats),
+	}, ",")
+}
+
+// Returns the JA3 fingerprint of a ClientHello, the MD5 hash of its JA3 string.
+func (h *Hello) Fingerprint() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the JA3 fingerprint of a ClientHello. raw holds the TLS records
+// carrying it, as returned by Parse, or the handshake message itself as carried
+// by QUIC.
+func FingerprintClientHello(raw []byte) (string, error) {
+	h, err := ParseHello(raw)
+	if err != nil {
+		return "", err
+	}
+	return h.Fingerprint(), nil
+}
+
+// Same as FingerprintClientHello, returning an empty string if the ClientHello
+// could not be parsed.
+func FingerprintJA3(raw []byte) string {
+	fp, err := FingerprintClientHello(raw)
+	if err != nil {
+		return ""
+	}
+	return fp
+}
+
+// Extracts the fields identifying the client software from a ClientHello. raw
+// holds the TLS records carrying it, or the handshake message itself.
+func ParseHello(raw []byte) (*Hello, error) {
+	msg := raw
+	if len(raw) > 0 && raw[0] == 22 {
+		var err error
+		if msg, err = readMessage(bytes.NewReader(raw)); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := parseInfo(msg)
+	if err != nil {
+		return nil, err
+	}
+	if info.helloErr != nil {
+		return nil, info.helloErr
+	}
+	return info.Hello, nil
+}
+
+// Records an extension of the ClientHello, parsing the ones identifying the
+// client software.
+func (h *Hello) addExtension(extType uint16, ext []byte) error {
+	if isGREASE(extType) {
+		return nil
+	}
+	h.Extensions = append(h.Extensions, extType)
+
+	var err error
+	switch (extType) {
+	// Supported groups.
+	case 10:
+		h.Groups, err = parseList(ext)
+		break
+	// EC point formats.
+	case 11:
+		if len(ext) < 1 || int(ext[0]) > len(ext[1:]) {
+			return fmt.Errorf("EC point formats extension is too short.")
+		}
+		h.PointFormats = append([]uint8{}, ext[1:1+ext[0]]...)
+		break
+	// Signature algorithms.
+	case 13:
+		h.SignatureAlgorithms, err = parseList(ext)
+		break
+	// Key share.
+	case 51:
+		h.KeyShares, err = parseKeyShares(ext)
+		break
+	}
+	return err
+}
+
+// Parses a list of 16-bit values, dropping GREASE ones.
+func parseValues(b []byte) ([]uint16, error) {
+	if len(b) % 2 != 0 {
+		return nil, fmt.Errorf("Invalid list length (%d)", len(b))
+	}
+
+	var values []uint16
+	for ; len(b) > 0; b = b[2:] {
+		if v := binary.BigEndian.Uint16(b[:2]); !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// Parses an extension holding a vector of 16-bit values.
+func parseList(b []byte) ([]uint16, error) {
+	v, err := parseVector(bytes.NewReader(b), 2)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read TLS extension (%w)", err)
+	}
+	return parseValues(v)
+}
+
+// Parses a key_share extension and returns the groups of the shares.
+func parseKeyShares(b []byte) ([]uint16, error) {
+	v, err := parseVector(bytes.NewReader(b), 2)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read key share extension (%w)", err)
+	}
+
+	var groups []uint16
+	for len(v) > 0 {
+		if len(v) < 4 {
+			return nil, fmt.Errorf("Key share extension is too short.")
+		}
+		group := binary.BigEndian.Uint16(v[:2])
+		length := int(binary.BigEndian.Uint16(v[2:4]))
+		if length > len(v[4:]) {
+			return nil, fmt.Errorf("Key share is too short.")
+		}
+		if !isGREASE(group) {
+			groups = append(groups, group)
+		}
+		v = v[4+length:]
+	}
+	return groups, nil
+}
+
+// Joins values with dashes, as done in JA3 strings.
+func joinValues(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range(values) {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
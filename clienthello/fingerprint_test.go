@@ -0,0 +1,156 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package clienthello
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseHello(t *testing.T) {
+	hello := craft([]byte{3, 3}, make([]byte, 32), []byte{0},
+		       // Cipher suites, the first one being GREASE.
+		       []byte{0, 6, 0x0a, 0x0a, 0x13, 0x01, 0xc0, 0x2f},
+		       []byte{1, 0},
+		       []byte{0, 59},
+		       // GREASE extension.
+		       []byte{0x1a, 0x1a, 0, 0},
+		       // SNI.
+		       []byte{0, 0, 0, 6, 0, 4, 0, 0, 1, 'a'},
+		       // Supported groups, the first one being GREASE.
+		       []byte{0, 10, 0, 8, 0, 6, 0x2a, 0x2a, 0, 29, 0, 23},
+		       // EC point formats.
+		       []byte{0, 11, 0, 2, 1, 0},
+		       // Signature algorithms.
+		       []byte{0, 13, 0, 6, 0, 4, 4, 3, 8, 4},
+		       // Key shares, the first one being GREASE.
+		       []byte{0, 51, 0, 13, 0, 11, 0x2a, 0x2a, 0, 1, 0, 0, 29, 0, 2, 0xaa, 0xbb})
+
+	want := &Hello{
+		Version: 0x303,
+		CipherSuites: []uint16{ 0x1301, 0xc02f },
+		Extensions: []uint16{ 0, 10, 11, 13, 51 },
+		Groups: []uint16{ 29, 23 },
+		PointFormats: []uint8{ 0 },
+		SignatureAlgorithms: []uint16{ 0x403, 0x804 },
+		KeyShares: []uint16{ 29 },
+	}
+
+	in := record(hello)
+	h, err := ParseHello(in)
+	if err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("Got %+v, wanted %+v", h, want)
+	}
+	if ja3 := h.JA3(); ja3 != "771,4865-49199,0-10-11-13-51,29-23,0" {
+		t.Errorf("Wrong JA3 string %q", ja3)
+	}
+
+	// The fields are extracted when parsing the ClientHello for routing.
+	info, _, err := Parse(bytes.NewReader(in))
+	if err != nil || !reflect.DeepEqual(info.Hello, want) {
+		t.Errorf("Got %+v from Parse, wanted %+v (%v)", info, want, err)
+	}
+
+	// Records and bare handshake messages give the same fingerprint.
+	for _, raw := range([][]byte{ in, in[5:], fragment(in, 10) }) {
+		fp, err := FingerprintClientHello(raw)
+		if err != nil || fp != "40dd2a2184b94cda37a2732aa0fceab0" {
+			t.Errorf("Wrong fingerprint %q (%v)", fp, err)
+		}
+	}
+}
+
+func TestFingerprintErrors(t *testing.T) {
+	in := fixture(t, "sni-alpn.bin")
+
+	tests := []struct {
+		desc string
+		in   []byte
+	}{
+		{
+			"Empty",
+			nil,
+		},
+		{
+			"Truncated record",
+			in[:len(in) - 1],
+		},
+		{
+			"Truncated message",
+			in[5:len(in) - 1],
+		},
+		{
+			"Truncated key share",
+			record(craft([]byte{3, 3}, make([]byte, 32), []byte{0, 0, 2, 0x13, 0x01, 1, 0},
+				     []byte{0, 10, 0, 51, 0, 6, 0, 4, 0, 29, 0, 32})),
+		},
+	}
+
+	for _, test := range(tests) {
+		if _, err := FingerprintClientHello(test.in); err == nil {
+			t.Errorf("%s: no error", test.desc)
+		}
+	}
+
+	if _, err := FingerprintClientHello(in); err != nil {
+		t.Errorf("Fixture: unexpected error (%s)", err)
+	}
+
+	// A ClientHello which can't be fingerprinted can still be routed.
+	info, err := ParseMessage(tests[3].in[5:])
+	if err != nil || info.Hello != nil {
+		t.Errorf("Got %+v parsing a truncated key share (%v)", info, err)
+	}
+}
+
+func TestFingerprintJA3(t *testing.T) {
+	// Example given by the reference implementation,
+	// https://github.com/salesforce/ja3
+	h := &Hello{
+		Version: 769,
+		CipherSuites: []uint16{ 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4 },
+		Extensions: []uint16{ 0, 10, 11 },
+		Groups: []uint16{ 23, 24, 25 },
+		PointFormats: []uint8{ 0 },
+	}
+	if ja3 := h.JA3(); ja3 != "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0" {
+		t.Errorf("Wrong JA3 string %q", ja3)
+	}
+	if fp := h.Fingerprint(); fp != "ada70206e40642a3e4461f35503241d5" {
+		t.Errorf("Wrong fingerprint %q", fp)
+	}
+
+	// The same ClientHello, on the wire.
+	hello := craft([]byte{3, 1}, make([]byte, 32), []byte{0},
+		       []byte{0, 24, 0, 47, 0, 53, 0, 5, 0, 10, 0xc0, 0x09, 0xc0, 0x0a,
+			      0xc0, 0x13, 0xc0, 0x14, 0, 50, 0, 56, 0, 19, 0, 4},
+		       []byte{1, 0},
+		       []byte{0, 32},
+		       []byte{0, 0, 0, 10, 0, 8, 0, 0, 5, 'a', '.', 'b', 'c', 'd'},
+		       []byte{0, 10, 0, 8, 0, 6, 0, 23, 0, 24, 0, 25},
+		       []byte{0, 11, 0, 2, 1, 0})
+	if fp := FingerprintJA3(record(hello)); fp != "ada70206e40642a3e4461f35503241d5" {
+		t.Errorf("Wrong fingerprint %q on the wire", fp)
+	}
+
+	if fp := FingerprintJA3([]byte{22, 3, 1}); fp != "" {
+		t.Errorf("Got fingerprint %q for a truncated ClientHello", fp)
+	}
+}
@@ -16,43 +16,244 @@
 package config
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
+	"math/rand/v2"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atenart/sniproxy/acme"
+	"github.com/atenart/sniproxy/ratelimit"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/proxy"
 )
 
 // Config holds the entire current configuration.
 type Config struct {
-	Routes  []*Route
+	Routes          []*Route
+	// Route used when no other one matches, if any.
+	Default         *Route
+	// Route used for connections without an SNI extension, if any.
+	// Those connections are closed otherwise.
+	NoSNI           *Route
+	// Route used for connections not starting with a TLS handshake record,
+	// if any. Those connections are closed otherwise.
+	NonTLS          *Route
+	// Limits the rate of new connections per client, if set.
+	RateLimit       *ratelimit.Limiter
+	// TCP keepalive period used for both ends of proxied connections, 0 if
+	// disabled.
+	KeepAlive       time.Duration
+	// Inbound connections start with a PROXY header (v1 or v2).
+	AcceptProxy     bool
+	// PROXY headers sent to backends carry the addresses read from the
+	// inbound header (the default), instead of the immediate peer ones.
+	ProxyPreserve   bool
+	// Database used for country based access control, if set.
+	GeoIP           GeoIP
+	// Wildcards only match within a label, instead of any string.
+	StrictWildcards bool
+	// Maximum number of concurrent connections, 0 if unlimited. Once
+	// reached, new connections are closed, or wait for a slot if
+	// MaxConnsPause is set (which pauses accepting connections).
+	MaxConns        int
+	MaxConnsPause   bool
+	// Maximum number of concurrent connections per client IP, 0 if
+	// unlimited.
+	MaxConnsPerIP   int
+
+	// Domains without wildcards, for exact lookups, wildcards covering
+	// a whole leading label (*.example.net), indexed by suffix, and the
+	// other patterns. All are built once the configuration is parsed.
+	exact           map[string][]*entry
+	suffixes        *trieNode
+	patterns        []*entry
+}
+
+// Domain of a route, as indexed for matching.
+type entry struct {
+	route       *Route
+	domain      *Domain
+	// See specificity.
+	specificity int
+	// Position of the domain in the configuration, to break ties.
+	order       int
+}
+
+// Node of a trie of domain labels, from the top-level domain down.
+type trieNode struct {
+	children  map[string]*trieNode
+	// Wildcards whose literal suffix ends at this node.
+	wildcards []*entry
 }
 
 // Route represents a route between matched domains and a backend.
 type Route struct {
-	Domains   []*regexp.Regexp
-	// Default backend.
-	Backend   *Backend
+	Domains      []*Domain
+	// Default backends, used in a weighted round-robin fashion. Backends
+	// dedicated to some protocols are tried first, in order, for clients
+	// offering them.
+	Backends     []*Backend
+	// Interval between two backend health checks, 0 if disabled.
+	HealthCheck  time.Duration
 	// Backend for ACME.
-	ACME      *Backend
+	ACME         *Backend
+	// Answers ACME TLS-ALPN-01 challenges locally, instead of a backend.
+	ACMESelf     *acme.Responder
+	// Terminates client TLS connections and originates new ones to the
+	// backends, instead of passing connections through. Nil by default.
+	TLSBackend   *TLSBackend
 	// Bypass ACLs for ACME.
-	AllowACME bool
+	AllowACME    bool
 	// Deny and Allow contain lists of IP ranges and/or addresses to
 	// whitelist or blacklist for a given route. If Allow is used, all
 	// addresses are then blocked by default.
 	// The more specific subnet takes precedence, and Deny wins over Allow
 	// in case none is more specific.
-	Deny      []*net.IPNet
-	Allow     []*net.IPNet
+	Deny         []*net.IPNet
+	Allow        []*net.IPNet
+	// Same as Deny and Allow, using ISO 3166-1 country codes. Country rules
+	// are less specific than any IP range, except 0.0.0.0/0 and ::/0.
+	DenyCountry  []string
+	AllowCountry []string
+	// JA3 fingerprints of the client software denied or allowed, in
+	// lowercase hexadecimal. If AllowJA3 is used, other fingerprints are
+	// denied. Deny wins over Allow.
+	DenyJA3      []string
+	AllowJA3     []string
+	// Limits the rate of connections per client to the route, if set.
+	RateLimit    *ratelimit.Limiter
+	// Maximum throughput of each connection, in bytes per second and per
+	// direction, 0 if unlimited.
+	RateBytes    int
+	// Proxied connections are closed after this long, regardless of their
+	// activity. 0 if unlimited.
+	MaxDuration  time.Duration
+	// ALPN protocols the route is restricted to, if any. Clients must offer
+	// at least one of them.
+	ALPN         []string
+	// Local port the route is restricted to, if not 0. Connections
+	// received on other ports don't match it.
+	Port         int
+	// Strategy used to choose a backend.
+	Balance      uint
+	// Number of times to retry connecting to a backend, the next backend
+	// being tried if there are several.
+	Retries      int
+	// Whether connections matching the route are access logged.
+	Log          bool
+	// Whether Nagle's algorithm is disabled (TCP_NODELAY) on both ends of
+	// the proxied connections, as done by default.
+	NoDelay      bool
+	// Connections matching a route in maintenance are closed instead of
+	// being routed.
+	Maintenance  bool
+	// Operational metadata ("# @key value" comment lines preceding the
+	// route), e.g. its owner.
+	Annotations  map[string]string
+
+	// Subnets added to Deny when an allow list is used, denying all other
+	// IPs by default.
+	defaultDeny  []*net.IPNet
+	// Protects the backends selection state.
+	mu           sync.Mutex
+	// Index of the first backend to consider for least-conn.
+	next         int
+}
+
+// Domain represents a domain pattern a route matches on.
+type Domain struct {
+	// nil for the default route.
+	*regexp.Regexp
+	// Pattern as written in the configuration.
+	Pattern string
+	// Line the domain was defined at.
+	Line    uint
+
+	// Pattern in its ASCII form.
+	ascii   string
 }
 
 // Backend represents a backend and its options.
 type Backend struct {
-	Address   string
+	Address       string
 	// HAProxy PROXY protocol support (None, v1, v2).
-	SendProxy uint
+	SendProxy     uint
+	// Types of the TLVs to append to PROXY v2 headers.
+	SendProxyTLVs []uint8
+	// Custom TLVs with static values to append to PROXY v2 headers.
+	SendProxyTags []ProxyTag
+	// Append a PROXY v2 SSL TLV describing the client's TLS handshake.
+	SendProxySSL  bool
+	// Local address connections to the backend originate from, if set.
+	Source        net.IP
+	// Address of the SOCKS5 proxy connections to the backend go through,
+	// if set.
+	SOCKS5        string
+	// Destination address reported in PROXY headers, the local address of
+	// the client connection being used if nil.
+	ProxyDest     *net.TCPAddr
+	// Maximum time to establish a connection to the backend.
+	DialTimeout   time.Duration
+	// Connections with no activity in both directions for this long are
+	// closed. 0 disables the timeout.
+	IdleTimeout   time.Duration
+	// Maximum number of concurrent connections, 0 if unlimited.
+	MaxConns      int
+	// Time to wait for a connection slot when all backends are saturated.
+	// Connections are rejected right away if 0.
+	MaxConnsQueue time.Duration
+	// Relative share of the connections the backend gets. Backends with a
+	// weight of 0 are never selected.
+	Weight        int
+	// Protocols the backend is dedicated to. If set, the backend is only
+	// selected for clients offering one of them, before the others.
+	ALPN          []string
+	// Host names are resolved at most once per DNSTTL when set, instead of
+	// on each dial. Resolved addresses are tried in order, starting from
+	// the next one on each dial if DNSRoundRobin is set.
+	DNSTTL        time.Duration
+	DNSRoundRobin bool
+
+	// Addresses the host name resolved to, when DNSTTL is set.
+	dns           dnsCache
+	// Unhealthy backends are skipped when choosing one.
+	mu            sync.Mutex
+	healthy       bool
+	// Connections being routed to the backend, accessed atomically.
+	active        int32
+	// Smooth weighted round-robin state, protected by the route's mutex.
+	current       int
 }
 
+// Balance possible values. Round-robin takes the backends weight into account,
+// weighted being an alias. Source hashes the client IP, so a client always
+// gets the same backend while the healthy ones do not change. Random picks
+// backends at random, proportionally to their weight.
+const (
+	BalanceRoundRobin = iota
+	BalanceLeastConn  = iota
+	BalanceWeighted   = iota
+	BalanceSource     = iota
+	BalanceRandom     = iota
+)
+
 // SendProxy possible values.
 const (
 	ProxyNone = iota
@@ -60,152 +261,2098 @@ const (
 	ProxyV2   = iota
 )
 
-// Reads a configuration file and transforms it into a Config struct.
+// SendProxyTLVs possible values, matching the PROXY v2 TLV types.
+const (
+	// Protocol preferred by the client, from the TLS ALPN extension.
+	ProxyTLVALPN      = 0x01
+	// Host name requested by the client, from the TLS SNI extension.
+	ProxyTLVAuthority = 0x02
+)
+
+// Custom types range of PROXY v2 TLVs.
+const (
+	ProxyTLVMinCustom = 0xe0
+	ProxyTLVMaxCustom = 0xef
+)
+
+// TLSBackend configures routes re-encrypting connections.
+type TLSBackend struct {
+	// Certificate presented to clients.
+	Certificate tls.Certificate
+	// Authorities backend certificates are verified against, the system
+	// ones if nil.
+	RootCAs     *x509.CertPool
+	// Name backend certificates are verified against, the SNI if empty.
+	ServerName  string
+	// Skips the verification of backend certificates.
+	Insecure    bool
+}
+
+// ProxyTag is a custom PROXY v2 TLV with a static value.
+type ProxyTag struct {
+	Type  uint8
+	Value string
+}
+
+// ParseError reports an invalid directive found while parsing a configuration.
+type ParseError struct {
+	// Name of the offending directive.
+	Directive string
+	File      string
+	Line      uint
+	Msg       string
+}
+
+func (e *ParseError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s (%s:%d)", e.Msg, e.File, e.Line)
+	}
+	return fmt.Sprintf("%s (line %d)", e.Msg, e.Line)
+}
+
+// Returns a ParseError for a given directive.
+func parseError(d *Directive, format string, v ...interface{}) *ParseError {
+	return &ParseError{
+		Directive: d.Name,
+		File: d.File,
+		Line: d.Line,
+		Msg: fmt.Sprintf(format, v...),
+	}
+}
+
+// Reads a configuration file and transforms it into a Config struct. The
+// configuration is read from stdin if file is "-".
 func (c *Config) ReadFile(file string) error {
-	f, err := os.Open(file)
+	if file == "-" {
+		return c.Read(os.Stdin)
+	}
+
+	root, err := readDirectives(file, nil)
+	if err != nil {
+		return err
+	}
+	return c.parse(root)
+}
+
+// Reads a configuration from r and transforms it into a Config struct. Relative
+// include patterns are resolved against the current directory.
+func (c *Config) Read(r io.Reader) error {
+	root, err := readDirectivesFrom(r, "", nil)
 	if err != nil {
 		return err
 	}
+	return c.parse(root)
+}
+
+// Reads the directives of a configuration file. Top-level include directives
+// are replaced by the directives of the files they match; relative patterns are
+// resolved against the directory of the including file. Files being included
+// are tracked in stack, to detect cycles.
+func readDirectives(file string, stack []string) (*Directive, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 
-	l := newLexer(f)
-	c.parse(parseDirective(&l))
+	if fi, err := f.Stat(); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", file)
+	}
 
-	return nil
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	return readDirectivesFrom(f, file, append(stack, abs))
+}
+
+// Reads directives from r, file being the name of the file they come from, if
+// any, and resolves their include directives (see readDirectives).
+func readDirectivesFrom(r io.Reader, file string, stack []string) (*Directive, error) {
+	l := newLexer(r)
+	root := parseDirective(&l)
+	root.setFile(file)
+
+	var directives []*Directive
+	for _, d := range(root.Directives) {
+		if d.Name != "include" {
+			directives = append(directives, d)
+			continue
+		}
+
+		if len(d.Args) != 1 {
+			return nil, parseError(d, "Invalid include directive")
+		}
+		if err := d.expand(); err != nil {
+			return nil, err
+		}
+
+		pattern := d.Args[0]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, parseError(d, "Invalid include pattern %q (%s)", d.Args[0], err)
+		}
+
+		for _, match := range(matches) {
+			if included, _ := filepath.Abs(match); contains(stack, included) {
+				return nil, parseError(d, "Include cycle detected (%s)", match)
+			}
+
+			sub, err := readDirectives(match, stack)
+			if err != nil {
+				if _, ok := err.(*ParseError); ok {
+					return nil, err
+				}
+				return nil, parseError(d, "Could not include %q (%s)", match, err)
+			}
+			directives = append(directives, sub.Directives...)
+		}
+	}
+	root.Directives = directives
+
+	return root, nil
+}
+
+// Reports whether a list of strings contains a given one.
+func contains(list []string, s string) bool {
+	for _, e := range(list) {
+		if e == s {
+			return true
+		}
+	}
+	return false
 }
 
 // Parses the directives generated by the parser and generate the configuration.
-func (c *Config) parse(root *Directive) {
+// Domains are compiled here so an invalid one is reported before the
+// configuration is used. The GeoIP database is closed if the configuration is
+// invalid.
+func (c *Config) parse(root *Directive) (err error) {
+	defer func() {
+		if err != nil {
+			c.Close()
+			c.GeoIP = nil
+		}
+	}()
+
+	var noSNI, nonTLS, countryRule *Directive
+	var dnsTTL time.Duration
+	var dnsRoundRobin bool
+	c.KeepAlive = time.Minute
+	c.ProxyPreserve = true
+
+	if err := root.expand(); err != nil {
+		return err
+	}
+
+	// The wildcards mode applies to all domains, whatever the directive
+	// position.
+	for _, directive := range(root.Directives) {
+		if directive.Name != "wildcards" {
+			continue
+		}
+		if len(directive.Args) != 1 || (directive.Args[0] != "strict" && directive.Args[0] != "greedy") {
+			return parseError(directive, "Invalid wildcards directive (strict or greedy)")
+		}
+		c.StrictWildcards = directive.Args[0] == "strict"
+	}
+
 	for _, directive := range(root.Directives) {
-		route := &Route{}
+		// Global directives.
+		switch directive.Name {
+		case "wildcards":
+			continue
+		case "no-sni":
+			if noSNI != nil || len(directive.Args) != 1 {
+				return parseError(directive, "Invalid no-sni directive")
+			}
+			noSNI = directive
+			continue
+		case "non-tls":
+			if nonTLS != nil || len(directive.Args) != 1 {
+				return parseError(directive, "Invalid non-tls directive")
+			}
+			nonTLS = directive
+			continue
+		case "rate-limit":
+			limiter, err := parseRateLimit(directive)
+			if err != nil {
+				return err
+			}
+			c.RateLimit = limiter
+			continue
+		case "geoip":
+			if len(directive.Args) != 1 {
+				return parseError(directive, "Invalid geoip directive")
+			}
+			db, err := OpenGeoIP(directive.Args[0])
+			if err != nil {
+				return parseError(directive, "Could not open GeoIP database %q (%s)", directive.Args[0], err)
+			}
+			c.Close()
+			c.GeoIP = db
+			continue
+		case "backend-dns-ttl":
+			if len(directive.Args) < 1 || len(directive.Args) > 2 ||
+			   (len(directive.Args) == 2 && directive.Args[1] != "round-robin") {
+				return parseError(directive, "Invalid backend-dns-ttl directive")
+			}
+			ttl, err := time.ParseDuration(directive.Args[0])
+			if err != nil || ttl < 0 {
+				return parseError(directive, "Invalid backend-dns-ttl duration %q", directive.Args[0])
+			}
+			dnsTTL, dnsRoundRobin = ttl, len(directive.Args) == 2
+			continue
+		case "accept-proxy":
+			if len(directive.Args) > 0 {
+				return parseError(directive, "Invalid accept-proxy directive")
+			}
+			c.AcceptProxy = true
+			continue
+		case "proxy-preserve":
+			if len(directive.Args) != 1 || (directive.Args[0] != "on" && directive.Args[0] != "off") {
+				return parseError(directive, "Invalid proxy-preserve directive")
+			}
+			c.ProxyPreserve = directive.Args[0] == "on"
+			continue
+		case "max-connections":
+			if len(directive.Args) < 1 || len(directive.Args) > 2 {
+				return parseError(directive, "Invalid max-connections directive")
+			}
+			max, err := strconv.Atoi(directive.Args[0])
+			if err != nil || max < 1 {
+				return parseError(directive, "Invalid max-connections value %q", directive.Args[0])
+			}
+			c.MaxConns = max
+			if len(directive.Args) == 2 {
+				switch (directive.Args[1]) {
+				case "close":
+					c.MaxConnsPause = false
+					break
+				case "pause":
+					c.MaxConnsPause = true
+					break
+				default:
+					return parseError(directive, "Invalid max-connections mode %q (close or pause)", directive.Args[1])
+				}
+			}
+			continue
+		case "max-conns-per-ip":
+			if len(directive.Args) != 1 {
+				return parseError(directive, "Invalid max-conns-per-ip directive")
+			}
+			max, err := strconv.Atoi(directive.Args[0])
+			if err != nil || max < 1 {
+				return parseError(directive, "Invalid max-conns-per-ip value %q", directive.Args[0])
+			}
+			c.MaxConnsPerIP = max
+			continue
+		case "map":
+			if len(directive.Args) != 1 {
+				return parseError(directive, "Invalid map directive")
+			}
+			if err := c.readMap(directive, directive.Args[0]); err != nil {
+				return err
+			}
+			continue
+		case "keepalive":
+			if len(directive.Args) == 1 && directive.Args[0] == "off" {
+				c.KeepAlive = 0
+				continue
+			}
+			period, err := parseDuration(directive, true)
+			if err != nil {
+				return err
+			}
+			c.KeepAlive = period
+			continue
+		}
+
+		route := &Route{ Log: true, NoDelay: true, Annotations: directive.Annotations }
 		c.Routes = append(c.Routes, route)
+		// Whether an allow list was given, even an empty one (e.g. an
+		// empty file), in which case all IPs are denied.
+		allowList := false
 
-		domains := strings.Split(directive.Name, ",")
+		domains := splitList(directive.Name)
 		for _, domain := range(domains) {
-			rgp, err := domain2Regex(domain)
+			// The default route matches anything, but is only
+			// used when no other route does.
+			if domain == "default" {
+				if c.Default != nil {
+					return parseError(directive, "Only one default route can be defined")
+				}
+				c.Default = route
+				route.Domains = append(route.Domains, &Domain{
+					Pattern: domain,
+					Line: directive.Line,
+				})
+				continue
+			}
+
+			ascii, err := domainToASCII(domain)
 			if err != nil {
-				log.Fatal("Invalid domain: " + domain)
+				return parseError(directive, "Invalid domain %q (%s)", domain, err)
 			}
 
-			route.Domains = append(route.Domains, rgp)
+			rgp, err := domain2Regex(ascii, c.StrictWildcards)
+			if err != nil {
+				return parseError(directive, "Invalid domain %q (%s)", domain, err)
+			}
+
+			route.Domains = append(route.Domains, &Domain{
+				Regexp: rgp,
+				Pattern: domain,
+				Line: directive.Line,
+				ascii: ascii,
+			})
 		}
 
 		for _, dir := range(directive.Directives) {
 			switch dir.Name {
 			case "backend":
 				if len(dir.Args) != 1 {
-					log.Fatal("Invalid backend directive")
+					return parseError(dir, "Invalid backend directive")
+				}
+				// Options apply to all the listed backends.
+				for _, address := range(splitList(dir.Args[0])) {
+					backend, err := parseBackend(dir, address)
+					if err != nil {
+						return err
+					}
+					route.Backends = append(route.Backends, backend)
 				}
-				route.Backend = parseBackend(dir)
 				break
 			case "acme":
 				if len(dir.Args) != 1 {
-					log.Fatal("Invalid acme directive")
+					return parseError(dir, "Invalid acme directive")
+				}
+				backend, err := parseBackend(dir, dir.Args[0])
+				if err != nil {
+					return err
+				}
+				route.ACME = backend
+				break
+			case "acme-self":
+				if len(dir.Args) < 1 || len(dir.Args) > 2 {
+					return parseError(dir, "Invalid acme-self directive")
+				}
+				accountKey := ""
+				if len(dir.Args) == 2 {
+					accountKey = dir.Args[1]
+				}
+				responder, err := acme.NewResponder(dir.Args[0], accountKey)
+				if err != nil {
+					return parseError(dir, "Invalid acme-self directive (%s)", err)
+				}
+				route.ACMESelf = responder
+				break
+			case "tls-backend":
+				t, err := parseTLSBackend(dir)
+				if err != nil {
+					return err
+				}
+				route.TLSBackend = t
+				break
+			case "max-duration":
+				duration, err := parseDuration(dir, true)
+				if err != nil {
+					return err
+				}
+				route.MaxDuration = duration
+				break
+			case "health-check":
+				interval, err := parseDuration(dir, false)
+				if err != nil {
+					return err
+				}
+				route.HealthCheck = interval
+				break
+			case "deny-country", "allow-country":
+				if len(dir.Args) != 1 {
+					return parseError(dir, "Invalid %s directive", dir.Name)
+				}
+				for _, country := range(splitList(dir.Args[0])) {
+					if len(country) != 2 {
+						return parseError(dir, "Invalid country code %q", country)
+					}
+					country = strings.ToUpper(country)
+					if dir.Name == "deny-country" {
+						route.DenyCountry = append(route.DenyCountry, country)
+					} else {
+						route.AllowCountry = append(route.AllowCountry, country)
+					}
+				}
+				if countryRule == nil {
+					countryRule = dir
+				}
+				break
+			case "ja3-deny", "ja3-allow":
+				if len(dir.Args) != 1 {
+					return parseError(dir, "Invalid %s directive", dir.Name)
+				}
+				for _, hash := range(splitList(dir.Args[0])) {
+					hash = strings.ToLower(hash)
+					if !isJA3(hash) {
+						return parseError(dir, "Invalid JA3 fingerprint %q", hash)
+					}
+					if dir.Name == "ja3-deny" {
+						route.DenyJA3 = append(route.DenyJA3, hash)
+					} else {
+						route.AllowJA3 = append(route.AllowJA3, hash)
+					}
+				}
+				break
+			case "alpn":
+				if len(dir.Args) != 1 {
+					return parseError(dir, "Invalid alpn directive")
+				}
+				for _, proto := range(splitList(dir.Args[0])) {
+					if len(proto) == 0 || len(proto) > 255 {
+						return parseError(dir, "Invalid ALPN protocol %q", proto)
+					}
+					route.ALPN = append(route.ALPN, proto)
+				}
+				break
+			case "port":
+				if len(dir.Args) != 1 {
+					return parseError(dir, "Invalid port directive")
+				}
+				port, err := strconv.ParseUint(dir.Args[0], 10, 16)
+				if err != nil || port == 0 {
+					return parseError(dir, "Invalid port %q", dir.Args[0])
+				}
+				route.Port = int(port)
+				break
+			case "log":
+				if len(dir.Args) != 1 || (dir.Args[0] != "on" && dir.Args[0] != "off") {
+					return parseError(dir, "Invalid log directive")
+				}
+				route.Log = dir.Args[0] == "on"
+				break
+			case "nodelay":
+				if len(dir.Args) != 1 || (dir.Args[0] != "on" && dir.Args[0] != "off") {
+					return parseError(dir, "Invalid nodelay directive")
+				}
+				route.NoDelay = dir.Args[0] == "on"
+				break
+			case "maintenance":
+				if len(dir.Args) > 1 || (len(dir.Args) == 1 && dir.Args[0] != "on" && dir.Args[0] != "off") {
+					return parseError(dir, "Invalid maintenance directive")
+				}
+				route.Maintenance = len(dir.Args) == 0 || dir.Args[0] == "on"
+				break
+			case "rate-bytes":
+				if len(dir.Args) != 1 {
+					return parseError(dir, "Invalid rate-bytes directive")
+				}
+				rate, err := strconv.Atoi(dir.Args[0])
+				if err != nil || rate < 1 {
+					return parseError(dir, "Invalid rate-bytes value %q", dir.Args[0])
+				}
+				route.RateBytes = rate
+				break
+			case "retries":
+				if len(dir.Args) != 1 {
+					return parseError(dir, "Invalid retries directive")
+				}
+				retries, err := strconv.Atoi(dir.Args[0])
+				if err != nil || retries < 0 {
+					return parseError(dir, "Invalid number of retries %q", dir.Args[0])
+				}
+				route.Retries = retries
+				break
+			case "balance":
+				if len(dir.Args) != 1 {
+					return parseError(dir, "Invalid balance directive")
+				}
+				switch dir.Args[0] {
+				case "round-robin":
+					route.Balance = BalanceRoundRobin
+					break
+				case "least-conn":
+					route.Balance = BalanceLeastConn
+					break
+				case "weighted":
+					route.Balance = BalanceWeighted
+					break
+				case "source":
+					route.Balance = BalanceSource
+					break
+				case "random":
+					route.Balance = BalanceRandom
+					break
+				default:
+					return parseError(dir, "Unknown balance strategy %q", dir.Args[0])
 				}
-				route.ACME = parseBackend(dir)
+				break
+			case "rate-limit":
+				limiter, err := parseRateLimit(dir)
+				if err != nil {
+					return err
+				}
+				route.RateLimit = limiter
 				break
 			case "deny":
 				if len(dir.Args) != 1 {
-					log.Fatal("Invalid deny directive")
+					return parseError(dir, "Invalid deny directive")
 				}
-				for _, subnet := range(strings.Split(dir.Args[0], ",")) {
-					route.Deny = append(route.Deny, parseRange(subnet))
+				for _, subnet := range(splitList(dir.Args[0])) {
+					if strings.HasPrefix(subnet, "@") {
+						list, err := readRanges(dir, subnet[1:])
+						if err != nil {
+							return err
+						}
+						route.Deny = append(route.Deny, list...)
+						continue
+					}
+					ipnet, err := parseRange(subnet)
+					if err != nil {
+						return parseError(dir, "Invalid %s directive (%s)", dir.Name, err)
+					}
+					route.Deny = append(route.Deny, ipnet)
 				}
 				break
 			case "allow":
 				if len(dir.Args) != 1 {
-					log.Fatal("Invalid allow directive")
+					return parseError(dir, "Invalid allow directive")
 				}
-				for _, subnet := range(strings.Split(dir.Args[0], ",")) {
+				for _, subnet := range(splitList(dir.Args[0])) {
 					if subnet == "acme" {
 						route.AllowACME = true
 						continue
 					}
-					route.Allow = append(route.Allow, parseRange(subnet))
+					allowList = true
+					if strings.HasPrefix(subnet, "@") {
+						list, err := readRanges(dir, subnet[1:])
+						if err != nil {
+							return err
+						}
+						route.Allow = append(route.Allow, list...)
+						continue
+					}
+					ipnet, err := parseRange(subnet)
+					if err != nil {
+						return parseError(dir, "Invalid %s directive (%s)", dir.Name, err)
+					}
+					route.Allow = append(route.Allow, ipnet)
 				}
 				break
 			default:
-				continue
+				return parseError(dir, "Unknown directive %q", dir.Name)
+			}
+		}
+
+		// Routes can share domains if they match different protocols.
+		for _, domain := range(route.Domains) {
+			if d := c.findDomain(route, domain); d != nil {
+				return parseError(directive, "Duplicate domain %q (already defined at line %d)", domain.Pattern, d.Line)
 			}
 		}
 
-		if len(route.Allow) > 0 {
+		// Routes only used for ACME do not need a default backend.
+		if len(route.Backends) == 0 && route.ACME == nil && route.ACMESelf == nil {
+			return parseError(directive, "No backend defined for route %q", directive.Name)
+		}
+
+		if allowList || len(route.AllowCountry) > 0 {
 			// When using the allow directive, we should block all
-			// other IPs. Set Deny to match all IPs.
+			// other IPs. Set Deny to match all IPs: /0 subnets
+			// being the least specific, allowed ones always win.
 			_, all4, _ := net.ParseCIDR("0.0.0.0/0")
 			_, all6, _ := net.ParseCIDR("::/0")
 			route.Deny = append(route.Deny, all4)
 			route.Deny = append(route.Deny, all6)
+			route.defaultDeny = []*net.IPNet{ all4, all6 }
+		}
+	}
+
+	if countryRule != nil && c.GeoIP == nil {
+		return parseError(countryRule, "Country rules require a geoip database")
+	}
+
+	if noSNI != nil {
+		route, err := c.parseFallback(noSNI)
+		if err != nil {
+			return err
+		}
+		c.NoSNI = route
+	}
+	if nonTLS != nil {
+		route, err := c.parseFallback(nonTLS)
+		if err != nil {
+			return err
 		}
+		c.NonTLS = route
+	}
+
+	// Backends can be defined after the directive.
+	if dnsTTL > 0 {
+		c.setBackendDNS(dnsTTL, dnsRoundRobin)
+	}
+
+	c.buildIndex()
+	return nil
+}
+
+// Releases the resources of a configuration no longer in use, i.e. closes its
+// GeoIP database.
+func (c *Config) Close() error {
+	if c.GeoIP == nil {
+		return nil
 	}
+	return c.GeoIP.Close()
 }
 
-func parseBackend(directive *Directive) *Backend {
-	backend := &Backend{
-		Address: directive.Args[0],
-		SendProxy: ProxyNone,
+// Sets the DNS cache parameters of all backends.
+func (c *Config) setBackendDNS(ttl time.Duration, roundRobin bool) {
+	routes := c.Routes
+	for _, route := range([]*Route{ c.NoSNI, c.NonTLS }) {
+		if route != nil {
+			routes = append(routes[:len(routes):len(routes)], route)
+		}
+	}
+	for _, route := range(routes) {
+		backends := route.Backends
+		if route.ACME != nil {
+			backends = append(backends[:len(backends):len(backends)], route.ACME)
+		}
+		for _, backend := range(backends) {
+			backend.DNSTTL = ttl
+			backend.DNSRoundRobin = roundRobin
+		}
 	}
+}
 
-	for _, d := range(directive.Directives) {
-		switch d.Name {
-		// HAProxy PROXY protocol (v1)
-		case "send-proxy":
-			if len(d.Args) > 0 {
-				log.Fatal("Invalid send-proxy directive")
+// Splits the domains of all routes between exact ones, looked up in a map,
+// wildcards of the *.example.net form, looked up in a suffix trie, and other
+// patterns, which have to be matched one by one. Patterns are sorted from the
+// most specific to the least specific one.
+func (c *Config) buildIndex() {
+	c.exact = make(map[string][]*entry)
+	c.suffixes = &trieNode{}
+	c.patterns = nil
+
+	order := 0
+	for _, route := range(c.Routes) {
+		for _, domain := range(route.Domains) {
+			if domain.Regexp == nil {
+				continue
 			}
-			backend.SendProxy = ProxyV1
-			break
-		// HAProxy PROXY protocol (v2)
-		case "send-proxy-v2":
-			if len(d.Args) > 0 {
-				log.Fatal("Invalid send-proxy directive")
+
+			e := &entry{
+				route: route,
+				domain: domain,
+				specificity: specificity(domain),
+				order: order,
+			}
+			order++
+
+			key := strings.ToLower(domain.ascii)
+			if isLiteral(domain.Pattern) {
+				c.exact[key] = append(c.exact[key], e)
+			} else if suffix, ok := strings.CutPrefix(key, "*."); ok && suffix != "" && isLiteral(suffix) {
+				c.suffixes.insert(suffix, e)
+			} else {
+				c.patterns = append(c.patterns, e)
 			}
-			backend.SendProxy = ProxyV2
-			break
 		}
 	}
 
-	return backend
+	// Wildcards with the longest literal suffix come first, then raw
+	// regular expressions. Ties are kept in the configuration order.
+	sort.SliceStable(c.patterns, func(i, j int) bool {
+		return c.patterns[i].specificity > c.patterns[j].specificity
+	})
 }
 
-// Converts a domain to a regexp.Regexp.
-func domain2Regex(domain string) (*regexp.Regexp, error) {
-	// Translate the domains into a regexp valid string.
-	regex := "^"
-	for _, r := range domain {
-		switch r {
-		case '*':
-			regex += `.*`
-			break
-		case '.':
-			regex += `\.`
-			break
-		default:
-			regex += string(r)
+// Adds a wildcard to the trie, under the node of its literal suffix.
+func (t *trieNode) insert(suffix string, e *entry) {
+	node := t
+	labels := strings.Split(suffix, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		next, ok := node.children[labels[i]]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*trieNode)
+			}
+			next = &trieNode{}
+			node.children[labels[i]] = next
 		}
+		node = next
 	}
-	regex += "$"
+	node.wildcards = append(node.wildcards, e)
+}
 
-	return regexp.Compile(regex)
+// Wildcards of a trie node, and the part of the SNI their "*" stands for.
+type trieMatch struct {
+	wildcards []*entry
+	prefix    string
+}
+
+// Walks the trie along the labels of an SNI and appends the wildcards whose
+// suffix it ends with to matches, the least specific first.
+func (t *trieNode) lookup(sni string, matches []trieMatch) []trieMatch {
+	node, rest := t, sni
+	for {
+		// The wildcard label needs a dot before the suffix.
+		i := strings.LastIndexByte(rest, '.')
+		if i < 0 {
+			return matches
+		}
+		if node = node.children[rest[i+1:]]; node == nil {
+			return matches
+		}
+		rest = rest[:i]
+		if len(node.wildcards) > 0 {
+			matches = append(matches, trieMatch{ node.wildcards, rest })
+		}
+	}
+}
+
+// Returns the specificity of a domain pattern: the length of its literal
+// suffix, or -1 for raw regular expressions.
+func specificity(domain *Domain) int {
+	if strings.HasPrefix(domain.ascii, "~") {
+		return -1
+	}
+
+	n := 0
+	for n < len(domain.ascii) && isLiteral(domain.ascii[len(domain.ascii)-n-1:]) {
+		n++
+	}
+	return n
+}
+
+// Parses the no-sni and non-tls directives, which either refer to the default
+// route or to a backend. As there is no SNI to fall back on, backends must have
+// a host, including the ones of the default route.
+func (c *Config) parseFallback(d *Directive) (*Route, error) {
+	if d.Args[0] == "default" {
+		if c.Default == nil {
+			return nil, parseError(d, "No default route defined")
+		}
+		for _, backend := range(c.Default.Backends) {
+			if backend.UsesSNI() {
+				return nil, parseError(d, "Invalid %s default route (backend %q has no host)", d.Name, backend.Address)
+			}
+		}
+		return c.Default, nil
+	}
+
+	backend, err := parseBackend(d, d.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if backend.UsesSNI() {
+		return nil, parseError(d, "Invalid %s backend %q", d.Name, backend.Address)
+	}
+
+	return &Route{
+		Backends: []*Backend{ backend },
+		Log: true,
+		NoDelay: true,
+	}, nil
+}
+
+// Parses a tls-backend directive: the certificate and key presented to clients,
+// and a block of options to verify backends.
+func parseTLSBackend(directive *Directive) (*TLSBackend, error) {
+	if len(directive.Args) != 2 {
+		return nil, parseError(directive, "Invalid tls-backend directive (certificate and key)")
+	}
+	cert, err := tls.LoadX509KeyPair(directive.Args[0], directive.Args[1])
+	if err != nil {
+		return nil, parseError(directive, "Could not load certificate %q (%s)", directive.Args[0], err)
+	}
+	t := &TLSBackend{ Certificate: cert }
+
+	for _, d := range(directive.Directives) {
+		switch (d.Name) {
+		case "ca":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid ca directive")
+			}
+			pem, err := os.ReadFile(d.Args[0])
+			if err != nil {
+				return nil, parseError(d, "Could not read CA file %q (%s)", d.Args[0], err)
+			}
+			t.RootCAs = x509.NewCertPool()
+			if !t.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, parseError(d, "No certificate found in CA file %q", d.Args[0])
+			}
+			break
+		case "server-name":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid server-name directive")
+			}
+			t.ServerName = d.Args[0]
+			break
+		case "insecure":
+			if len(d.Args) != 0 {
+				return nil, parseError(d, "Invalid insecure directive")
+			}
+			t.Insecure = true
+			break
+		default:
+			return nil, parseError(d, "Unknown directive %q", d.Name)
+		}
+	}
+	return t, nil
+}
+
+func parseBackend(directive *Directive, address string) (*Backend, error) {
+	if strings.HasPrefix(address, unixPrefix) {
+		if len(address) == len(unixPrefix) {
+			return nil, parseError(directive, "Invalid backend address %q (missing path)", address)
+		}
+	} else {
+		// The host can be omitted, the SNI being used instead.
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, parseError(directive, "Invalid backend address %q (%s)", address, err)
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return nil, parseError(directive, "Invalid backend port %q", port)
+		}
+	}
+
+	backend := &Backend{
+		Address: address,
+		SendProxy: ProxyNone,
+		DialTimeout: 3 * time.Second,
+		IdleTimeout: 10 * time.Minute,
+		Weight: 1,
+		healthy: true,
+	}
+
+	for _, d := range(directive.Directives) {
+		switch d.Name {
+		// HAProxy PROXY protocol (v1)
+		case "send-proxy":
+			if len(d.Args) > 0 {
+				return nil, parseError(d, "Invalid send-proxy directive")
+			}
+			backend.SendProxy = ProxyV1
+			break
+		// HAProxy PROXY protocol (v2)
+		case "send-proxy-v2":
+			if len(d.Args) > 0 {
+				return nil, parseError(d, "Invalid send-proxy-v2 directive")
+			}
+			backend.SendProxy = ProxyV2
+			break
+		case "source":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid source directive")
+			}
+			source := net.ParseIP(d.Args[0])
+			if source == nil {
+				return nil, parseError(d, "Invalid source address %q", d.Args[0])
+			}
+			backend.Source = source
+			break
+		case "socks5":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid socks5 directive")
+			}
+			if err := checkHostPort(d.Args[0]); err != nil {
+				return nil, parseError(d, "Invalid socks5 address %q (%s)", d.Args[0], err)
+			}
+			backend.SOCKS5 = d.Args[0]
+			break
+		case "proxy-dest":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid proxy-dest directive")
+			}
+			dest, err := parseProxyDest(d.Args[0])
+			if err != nil {
+				return nil, parseError(d, "Invalid proxy-dest address %q (%s)", d.Args[0], err)
+			}
+			backend.ProxyDest = dest
+			break
+		case "dial-timeout":
+			timeout, err := parseDuration(d, false)
+			if err != nil {
+				return nil, err
+			}
+			backend.DialTimeout = timeout
+			break
+		case "idle-timeout":
+			timeout, err := parseDuration(d, true)
+			if err != nil {
+				return nil, err
+			}
+			backend.IdleTimeout = timeout
+			break
+		case "max-conns":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid max-conns directive")
+			}
+			max, err := strconv.Atoi(d.Args[0])
+			if err != nil || max < 1 {
+				return nil, parseError(d, "Invalid max-conns value %q", d.Args[0])
+			}
+			backend.MaxConns = max
+			break
+		case "weight":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid weight directive")
+			}
+			weight, err := strconv.Atoi(d.Args[0])
+			if err != nil || weight < 0 {
+				return nil, parseError(d, "Invalid weight %q", d.Args[0])
+			}
+			backend.Weight = weight
+			break
+		case "max-conns-queue":
+			timeout, err := parseDuration(d, true)
+			if err != nil {
+				return nil, err
+			}
+			backend.MaxConnsQueue = timeout
+			break
+		case "alpn":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid alpn directive")
+			}
+			for _, proto := range(splitList(d.Args[0])) {
+				if len(proto) == 0 || len(proto) > 255 {
+					return nil, parseError(d, "Invalid ALPN protocol %q", proto)
+				}
+				backend.ALPN = append(backend.ALPN, proto)
+			}
+			break
+		// HAProxy PROXY protocol (v2) TLVs
+		case "send-proxy-v2-tlv":
+			if len(d.Args) != 1 {
+				return nil, parseError(d, "Invalid send-proxy-v2-tlv directive")
+			}
+			for _, tlv := range(splitList(d.Args[0])) {
+				switch tlv {
+				case "alpn":
+					backend.SendProxyTLVs = append(backend.SendProxyTLVs, ProxyTLVALPN)
+					break
+				case "authority":
+					backend.SendProxyTLVs = append(backend.SendProxyTLVs, ProxyTLVAuthority)
+					break
+				default:
+					return nil, parseError(d, "Unknown PROXY v2 TLV %q", tlv)
+				}
+			}
+			break
+		case "send-proxy-v2-ssl":
+			if len(d.Args) > 0 {
+				return nil, parseError(d, "Invalid send-proxy-v2-ssl directive")
+			}
+			backend.SendProxySSL = true
+			break
+		case "send-proxy-v2-tag":
+			if len(d.Args) != 2 {
+				return nil, parseError(d, "Invalid send-proxy-v2-tag directive")
+			}
+			t, err := strconv.ParseUint(d.Args[0], 0, 8)
+			if err != nil || t < ProxyTLVMinCustom || t > ProxyTLVMaxCustom {
+				return nil, parseError(d, "Invalid PROXY v2 custom TLV type %q (0xe0-0xef)", d.Args[0])
+			}
+			if len(d.Args[1]) > math.MaxUint16 {
+				return nil, parseError(d, "PROXY v2 TLV value too long")
+			}
+			backend.SendProxyTags = append(backend.SendProxyTags, ProxyTag{ Type: uint8(t), Value: d.Args[1] })
+			break
+		default:
+			return nil, parseError(d, "Unknown directive %q", d.Name)
+		}
+	}
+
+	if (len(backend.SendProxyTLVs) > 0 || len(backend.SendProxyTags) > 0 || backend.SendProxySSL) &&
+	   backend.SendProxy != ProxyV2 {
+		return nil, parseError(directive, "PROXY v2 TLVs require send-proxy-v2")
+	}
+	// PROXY v1 headers can only describe TCP connections.
+	if backend.SendProxy == ProxyV1 && strings.HasPrefix(backend.Address, unixPrefix) {
+		return nil, parseError(directive, "send-proxy can't be used with a Unix backend (use send-proxy-v2)")
+	}
+	if backend.Source != nil && strings.HasPrefix(backend.Address, unixPrefix) {
+		return nil, parseError(directive, "source requires a TCP backend")
+	}
+	if len(backend.SOCKS5) > 0 && strings.HasPrefix(backend.Address, unixPrefix) {
+		return nil, parseError(directive, "socks5 requires a TCP backend")
+	}
+	if backend.ProxyDest != nil && backend.SendProxy == ProxyNone {
+		return nil, parseError(directive, "proxy-dest requires send-proxy or send-proxy-v2")
+	}
+	if backend.MaxConnsQueue > 0 && backend.MaxConns == 0 {
+		return nil, parseError(directive, "max-conns-queue requires max-conns")
+	}
+
+	return backend, nil
+}
+
+// Parses the destination address reported in PROXY headers, an IP literal and
+// a port.
+func parseProxyDest(address string) (*net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address")
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("invalid port")
+	}
+	return &net.TCPAddr{ IP: ip, Port: int(n) }, nil
+}
+
+// Checks an address is made of a host and a non-zero port.
+func checkHostPort(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if len(host) == 0 {
+		return fmt.Errorf("missing host")
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid port")
+	}
+	return nil
+}
+
+// Returns the domain with the same pattern as a route's domain, defined before
+// it in a route matching the same ALPN protocols, if any.
+func (c *Config) findDomain(route *Route, domain *Domain) *Domain {
+	for _, r := range(c.Routes) {
+		if !sameProtocols(r.ALPN, route.ALPN) || r.Port != route.Port {
+			continue
+		}
+		for _, d := range(r.Domains) {
+			// Only domains defined before are considered.
+			if d == domain {
+				return nil
+			}
+			if strings.EqualFold(d.ascii, domain.ascii) {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether two lists hold the same protocols, in any order.
+func sameProtocols(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, proto := range(a) {
+		if !contains(b, proto) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether a route can be used by a client offering a list of ALPN
+// protocols.
+func (r *Route) MatchALPN(offered []string) bool {
+	return len(r.ALPN) == 0 || offers(offered, r.ALPN)
+}
+
+// Returns warnings about domains which can never be matched, as an earlier
+// route matches the same domain for all protocols.
+func (c *Config) Shadowed() []string {
+	var warnings []string
+	for i, route := range(c.Routes) {
+		for _, domain := range(route.Domains) {
+			if domain.Regexp == nil || strings.HasPrefix(domain.Pattern, "~") {
+				continue
+			}
+
+			for _, prev := range(c.Routes[:i]) {
+				// Routes restricted to some protocols or port
+				// do not shadow others.
+				if len(prev.ALPN) > 0 || (prev.Port != 0 && prev.Port != route.Port) {
+					continue
+				}
+				for _, p := range(prev.Domains) {
+					if p.Regexp != nil && strings.EqualFold(p.ascii, domain.ascii) {
+						warnings = append(warnings,
+							fmt.Sprintf("Domain %q (line %d) is shadowed by %q (line %d)",
+								    domain.Pattern, domain.Line, p.Pattern, p.Line))
+					}
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// Matches an SNI and the ALPN protocols offered by a client to a route. The
+// most specific domain wins: exact domains first, then wildcards with the
+// longest literal suffix, then raw regular expressions. Routes restricted to
+// some protocols only match if one of them is offered, routes matching the
+// same domain being tried in order. Returns the route and the domain pattern
+// which matched. The default route, if any, is used when no other route
+// matches. Domains are case-insensitive. Routes restricted to a port never
+// match, see MatchPort.
+func (c *Config) Match(sni string, alpn []string) (*Route, string, error) {
+	return c.match(sni, alpn, 0, nil)
+}
+
+// Same as Match, for a connection received on a given port: routes restricted
+// to a port only match connections received on it.
+func (c *Config) MatchPort(sni string, alpn []string, port int) (*Route, string, error) {
+	return c.match(sni, alpn, port, nil)
+}
+
+// A domain pattern considered when matching a connection to a route.
+type Candidate struct {
+	Pattern string
+	// Why the pattern was not used: "alpn" if the route doesn't match the
+	// offered protocols, "port" if it is restricted to another port, "no
+	// match" if the pattern doesn't match the SNI or "strict" if the
+	// wildcard only stands for a single label. Empty for the winning
+	// pattern.
+	Skipped string
+}
+
+// Same as Match, also returning the patterns considered in order, for
+// debugging.
+func (c *Config) MatchDebug(sni string, alpn []string) (*Route, string, []Candidate, error) {
+	return c.MatchPortDebug(sni, alpn, 0)
+}
+
+// Same as MatchPort, also returning the patterns considered in order, for
+// debugging.
+func (c *Config) MatchPortDebug(sni string, alpn []string, port int) (*Route, string, []Candidate, error) {
+	var candidates []Candidate
+	route, pattern, err := c.match(sni, alpn, port, func(pattern, skipped string) {
+		candidates = append(candidates, Candidate{ pattern, skipped })
+	})
+	return route, pattern, candidates, err
+}
+
+// Matches an SNI to a route (see MatchPort), reporting the patterns considered to
+// trace if set.
+func (c *Config) match(sni string, alpn []string, port int, trace func(pattern, skipped string)) (*Route, string, error) {
+	sni = strings.ToLower(sni)
+
+	// Returns whether a route is used, tracing the pattern.
+	use := func(route *Route, pattern string, skipped string) bool {
+		if skipped == "" && !route.MatchALPN(alpn) {
+			skipped = "alpn"
+		}
+		if skipped == "" && route.Port != 0 && route.Port != port {
+			skipped = "port"
+		}
+		if trace != nil {
+			trace(pattern, skipped)
+		}
+		return skipped == ""
+	}
+
+	// Exact domains take precedence over patterns.
+	for _, e := range(c.exact[sni]) {
+		if use(e.route, e.domain.Pattern, "") {
+			return e.route, e.domain.Pattern, nil
+		}
+	}
+
+	// Wildcards found in the trie are merged with the other patterns, by
+	// specificity then configuration order.
+	var buf [8]trieMatch
+	matches := c.suffixes.lookup(sni, buf[:0])
+	patterns := c.patterns
+	for len(matches) > 0 || len(patterns) > 0 {
+		var next []*entry
+		if len(matches) > 0 {
+			next = matches[len(matches)-1].wildcards
+		}
+
+		if len(patterns) > 0 && (next == nil || before(patterns[0], next[0])) {
+			e := patterns[0]
+			patterns = patterns[1:]
+			skipped := ""
+			if !e.domain.MatchString(sni) {
+				skipped = "no match"
+			}
+			if use(e.route, e.domain.Pattern, skipped) {
+				return e.route, e.domain.Pattern, nil
+			}
+			continue
+		}
+
+		m := &matches[len(matches)-1]
+		e := m.wildcards[0]
+		if m.wildcards = m.wildcards[1:]; len(m.wildcards) == 0 {
+			matches = matches[:len(matches)-1]
+		}
+		// In strict mode, the wildcard stands for a single label.
+		skipped := ""
+		if c.StrictWildcards && (m.prefix == "" || strings.Contains(m.prefix, ".")) {
+			skipped = "strict"
+		}
+		if use(e.route, e.domain.Pattern, skipped) {
+			return e.route, e.domain.Pattern, nil
+		}
+	}
+
+	if c.Default != nil && use(c.Default, "default", "") {
+		return c.Default, "default", nil
+	}
+
+	return nil, "", fmt.Errorf("%w (%s)", ErrNoRoute, sni)
+}
+
+// Reports whether a pattern has precedence over another one.
+func before(a, b *entry) bool {
+	if a.specificity != b.specificity {
+		return a.specificity > b.specificity
+	}
+	return a.order < b.order
+}
+
+// Errors returned when resolving a connection.
+var (
+	ErrNoRoute   = errors.New("No route matching the requested domain")
+	ErrDenied    = errors.New("Access denied")
+	ErrNoBackend = errors.New("No backend available")
+)
+
+// Resolves the backend a connection would be routed to, without any
+// networking: the SNI is matched to a route, the client checked against the
+// route rules and a backend chosen. An empty SNI stands for connections
+// without an SNI extension. ACME challenges answered locally have no backend.
+// Rate limits are not checked, and routes restricted to a port not matched
+// (see ResolvePort), but backends are chosen as for a real connection.
+func (c *Config) Resolve(sni string, alpn []string, client net.IP) (*Backend, error) {
+	return c.ResolvePort(sni, alpn, client, 0)
+}
+
+// Same as Resolve, for a connection received on a given port.
+func (c *Config) ResolvePort(sni string, alpn []string, client net.IP, port int) (*Backend, error) {
+	var route *Route
+	if sni == "" {
+		if c.NoSNI == nil {
+			return nil, fmt.Errorf("%w (no sni)", ErrNoRoute)
+		}
+		route = c.NoSNI
+	} else {
+		ascii, err := ToASCII(sni)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SNI %q (%s)", sni, err)
+		}
+		if route, _, err = c.MatchPort(ascii, alpn, port); err != nil {
+			return nil, err
+		}
+	}
+
+	acme := contains(alpn, "acme-tls/1")
+	if !(acme && route.AllowACME) && !route.Allowed(client, c.GeoIP) {
+		return nil, fmt.Errorf("%w (%s)", ErrDenied, client)
+	}
+	if acme && route.ACMESelf != nil {
+		return nil, nil
+	}
+
+	backend := route.nextBackend(acme, client, alpn)
+	if backend == nil {
+		return nil, ErrNoBackend
+	}
+	backend.Release()
+	return backend, nil
+}
+
+// Reports whether a string is a JA3 fingerprint, an MD5 hash in lowercase
+// hexadecimal.
+func isJA3(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	for _, c := range(s) {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if a client with a given JA3 fingerprint is allowed to use the route.
+// Clients which handshake could not be fingerprinted are only denied when
+// AllowJA3 is used.
+func (r *Route) AllowedJA3(fingerprint string) bool {
+	if contains(r.DenyJA3, fingerprint) {
+		return false
+	}
+	return len(r.AllowJA3) == 0 || contains(r.AllowJA3, fingerprint)
+}
+
+// Access control decisions, see Route.Check.
+const (
+	// The route has no IP nor country rules.
+	ACLNone        = ""
+	ACLAllowed     = "allowed"
+	// Denied by a deny rule, either a subnet or a country.
+	ACLDenied      = "denied"
+	// Denied as not part of the route allow list.
+	ACLDefaultDeny = "default-deny"
+)
+
+// Checks an IP against the route subnet deny/allow rules, country rules being
+// ignored. See Check for the precedence rules.
+func (r *Route) AllowsIP(ip net.IP) bool {
+	return r.Allowed(ip, nil)
+}
+
+// Checks an IP against the route deny/allow rules.
+func (r *Route) Allowed(ip net.IP, geoip GeoIP) bool {
+	decision := r.Check(ip, geoip)
+	return decision != ACLDenied && decision != ACLDefaultDeny
+}
+
+// Checks an IP against the route deny/allow rules and returns the decision.
+// The more specific rule takes precedence, and Deny wins over Allow in case
+// none is more specific. Country rules are less specific than any subnet, except
+// 0.0.0.0/0 and ::/0.
+func (r *Route) Check(ip net.IP, geoip GeoIP) string {
+	// Check if filtering is enabled for the route.
+	if len(r.Allow) == 0 && len(r.Deny) == 0 &&
+	   len(r.AllowCountry) == 0 && len(r.DenyCountry) == 0 {
+		return ACLNone
+	}
+
+	// Specificity of a subnet: /0 subnets are the least specific, then
+	// countries, then other subnets by mask length.
+	specificity := func(subnet *net.IPNet) int {
+		sz, _ := subnet.Mask.Size()
+		if sz == 0 {
+			return 0
+		}
+		return sz + 1
+	}
+
+	var country string
+	if geoip != nil && (len(r.AllowCountry) > 0 || len(r.DenyCountry) > 0) {
+		var err error
+		if country, err = geoip.Country(ip); err != nil {
+			log.Printf("Could not look up the country of %s (%s)", ip, err)
+		}
+	}
+
+	var allowed int = -1
+	for _, subnet := range(r.Allow) {
+		if subnet.Contains(ip) && specificity(subnet) > allowed {
+			allowed = specificity(subnet)
+		}
+	}
+	if country != "" && allowed < 1 && contains(r.AllowCountry, country) {
+		allowed = 1
+	}
+
+	if country != "" && allowed <= 1 && contains(r.DenyCountry, country) {
+		return ACLDenied
+	}
+	for _, subnet := range(r.Deny) {
+		if subnet.Contains(ip) && specificity(subnet) >= allowed {
+			for _, all := range(r.defaultDeny) {
+				if subnet == all {
+					return ACLDefaultDeny
+				}
+			}
+			return ACLDenied
+		}
+	}
+	return ACLAllowed
+}
+
+// Returns the next healthy backend of a route with capacity left, using the
+// route's balancing strategy, or nil if none is available. A connection slot
+// is reserved on the returned backend and must be released once done. The
+// client IP is only used by the source strategy, round-robin being used if
+// unknown.
+func (r *Route) NextBackend(client net.IP) *Backend {
+	// Random selection is stateless and doesn't need the route's mutex,
+	// sparing contention under high connection rates.
+	if r.Balance == BalanceRandom {
+		backend := r.random()
+		if backend == nil || !backend.Acquire() {
+			return nil
+		}
+		return backend
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var backend *Backend
+	switch (r.Balance) {
+	case BalanceLeastConn:
+		backend = r.leastConn()
+		break
+	case BalanceSource:
+		if client != nil {
+			backend = r.source(client)
+			break
+		}
+		backend = r.roundRobin()
+		break
+	default:
+		backend = r.roundRobin()
+	}
+
+	if backend == nil || !backend.Acquire() {
+		return nil
+	}
+	return backend
+}
+
+// Reports whether a backend can be selected.
+func (b *Backend) selectable() bool {
+	return b.Weight > 0 && b.Healthy() && !b.saturated()
+}
+
+// Reports whether a backend can be selected by the balancing strategies,
+// backends dedicated to some protocols being selected separately.
+func (b *Backend) balanced() bool {
+	return len(b.ALPN) == 0 && b.selectable()
+}
+
+// Returns the backend with the fewest active connections relative to its
+// weight. Ties are broken in a round-robin fashion. Must be called with mu
+// held.
+func (r *Route) leastConn() *Backend {
+	var best *Backend
+	n := len(r.Backends)
+	for i := 0; i < n; i++ {
+		backend := r.Backends[(r.next + i) % n]
+		if !backend.balanced() {
+			continue
+		}
+
+		// Compare active / weight ratios.
+		if best == nil || backend.ActiveConns() * best.Weight < best.ActiveConns() * backend.Weight {
+			best = backend
+		}
+	}
+	if n > 0 {
+		r.next = (r.next + 1) % n
+	}
+	return best
+}
+
+// Returns the backend a client IP hashes to, among the selectable ones. Must
+// be called with the route's mutex held.
+func (r *Route) source(client net.IP) *Backend {
+	var candidates []*Backend
+	for _, backend := range(r.Backends) {
+		if backend.balanced() {
+			candidates = append(candidates, backend)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	h := fnv.New32a()
+	h.Write(client.To16())
+	return candidates[h.Sum32() % uint32(len(candidates))]
+}
+
+// Returns a backend picked at random among the selectable ones, proportionally
+// to their weight. Returns nil if none is, including when backends become
+// unselectable while picking one.
+func (r *Route) random() *Backend {
+	total := 0
+	for _, backend := range(r.Backends) {
+		if backend.balanced() {
+			total += backend.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.IntN(total)
+	for _, backend := range(r.Backends) {
+		if !backend.balanced() {
+			continue
+		}
+		if n < backend.Weight {
+			return backend
+		}
+		n -= backend.Weight
+	}
+	return nil
+}
+
+// Returns the next backend using a smooth weighted round-robin. Must be called
+// with mu held.
+func (r *Route) roundRobin() *Backend {
+	// Each candidate's current weight is increased by its weight, the one
+	// with the highest current weight is selected and has its current
+	// weight decreased by the total. This spreads selections evenly.
+	var best *Backend
+	total := 0
+	for _, backend := range(r.Backends) {
+		if !backend.balanced() {
+			continue
+		}
+
+		backend.current += backend.Weight
+		total += backend.Weight
+		if best == nil || backend.current > best.current {
+			best = backend
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// Interval at which saturated backends are polled when queueing.
+const queuePollInterval = 10 * time.Millisecond
+
+// Returns the next backend for a connection, using the ACME one for ACME
+// challenges if set, without waiting for a connection slot.
+func (r *Route) nextBackend(acme bool, client net.IP, alpn []string) *Backend {
+	if acme && r.ACME != nil {
+		if r.ACME.Acquire() {
+			return r.ACME
+		}
+		return nil
+	}
+	if backend := r.alpnBackend(alpn); backend != nil {
+		return backend
+	}
+	return r.NextBackend(client)
+}
+
+// Returns the first backend dedicated to a protocol offered by the client
+// which can take the connection, in the order backends are defined, with a
+// connection slot reserved. Returns nil if there is none.
+func (r *Route) alpnBackend(alpn []string) *Backend {
+	for _, backend := range(r.Backends) {
+		if !backend.selectable() || !offers(alpn, backend.ALPN) {
+			continue
+		}
+		if backend.Acquire() {
+			return backend
+		}
+	}
+	return nil
+}
+
+// Reports whether a client offering a list of protocols offers one of the
+// given ones.
+func offers(alpn, protos []string) bool {
+	for _, proto := range(protos) {
+		if contains(alpn, proto) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a backend to route a connection to (the ACME one if requested and
+// available), with a connection slot reserved which must be released once
+// done. Backends dedicated to a protocol offered by the client are preferred,
+// the others being used as a fallback. If all backends are saturated, waits up
+// to their max-conns-queue time for a slot to free up. Returns nil if no
+// backend is available.
+func (r *Route) AcquireBackend(acme bool, client net.IP, alpn []string) *Backend {
+	candidates := r.Backends
+	if acme && r.ACME != nil {
+		candidates = []*Backend{ r.ACME }
+	}
+
+	backend := r.nextBackend(acme, client, alpn)
+	if backend != nil {
+		return backend
+	}
+
+	var wait time.Duration
+	for _, b := range(candidates) {
+		if b.Healthy() && b.MaxConnsQueue > wait {
+			wait = b.MaxConnsQueue
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	for backend == nil && time.Now().Before(deadline) {
+		time.Sleep(queuePollInterval)
+		backend = r.nextBackend(acme, client, alpn)
+	}
+	return backend
+}
+
+// Reserves a connection slot on a backend. Returns false if the backend
+// reached its maximum number of concurrent connections.
+func (b *Backend) Acquire() bool {
+	n := atomic.AddInt32(&b.active, 1)
+	if b.MaxConns > 0 && int(n) > b.MaxConns {
+		atomic.AddInt32(&b.active, -1)
+		return false
+	}
+	return true
+}
+
+// Reports whether a backend reached its maximum number of concurrent
+// connections.
+func (b *Backend) saturated() bool {
+	return b.MaxConns > 0 && b.ActiveConns() >= b.MaxConns
+}
+
+// Releases a connection slot reserved with Acquire.
+func (b *Backend) Release() {
+	atomic.AddInt32(&b.active, -1)
+}
+
+// Returns the number of connections being routed to a backend.
+func (b *Backend) ActiveConns() int {
+	return int(atomic.LoadInt32(&b.active))
+}
+
+// Prefix of Unix domain socket backend addresses.
+const unixPrefix = "unix:"
+
+// Returns the network and address to dial to connect to a backend. Backends
+// without a host use the SNI instead.
+func (b *Backend) DialAddress(sni string) (string, string) {
+	if strings.HasPrefix(b.Address, unixPrefix) {
+		return "unix", strings.TrimPrefix(b.Address, unixPrefix)
+	}
+
+	host, port, _ := net.SplitHostPort(b.Address)
+	if len(host) == 0 {
+		host = sni
+	}
+	return "tcp", net.JoinHostPort(host, port)
+}
+
+// Returns a dialer connecting to the backend over a given network, within its
+// dial timeout and from its source address if any.
+func (b *Backend) Dialer(network string) *net.Dialer {
+	d := &net.Dialer{ Timeout: b.DialTimeout }
+	if b.Source == nil {
+		return d
+	}
+
+	switch (network) {
+	case "udp":
+		d.LocalAddr = &net.UDPAddr{ IP: b.Source }
+		break
+	case "tcp":
+		d.LocalAddr = &net.TCPAddr{ IP: b.Source }
+		break
+	}
+	return d
+}
+
+// SOCKS5 client performing its handshake on a given connection.
+type socksConnDialer interface {
+	DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+}
+
+// Connects to a backend through its SOCKS5 proxy, which resolves the backend
+// host name. The dialer timeout covers the SOCKS5 handshake. The connection to
+// the proxy is returned as is once the handshake is done (a *net.TCPConn), so
+// half-closes and TCP options apply to it.
+func (b *Backend) dialSOCKS5(dialer *net.Dialer, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("Could not connect to %s (SOCKS5 only supports TCP)", address)
+	}
+
+	ctx := context.Background()
+	if dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+
+	socks, err := proxy.SOCKS5("tcp", b.SOCKS5, nil, dialer)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s through %s (%s)", address, b.SOCKS5, err)
+	}
+	client, ok := socks.(socksConnDialer)
+	if !ok {
+		return nil, fmt.Errorf("Could not connect to %s through %s (unsupported SOCKS5 client)", address, b.SOCKS5)
+	}
+
+	c, err := dialer.DialContext(ctx, "tcp", b.SOCKS5)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to %s through %s (%s)", address, b.SOCKS5, err)
+	}
+	if _, err := client.DialWithConn(ctx, c, network, address); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Could not connect to %s through %s (%s)", address, b.SOCKS5, err)
+	}
+	return c, nil
+}
+
+// Reports whether a backend uses the SNI as its host.
+func (b *Backend) UsesSNI() bool {
+	if strings.HasPrefix(b.Address, unixPrefix) {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(b.Address)
+	return len(host) == 0
+}
+
+// Reports whether a backend is considered healthy.
+func (b *Backend) Healthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+// Sets the health state of a backend. Returns true if the state changed.
+func (b *Backend) SetHealthy(healthy bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	changed := b.healthy != healthy
+	b.healthy = healthy
+	return changed
+}
+
+// Parses the duration argument of a directive. Durations must be positive, 0
+// being only accepted if allowZero is set.
+func parseDuration(d *Directive, allowZero bool) (time.Duration, error) {
+	if len(d.Args) != 1 {
+		return 0, parseError(d, "Invalid %s directive", d.Name)
+	}
+
+	duration, err := time.ParseDuration(d.Args[0])
+	if err != nil || duration < 0 || (duration == 0 && !allowZero) {
+		return 0, parseError(d, "Invalid %s duration %q", d.Name, d.Args[0])
+	}
+
+	return duration, nil
+}
+
+// Parses a rate-limit directive: a number of connections per second and per
+// client, optionally followed by a burst size. The burst defaults to the rate,
+// and at least 1.
+func parseRateLimit(d *Directive) (*ratelimit.Limiter, error) {
+	if len(d.Args) < 1 || len(d.Args) > 2 {
+		return nil, parseError(d, "Invalid rate-limit directive")
+	}
+
+	rate, err := strconv.ParseFloat(d.Args[0], 64)
+	if err != nil || rate <= 0 {
+		return nil, parseError(d, "Invalid rate-limit rate %q", d.Args[0])
+	}
+
+	burst := int(math.Ceil(rate))
+	if len(d.Args) == 2 {
+		burst, err = strconv.Atoi(d.Args[1])
+		if err != nil || burst < 1 {
+			return nil, parseError(d, "Invalid rate-limit burst %q", d.Args[1])
+		}
+	}
+
+	return ratelimit.New(rate, burst), nil
+}
+
+// Converts a domain to a case-insensitive regexp.Regexp. Domains starting with
+// '~' are raw regular expressions, always anchored. Strict wildcards match a
+// single label when used as one (e.g. *.example.net), part of a label
+// otherwise, instead of any string.
+func domain2Regex(domain string, strict bool) (*regexp.Regexp, error) {
+	if strings.HasPrefix(domain, "~") {
+		if len(domain) == 1 {
+			return nil, fmt.Errorf("empty regular expression")
+		}
+		return regexp.Compile("(?i)^(?:" + domain[1:] + ")$")
+	}
+
+	// Translate the domains into a regexp valid string.
+	regex := "(?i)^"
+	for i, r := range domain {
+		switch r {
+		case '*':
+			if !strict {
+				regex += `.*`
+				break
+			}
+			label := (i == 0 || domain[i-1] == '.') &&
+				 (i == len(domain) - 1 || domain[i+1] == '.')
+			if label {
+				regex += `[^.]+`
+			} else {
+				regex += `[^.]*`
+			}
+			break
+		case '.':
+			regex += `\.`
+			break
+		default:
+			regex += string(r)
+		}
+	}
+	regex += "$"
+
+	return regexp.Compile(regex)
+}
+
+// Converts the internationalized labels of a domain pattern to their ASCII
+// form. Raw regular expressions are left untouched.
+func domainToASCII(domain string) (string, error) {
+	if strings.HasPrefix(domain, "~") {
+		return domain, nil
+	}
+
+	labels := strings.Split(domain, ".")
+	for i, label := range(labels) {
+		if isASCII(label) {
+			continue
+		}
+		ascii, err := idna.Lookup.ToASCII(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = ascii
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// Normalizes an SNI to its lowercase ASCII form. Returns an error if it is not
+// a valid (internationalized) host name.
+func ToASCII(sni string) (string, error) {
+	// Don't feed overlong values to the IDNA conversion.
+	if len(sni) > maxHostnameLen * 4 {
+		return "", fmt.Errorf("host name too long")
+	}
+
+	sni = strings.ToLower(sni)
+	if !isASCII(sni) {
+		ascii, err := idna.Lookup.ToASCII(sni)
+		if err != nil {
+			return "", err
+		}
+		return ascii, validHostname(ascii)
+	}
+	if err := validHostname(sni); err != nil {
+		return "", err
+	}
+	if !strings.Contains(sni, "xn--") {
+		return sni, nil
+	}
+
+	// Punycode labels must be valid and in their canonical form.
+	ascii, err := idna.Lookup.ToASCII(sni)
+	if err != nil {
+		return "", err
+	}
+	if ascii != sni {
+		return "", fmt.Errorf("non canonical punycode")
+	}
+	return ascii, nil
+}
+
+// Limits of host names, in bytes.
+const (
+	maxHostnameLen = 253
+	maxLabelLen    = 63
+)
+
+// Checks a lowercase ASCII host name follows the DNS rules: labels of letters,
+// digits and hyphens, not starting nor ending with a hyphen, separated by dots.
+// Underscores are allowed as well, as they are found in the wild.
+func validHostname(name string) error {
+	if len(name) > maxHostnameLen {
+		return fmt.Errorf("host name too long")
+	}
+
+	for _, label := range(strings.Split(name, ".")) {
+		if label == "" {
+			return fmt.Errorf("empty label")
+		}
+		if len(label) > maxLabelLen {
+			return fmt.Errorf("label too long")
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label starting or ending with a hyphen")
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return fmt.Errorf("invalid character %q", c)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns whether a string only contains ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether a domain only matches itself. Raw regular expressions never
+// do, even without metacharacters.
+func isLiteral(domain string) bool {
+	return !strings.HasPrefix(domain, "~") &&
+	       regexp.QuoteMeta(domain) == strings.ReplaceAll(domain, ".", `\.`)
+}
+
+// Reads the routes of a map directive from a file, one "domain backend" pair per
+// line, domains being matched exactly. Empty lines and comments (starting with
+// '#') are ignored. A relative path is resolved against the directory of the
+// configuration file.
+func (c *Config) readMap(d *Directive, path string) error {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(d.File), path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return parseError(d, "Could not read map (%s)", err)
+	}
+	defer f.Close()
+
+	// Maps can hold many domains: duplicates are looked up in the domains
+	// of the routes matching any protocol and port, as map routes do,
+	// instead of going through all routes for each line.
+	defined := make(map[string]*Domain)
+	for _, route := range(c.Routes) {
+		if len(route.ALPN) > 0 || route.Port != 0 {
+			continue
+		}
+		for _, domain := range(route.Domains) {
+			key := strings.ToLower(domain.ascii)
+			if _, ok := defined[key]; !ok && domain.Regexp != nil {
+				defined[key] = domain
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := uint(1); scanner.Scan(); line++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Entries are reported as map directives of the map file.
+		e := &Directive{ Name: d.Name, Args: fields, File: path, Line: line }
+		if len(fields) != 2 {
+			return parseError(e, "Invalid map entry (domain backend)")
+		}
+
+		domain := fields[0]
+		if domain == "default" || !isLiteral(domain) {
+			return parseError(e, "Invalid map domain %q (exact domains only)", domain)
+		}
+		ascii, err := domainToASCII(domain)
+		if err != nil {
+			return parseError(e, "Invalid domain %q (%s)", domain, err)
+		}
+		rgp, err := domain2Regex(ascii, c.StrictWildcards)
+		if err != nil {
+			return parseError(e, "Invalid domain %q (%s)", domain, err)
+		}
+		key := strings.ToLower(ascii)
+		if prev, ok := defined[key]; ok {
+			return parseError(e, "Duplicate domain %q (already defined at line %d)", domain, prev.Line)
+		}
+
+		backend, err := parseBackend(e, fields[1])
+		if err != nil {
+			return err
+		}
+
+		route := &Route{
+			Domains: []*Domain{{
+				Regexp: rgp,
+				Pattern: domain,
+				Line: line,
+				ascii: ascii,
+			}},
+			Backends: []*Backend{ backend },
+			Log: true,
+			NoDelay: true,
+			Annotations: d.Annotations,
+		}
+		c.Routes = append(c.Routes, route)
+		defined[key] = route.Domains[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return parseError(d, "Could not read map %q (%s)", path, err)
+	}
+	return nil
+}
+
+// Reads a list of subnets from a file, one per line, for an allow or deny
+// directive. Empty lines and comments (starting with '#') are ignored. A
+// relative path is resolved against the directory of the configuration file.
+func readRanges(d *Directive, path string) ([]*net.IPNet, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(d.File), path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, parseError(d, "Could not read %s list (%s)", d.Name, err)
+	}
+	defer f.Close()
+
+	var ranges []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for line := uint(1); scanner.Scan(); line++ {
+		subnet, _, _ := strings.Cut(scanner.Text(), "#")
+		subnet = strings.TrimSpace(subnet)
+		if subnet == "" {
+			continue
+		}
+
+		ipnet, err := parseRange(subnet)
+		if err != nil {
+			return nil, &ParseError{
+				Directive: d.Name,
+				File: path,
+				Line: line,
+				Msg: fmt.Sprintf("Invalid %s list (%s)", d.Name, err),
+			}
+		}
+		ranges = append(ranges, ipnet)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, parseError(d, "Could not read %s list %q (%s)", d.Name, path, err)
+	}
+	return ranges, nil
 }
 
 // Parse a subnet string.
-func parseRange(subnet string) *net.IPNet {
+func parseRange(subnet string) (*net.IPNet, error) {
 	_, ipnet, err := net.ParseCIDR(subnet)
 	if err == nil {
-		return ipnet
+		return ipnet, nil
 	}
 
 	ip := net.ParseIP(subnet)
 	if ip == nil {
-		log.Fatal("Could not parse subnet " + subnet)
+		return nil, fmt.Errorf("Could not parse subnet %q", subnet)
 	}
 
 	// IP is an IPv4 address, its CIDR should be /32.
 	if v4 := ip.To4(); v4 != nil {
-		return &net.IPNet{ IP: ip, Mask: net.CIDRMask(32, 32) }
+		return &net.IPNet{ IP: ip, Mask: net.CIDRMask(32, 32) }, nil
 	}
 
 	// IP is an IPv6 address, its CIDR should be /128.
-	return &net.IPNet{ IP: ip, Mask: net.CIDRMask(128, 128) }
+	return &net.IPNet{ IP: ip, Mask: net.CIDRMask(128, 128) }, nil
 }
@@ -0,0 +1,2448 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func parseString(in string) (*Config, error) {
+	c := &Config{}
+	return c, c.Read(strings.NewReader(in))
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		desc      string
+		in        string
+		directive string
+		line      uint
+	}{
+		{
+			"Invalid domain",
+			"example.net, a(.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"example.net,a(.net",
+			1,
+		},
+		{
+			"Invalid regular expression",
+			"~[a-z+.example.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"~[a-z+.example.net",
+			1,
+		},
+		{
+			"Empty regular expression",
+			"~ {\n\tbackend 1.2.3.4:443\n}\n",
+			"~",
+			1,
+		},
+		{
+			"Backend without address",
+			"example.net {\n\tbackend\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"Acme with too many arguments",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tacme 1.2.3.5:443 foo\n}\n",
+			"acme",
+			3,
+		},
+		{
+			"PROXY v2 tag outside of the custom range",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsend-proxy-v2\n\t\tsend-proxy-v2-tag 0x05 foo\n\t}\n}\n",
+			"send-proxy-v2-tag",
+			4,
+		},
+		{
+			"PROXY v2 tag without a value",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsend-proxy-v2\n\t\tsend-proxy-v2-tag 0xe0\n\t}\n}\n",
+			"send-proxy-v2-tag",
+			4,
+		},
+		{
+			"PROXY v2 SSL TLV with send-proxy",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsend-proxy\n\t\tsend-proxy-v2-ssl\n\t}\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"PROXY v2 tag without send-proxy-v2",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsend-proxy-v2-tag 0xe0 foo\n\t}\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"Invalid source address",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsource 10.0.0.256\n\t}\n}\n",
+			"source",
+			3,
+		},
+		{
+			"Source address of a Unix backend",
+			"example.net {\n\tbackend unix:/run/backend.sock {\n\t\tsource 10.0.0.1\n\t}\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"non-tls backend without a host",
+			"non-tls :443\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"non-tls",
+			1,
+		},
+		{
+			"map without a file",
+			"example.net {\n\tbackend 1.2.3.4:443\n}\nmap\n",
+			"map",
+			4,
+		},
+		{
+			"SOCKS5 address without a port",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsocks5 10.0.0.1\n\t}\n}\n",
+			"socks5",
+			3,
+		},
+		{
+			"PROXY v1 to a Unix backend",
+			"example.net {\n\tbackend unix:/run/backend.sock {\n\t\tsend-proxy\n\t}\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"SOCKS5 proxy of a Unix backend",
+			"example.net {\n\tbackend unix:/run/backend.sock {\n\t\tsocks5 10.0.0.1:1080\n\t}\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"PROXY destination without a port",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsend-proxy\n\t\tproxy-dest 10.0.0.1\n\t}\n}\n",
+			"proxy-dest",
+			4,
+		},
+		{
+			"PROXY destination not being an IP",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsend-proxy\n\t\tproxy-dest example.net:443\n\t}\n}\n",
+			"proxy-dest",
+			4,
+		},
+		{
+			"PROXY destination without send-proxy",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tproxy-dest 10.0.0.1:443\n\t}\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"Unknown wildcards mode",
+			"wildcards lazy\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"wildcards",
+			1,
+		},
+		{
+			"Negative number of retries",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tretries -1\n}\n",
+			"retries",
+			3,
+		},
+		{
+			"Acme-self without a directory",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tacme-self\n}\n",
+			"acme-self",
+			3,
+		},
+		{
+			"Send-proxy with an argument",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsend-proxy v1\n\t}\n}\n",
+			"send-proxy",
+			3,
+		},
+		{
+			"Invalid health-check interval",
+			"example.net {\n\tbackend 1.2.3.4:443\n\thealth-check 0s\n}\n",
+			"health-check",
+			3,
+		},
+		{
+			"Invalid dial-timeout",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tdial-timeout 0\n\t}\n}\n",
+			"dial-timeout",
+			3,
+		},
+		{
+			"Invalid idle-timeout",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tidle-timeout -1s\n\t}\n}\n",
+			"idle-timeout",
+			3,
+		},
+		{
+			"Multiple default routes",
+			"default {\n\tbackend 1.2.3.4:443\n}\nexample.net, default {\n\tbackend 1.2.3.5:443\n}\n",
+			"example.net,default",
+			4,
+		},
+		{
+			"No-sni without a default route",
+			"no-sni default\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"no-sni",
+			1,
+		},
+		{
+			"No-sni backend without a host",
+			"example.net {\n\tbackend 1.2.3.4:443\n}\n\nno-sni :443\n",
+			"no-sni",
+			5,
+		},
+		{
+			"No-sni default route without a host",
+			"default {\n\tbackend 1.2.3.4:443\n\tbackend :443\n}\nno-sni default\n",
+			"no-sni",
+			5,
+		},
+		{
+			"non-tls default route without a host",
+			"non-tls default\ndefault {\n\tbackend :443\n}\n",
+			"non-tls",
+			1,
+		},
+		{
+			"Invalid rate-limit rate",
+			"rate-limit 0\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"rate-limit",
+			1,
+		},
+		{
+			"Invalid rate-limit burst",
+			"example.net {\n\tbackend 1.2.3.4:443\n\trate-limit 10 0\n}\n",
+			"rate-limit",
+			3,
+		},
+		{
+			"Invalid max-conns",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tmax-conns 0\n\t}\n}\n",
+			"max-conns",
+			3,
+		},
+		{
+			"Max-conns-queue without max-conns",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tmax-conns-queue 1s\n\t}\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"Duplicate domain",
+			"example.net {\n\tbackend 1.2.3.4:443\n}\n*.example.net, example.net {\n\tbackend 1.2.3.5:443\n}\n",
+			"*.example.net,example.net",
+			4,
+		},
+		{
+			"Duplicate internationalized domain",
+			"münchen.de {\n\tbackend 1.2.3.4:443\n}\nxn--mnchen-3ya.de {\n\tbackend 1.2.3.5:443\n}\n",
+			"xn--mnchen-3ya.de",
+			4,
+		},
+		{
+			"Duplicate domain in a different case",
+			"example.net {\n\tbackend 1.2.3.4:443\n}\nExample.NET {\n\tbackend 1.2.3.5:443\n}\n",
+			"Example.NET",
+			4,
+		},
+		{
+			"Route without backend",
+			"example.net {\n\tdeny 10.0.0.1\n}\n",
+			"example.net",
+			1,
+		},
+		{
+			"Backend without port",
+			"example.net {\n\tbackend 1.2.3.4\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"Backend with an invalid port",
+			"example.net {\n\tbackend 1.2.3.4:https\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"Invalid weight",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tweight -1\n\t}\n}\n",
+			"weight",
+			3,
+		},
+		{
+			"Unknown balance strategy",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tbalance fastest\n}\n",
+			"balance",
+			3,
+		},
+		{
+			"Invalid keepalive",
+			"keepalive on\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"keepalive",
+			1,
+		},
+		{
+			"Invalid max-connections value",
+			"max-connections 0\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"max-connections",
+			1,
+		},
+		{
+			"Invalid max-connections mode",
+			"max-connections 10 wait\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"max-connections",
+			1,
+		},
+		{
+			"Invalid max-conns-per-ip value",
+			"max-conns-per-ip none\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"max-conns-per-ip",
+			1,
+		},
+		{
+			"Missing tls-backend certificate",
+			"example.net {\n\tbackend 1.2.3.4:443\n\ttls-backend /nonexistent.pem /nonexistent.key\n}\n",
+			"tls-backend",
+			3,
+		},
+		{
+			"Invalid rate-bytes value",
+			"example.net {\n\tbackend 1.2.3.4:443\n\trate-bytes 1M\n}\n",
+			"rate-bytes",
+			3,
+		},
+		{
+			"Invalid log value",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tlog false\n}\n",
+			"log",
+			3,
+		},
+		{
+			"Invalid port",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tport 65536\n}\n",
+			"port",
+			3,
+		},
+		{
+			"Invalid nodelay value",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tnodelay\n}\n",
+			"nodelay",
+			3,
+		},
+		{
+			"Invalid backend-dns-ttl mode",
+			"backend-dns-ttl 1m random\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"backend-dns-ttl",
+			1,
+		},
+		{
+			"Invalid proxy-preserve value",
+			"accept-proxy\nproxy-preserve yes\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+			"proxy-preserve",
+			2,
+		},
+		{
+			"Unset environment variable",
+			"example.net {\n\tbackend ${SNIPROXY_TEST_UNSET}:443\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"Unknown route directive",
+			"example.net {\n\tbakend 1.2.3.4:443\n}\n",
+			"bakend",
+			2,
+		},
+		{
+			"Unknown backend directive",
+			"example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsend-proxy-v3\n\t}\n}\n",
+			"send-proxy-v3",
+			3,
+		},
+		{
+			"Country rules without a geoip database",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tdeny-country fr\n}\n",
+			"deny-country",
+			3,
+		},
+		{
+			"Invalid JA3 fingerprint",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tja3-deny ada70206e40642a3e4461f35503241d\n}\n",
+			"ja3-deny",
+			3,
+		},
+		{
+			"Invalid country code",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tallow-country fra\n}\n",
+			"allow-country",
+			3,
+		},
+		{
+			"Missing geoip database",
+			"geoip /nonexistent.mmdb\n",
+			"geoip",
+			1,
+		},
+		{
+			"Unix backend without a path",
+			"example.net {\n\tbackend unix:\n}\n",
+			"backend",
+			2,
+		},
+		{
+			"Invalid subnet in deny",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tdeny 10.0.0.1, 10.0.0.300\n}\n",
+			"deny",
+			3,
+		},
+		{
+			"Invalid subnet in allow",
+			"example.net {\n\tbackend 1.2.3.4:443\n\n\tallow 10.0.0.0/33\n}\n",
+			"allow",
+			4,
+		},
+		{
+			"Invalid maintenance value",
+			"example.net {\n\tbackend 1.2.3.4:443\n\tmaintenance yes\n}\n",
+			"maintenance",
+			3,
+		},
+	}
+
+	for _, test := range(tests) {
+		_, err := parseString(test.in)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: expected a ParseError, got %v", test.desc, err)
+			continue
+		}
+		if perr.Directive != test.directive || perr.Line != test.line {
+			t.Errorf("%s: wrong error location: got %q line %d, wanted %q line %d",
+				 test.desc, perr.Directive, perr.Line, test.directive, test.line)
+		}
+	}
+}
+
+func TestParseValid(t *testing.T) {
+	c, err := parseString(`
+example.net, *.example.net {
+	backend 1.2.3.4:443 {
+		send-proxy-v2
+		send-proxy-v2-tag 0xe0 "tier 1"
+		send-proxy-v2-tag 239 eu
+		proxy-dest [2001:db8::1]:8443
+	}
+	acme 1.2.3.5:443
+	allow 10.0.0.0/8, acme
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(c.Routes) != 1 {
+		t.Fatalf("Wrong number of routes: got %d, wanted 1", len(c.Routes))
+	}
+
+	route := c.Routes[0]
+	if len(route.Domains) != 2 || len(route.Backends) != 1 || route.ACME == nil || !route.AllowACME {
+		t.Errorf("Route was not parsed correctly")
+	}
+	if route.Backends[0].SendProxy != ProxyV2 {
+		t.Errorf("Wrong PROXY protocol version: got %d, wanted %d", route.Backends[0].SendProxy, ProxyV2)
+	}
+	tags := route.Backends[0].SendProxyTags
+	if len(tags) != 2 || tags[0] != (ProxyTag{ 0xe0, "tier 1" }) || tags[1] != (ProxyTag{ 0xef, "eu" }) {
+		t.Errorf("Wrong PROXY v2 tags: %v", tags)
+	}
+	if dest := route.Backends[0].ProxyDest; dest == nil || dest.String() != "[2001:db8::1]:8443" {
+		t.Errorf("Wrong PROXY destination: %v", dest)
+	}
+	if !route.Log {
+		t.Errorf("Access logging is not enabled by default")
+	}
+	if !route.NoDelay {
+		t.Errorf("TCP_NODELAY is not set by default")
+	}
+	if c.KeepAlive != time.Minute {
+		t.Errorf("Wrong default keepalive: got %s", c.KeepAlive)
+	}
+	if !c.ProxyPreserve {
+		t.Errorf("PROXY addresses are not preserved by default")
+	}
+	if route.Backends[0].DialTimeout != 3 * time.Second || route.Backends[0].IdleTimeout != 10 * time.Minute {
+		t.Errorf("Wrong default timeouts")
+	}
+}
+
+func TestBackendDNS(t *testing.T) {
+	c, err := parseString("backend-dns-ttl 1m round-robin\nexample.net {\n\tbackend backend.invalid:443\n}\nno-sni localhost:443\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	backend := c.Routes[0].Backends[0]
+	if backend.DNSTTL != time.Minute || !backend.DNSRoundRobin {
+		t.Fatalf("DNS cache not configured: %s, %v", backend.DNSTTL, backend.DNSRoundRobin)
+	}
+	if noSNI := c.NoSNI.Backends[0]; noSNI.DNSTTL != time.Minute {
+		t.Errorf("DNS cache not configured for the no-sni backend")
+	}
+
+	// Cached addresses are used in turn.
+	backend.dns = dnsCache{
+		hosts: map[string]*dnsEntry{
+			"backend.invalid": {
+				ips: []net.IP{ net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2") },
+				expires: time.Now().Add(time.Minute),
+			},
+		},
+	}
+	tests := []struct {
+		desc string
+		in   string
+		out  string
+	}{
+		{ "First record", "backend.invalid:443", "192.0.2.1:443 192.0.2.2:443" },
+		{ "Next record", "backend.invalid:443", "192.0.2.2:443 192.0.2.1:443" },
+		{ "IP address", "192.0.2.3:443", "192.0.2.3:443" },
+		{ "Unix socket", "/run/backend.sock", "/run/backend.sock" },
+	}
+	for _, test := range(tests) {
+		network := "tcp"
+		if strings.HasPrefix(test.in, "/") {
+			network = "unix"
+		}
+		if out := strings.Join(backend.ResolveAddress(network, test.in), " "); out != test.out {
+			t.Errorf("%s: got %q, wanted %q", test.desc, out, test.out)
+		}
+	}
+
+	// Stale addresses are kept if the host can't be resolved anymore.
+	backend.DNSRoundRobin = false
+	backend.DialTimeout = 100 * time.Millisecond
+	backend.dns.hosts["backend.invalid"].expires = time.Now()
+	if out := backend.ResolveAddress("tcp", "backend.invalid:443"); out[0] != "192.0.2.1:443" {
+		t.Errorf("Stale addresses not used: %v", out)
+	}
+
+	// Hosts resolved for the first time.
+	backend.dns = dnsCache{}
+	if out := backend.ResolveAddress("tcp", "backend.invalid:443"); len(out) != 1 || out[0] != "backend.invalid:443" {
+		t.Errorf("Unresolved address not kept: %v", out)
+	}
+	c.NoSNI.Backends[0].DialTimeout = time.Second
+	if out := c.NoSNI.Backends[0].ResolveAddress("tcp", "localhost:443"); len(out) == 0 || strings.Contains(out[0], "localhost") {
+		t.Errorf("localhost not resolved: %v", out)
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	var mu sync.Mutex
+	lookups := make(map[string]int)
+	release := make(chan struct{})
+	cache := &dnsCache{
+		resolve: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			mu.Lock()
+			lookups[host]++
+			mu.Unlock()
+			if host == "slow.example.net" {
+				<-release
+			}
+			ip := net.IPv4(192, 0, 2, byte(len(host)))
+			return []net.IPAddr{{ IP: ip }}, nil
+		},
+	}
+
+	// Concurrent lookups of a host name wait for a single resolution,
+	// without blocking the lookups of other host names.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips, err := cache.lookup("slow.example.net", time.Minute, time.Second); err != nil || len(ips) != 1 {
+				t.Errorf("Wrong slow lookup: %v (%v)", ips, err)
+			}
+		}()
+	}
+	for resolving := false; !resolving; {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		resolving = lookups["slow.example.net"] > 0
+		mu.Unlock()
+	}
+	for _, host := range([]string{ "a.example.net", "bb.example.net", "a.example.net" }) {
+		ips, err := cache.lookup(host, time.Minute, time.Second)
+		if err != nil || !ips[0].Equal(net.IPv4(192, 0, 2, byte(len(host)))) {
+			t.Errorf("Wrong addresses for %s: %v (%v)", host, ips, err)
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	for host, n := range(map[string]int{ "slow.example.net": 1, "a.example.net": 1, "bb.example.net": 1 }) {
+		if lookups[host] != n {
+			t.Errorf("%s resolved %d times, wanted %d", host, lookups[host], n)
+		}
+	}
+
+	// The cache is bounded.
+	for i := 0; i < dnsCacheSize + 10; i++ {
+		cache.lookup(fmt.Sprintf("%d.example.net", i), time.Minute, time.Second)
+	}
+	if len(cache.hosts) > dnsCacheSize {
+		t.Errorf("Cache is not bounded: %d host names", len(cache.hosts))
+	}
+}
+
+func TestBackendDialer(t *testing.T) {
+	c, err := parseString("example.net {\n\tbackend 1.2.3.4:443 {\n\t\tsource 2001:db8::1\n\t}\n\tbackend 1.2.3.5:443\n}\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	backend := c.Routes[0].Backends[0]
+	if d := backend.Dialer("tcp"); d.LocalAddr.String() != "[2001:db8::1]:0" || d.Timeout != backend.DialTimeout {
+		t.Errorf("Wrong TCP dialer: %v", d.LocalAddr)
+	}
+	if d := backend.Dialer("udp"); d.LocalAddr.Network() != "udp" {
+		t.Errorf("Wrong UDP dialer: %v", d.LocalAddr)
+	}
+	if d := c.Routes[0].Backends[1].Dialer("tcp"); d.LocalAddr != nil {
+		t.Errorf("Unexpected source address: %v", d.LocalAddr)
+	}
+}
+
+func TestParseNoDelay(t *testing.T) {
+	c, err := parseString("example.net {\n\tbackend 1.2.3.4:443\n\tnodelay off\n}\nno-sni 1.2.3.5:443\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if c.Routes[0].NoDelay || !c.NoSNI.NoDelay {
+		t.Errorf("Wrong nodelay values: %v, %v", c.Routes[0].NoDelay, c.NoSNI.NoDelay)
+	}
+}
+
+func TestParseACMEOnly(t *testing.T) {
+	c, err := parseString("example.net {\n\tacme 1.2.3.4:443\n}\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if route := c.Routes[0]; route.ACME == nil || len(route.Backends) != 0 {
+		t.Errorf("ACME-only route was not parsed correctly")
+	}
+
+	// Non-ACME connections to an ACME-only route have no backend.
+	if c.Routes[0].AcquireBackend(false, nil, nil) != nil {
+		t.Errorf("A backend was selected for a non-ACME connection")
+	}
+}
+
+func TestParseACMESelf(t *testing.T) {
+	dir := t.TempDir()
+	c, err := parseString("example.net {\n\tacme-self " + dir + "\n}\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if route := c.Routes[0]; route.ACMESelf == nil || route.ACMESelf.Dir != dir {
+		t.Errorf("ACME responder was not parsed correctly")
+	}
+
+	if _, err := parseString("example.net {\n\tacme-self " + dir + " " + dir + "/key.pem\n}\n"); err == nil {
+		t.Errorf("Missing account key was accepted")
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	c, err := parseString(`
+rate-limit 0.5
+example.net {
+	backend 1.2.3.4:443
+	rate-limit 10 20
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(c.Routes) != 1 {
+		t.Fatalf("Wrong number of routes: got %d, wanted 1", len(c.Routes))
+	}
+	if c.RateLimit == nil || c.RateLimit.Rate != 0.5 || c.RateLimit.Burst != 1 {
+		t.Errorf("Global rate limit was not parsed correctly")
+	}
+	if l := c.Routes[0].RateLimit; l == nil || l.Rate != 10 || l.Burst != 20 {
+		t.Errorf("Route rate limit was not parsed correctly")
+	}
+}
+
+func TestParseKeepAlive(t *testing.T) {
+	tests := []struct {
+		in  string
+		out time.Duration
+	}{
+		{ "keepalive 30s", 30 * time.Second },
+		{ "keepalive off", 0 },
+		{ "keepalive 0", 0 },
+	}
+
+	for _, test := range(tests) {
+		c, err := parseString(test.in + "\nexample.net {\n\tbackend 1.2.3.4:443\n}\n")
+		if err != nil || c.KeepAlive != test.out {
+			t.Errorf("%q: got %s (%v), wanted %s", test.in, c.KeepAlive, err, test.out)
+		}
+	}
+}
+
+func TestParseMaxConnections(t *testing.T) {
+	tests := []struct {
+		in    string
+		max   int
+		pause bool
+	}{
+		{ "", 0, false },
+		{ "max-connections 100", 100, false },
+		{ "max-connections 100 close", 100, false },
+		{ "max-connections 100 pause", 100, true },
+	}
+
+	for _, test := range(tests) {
+		c, err := parseString(test.in + "\nexample.net {\n\tbackend 1.2.3.4:443\n}\n")
+		if err != nil || c.MaxConns != test.max || c.MaxConnsPause != test.pause {
+			t.Errorf("%q: got %d, %t (%v), wanted %d, %t", test.in, c.MaxConns, c.MaxConnsPause, err, test.max, test.pause)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	t.Setenv("SNIPROXY_TEST_ORIGIN", "1.2.3.4")
+	t.Setenv("SNIPROXY_TEST_PORT", "8443")
+
+	c, err := parseString("example.net {\n\tbackend ${SNIPROXY_TEST_ORIGIN}:$SNIPROXY_TEST_PORT\n}\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := c.Routes[0].Backends[0].Address; got != "1.2.3.4:8443" {
+		t.Errorf("Wrong backend address: got %s, wanted 1.2.3.4:8443", got)
+	}
+}
+
+// Writes files to a temporary directory and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range(files) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"sniproxy.conf": "include routes/*.conf\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+		"routes/a.conf": "a.example.net {\n\tbackend 1.2.3.5:443\n}\n",
+		"routes/b.conf": "b.example.net {\n\tbackend 1.2.3.6:443\n}\n",
+	})
+
+	c := &Config{}
+	if err := c.ReadFile(filepath.Join(dir, "sniproxy.conf")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var domains []string
+	for _, route := range(c.Routes) {
+		domains = append(domains, route.Domains[0].Pattern)
+	}
+	if strings.Join(domains, ",") != "a.example.net,b.example.net,example.net" {
+		t.Errorf("Wrong routes: %v", domains)
+	}
+}
+
+func TestReadStdin(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"stdin": "include routes/*.conf\nexample.net {\n\tbackend 1.2.3.4:443\n}\n",
+		"routes/a.conf": "a.example.net {\n\tbackend 1.2.3.5:443\n}\n",
+	})
+
+	stdin, err := os.Open(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer func(f *os.File) { os.Stdin = f }(os.Stdin)
+	os.Stdin = stdin
+
+	// Relative includes are resolved against the current directory.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{}
+	if err := c.ReadFile("-"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(c.Routes) != 2 || c.Routes[0].Domains[0].Pattern != "a.example.net" {
+		t.Errorf("Configuration was not read from stdin")
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	tests := []struct {
+		desc  string
+		files map[string]string
+		file  string
+		line  uint
+	}{
+		{
+			"Include cycle",
+			map[string]string{
+				"sniproxy.conf": "include a.conf\n",
+				"a.conf": "\ninclude sniproxy.conf\n",
+			},
+			"a.conf",
+			2,
+		},
+		{
+			"Error in an included file",
+			map[string]string{
+				"sniproxy.conf": "include a.conf\n",
+				"a.conf": "example.net {\n\tbackend\n}\n",
+			},
+			"a.conf",
+			2,
+		},
+		{
+			"Unreadable included file",
+			map[string]string{
+				"sniproxy.conf": "\ninclude a\n",
+				"a/b.conf": "",
+			},
+			"sniproxy.conf",
+			2,
+		},
+	}
+
+	for _, test := range(tests) {
+		dir := writeFiles(t, test.files)
+		err := (&Config{}).ReadFile(filepath.Join(dir, "sniproxy.conf"))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: expected a ParseError, got %v", test.desc, err)
+			continue
+		}
+		if perr.File != filepath.Join(dir, test.file) || perr.Line != test.line {
+			t.Errorf("%s: wrong error location: got %s:%d, wanted %s:%d",
+				 test.desc, perr.File, perr.Line, test.file, test.line)
+		}
+	}
+}
+
+func TestRangeLists(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"sniproxy.conf": "example.net {\n\tbackend 1.2.3.4:443\n\tdeny @lists/deny.txt, 10.1.0.0/16\n\tallow @lists/allow.txt\n}\n",
+		"lists/deny.txt": "# Blocklist\n10.0.0.0/8\n\n  192.168.0.1  # scanner\n",
+		"lists/allow.txt": "10.0.0.1\n",
+	})
+
+	c := &Config{}
+	if err := c.ReadFile(filepath.Join(dir, "sniproxy.conf")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	route := c.Routes[0]
+	if fmt.Sprint(route.Deny[:3]) != "[10.0.0.0/8 192.168.0.1/32 10.1.0.0/16]" {
+		t.Errorf("Wrong denied subnets: %v", route.Deny)
+	}
+	if fmt.Sprint(route.Allow) != "[10.0.0.1/32]" {
+		t.Errorf("Wrong allowed subnets: %v", route.Allow)
+	}
+
+	// An empty allow list denies everyone.
+	dir = writeFiles(t, map[string]string{
+		"sniproxy.conf": "example.net {\n\tbackend 1.2.3.4:443\n\tallow @allow.txt\n}\n",
+		"allow.txt": "# Nobody yet\n\n",
+	})
+	c = &Config{}
+	if err := c.ReadFile(filepath.Join(dir, "sniproxy.conf")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, ip := range([]string{ "10.0.0.1", "2001:db8::1" }) {
+		if d := c.Routes[0].Check(net.ParseIP(ip), nil); d != ACLDefaultDeny {
+			t.Errorf("Wrong decision for %s with an empty allow list: %s", ip, d)
+		}
+	}
+
+	tests := []struct {
+		desc  string
+		files map[string]string
+		file  string
+		line  uint
+	}{
+		{
+			"Invalid subnet in a list",
+			map[string]string{
+				"sniproxy.conf": "example.net {\n\tbackend 1.2.3.4:443\n\tdeny @deny.txt\n}\n",
+				"deny.txt": "10.0.0.0/8\n# Comment\n10.0.0.300\n",
+			},
+			"deny.txt",
+			3,
+		},
+		{
+			"Missing list",
+			map[string]string{
+				"sniproxy.conf": "example.net {\n\tbackend 1.2.3.4:443\n\tallow @allow.txt\n}\n",
+			},
+			"sniproxy.conf",
+			3,
+		},
+	}
+
+	for _, test := range(tests) {
+		dir := writeFiles(t, test.files)
+		err := (&Config{}).ReadFile(filepath.Join(dir, "sniproxy.conf"))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: expected a ParseError, got %v", test.desc, err)
+			continue
+		}
+		if perr.File != filepath.Join(dir, test.file) || perr.Line != test.line {
+			t.Errorf("%s: wrong error location: got %s:%d, wanted %s:%d",
+				 test.desc, perr.File, perr.Line, test.file, test.line)
+		}
+	}
+}
+
+func TestMap(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"sniproxy.conf": "example.net {\n\tbackend 1.2.3.4:443\n}\n# @owner hosting\nmap maps/hosting.map\n",
+		"maps/hosting.map": "# Customers\nexample.org 10.0.0.1:443\n\n  Example.COM   10.0.0.2:8443  # legacy\nbücher.example 10.0.0.3:443\n",
+	})
+	file := filepath.Join(dir, "sniproxy.conf")
+
+	c := &Config{}
+	if err := c.ReadFile(file); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(c.Routes) != 4 {
+		t.Fatalf("Wrong number of routes: %d", len(c.Routes))
+	}
+
+	tests := []struct {
+		desc string
+		in   string
+		out  string
+	}{
+		{ "Route block", "example.net", "1.2.3.4:443" },
+		{ "Map entry", "example.org", "10.0.0.1:443" },
+		{ "Map entry (case insensitive)", "example.com", "10.0.0.2:8443" },
+		{ "Map entry (IDN)", "xn--bcher-kva.example", "10.0.0.3:443" },
+		{ "Exact match only", "www.example.org", "" },
+	}
+	for _, test := range(tests) {
+		route, _, err := c.Match(test.in, nil)
+		if test.out == "" {
+			if err == nil {
+				t.Errorf("%s: unexpected match", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.desc, err)
+		} else if route.Backends[0].Address != test.out {
+			t.Errorf("%s: wrong backend %q, wanted %q", test.desc, route.Backends[0].Address, test.out)
+		} else if test.in != "example.net" && route.Annotations["owner"] != "hosting" {
+			t.Errorf("%s: wrong annotations: %v", test.desc, route.Annotations)
+		}
+	}
+
+	// Maps are read again with the configuration.
+	os.WriteFile(filepath.Join(dir, "maps/hosting.map"), []byte("example.org 10.0.0.4:443\n"), 0644)
+	c = &Config{}
+	if err := c.ReadFile(file); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if route, _, err := c.Match("example.org", nil); err != nil || route.Backends[0].Address != "10.0.0.4:443" {
+		t.Errorf("Map not read again: %v", err)
+	}
+	if _, _, err := c.Match("example.com", nil); err == nil {
+		t.Errorf("Removed map entry still matched")
+	}
+
+	errors := []struct {
+		desc  string
+		files map[string]string
+		file  string
+		line  uint
+	}{
+		{
+			"Missing backend",
+			map[string]string{
+				"sniproxy.conf": "map hosting.map\n",
+				"hosting.map": "example.org 10.0.0.1:443\nexample.com\n",
+			},
+			"hosting.map",
+			2,
+		},
+		{
+			"Wildcard domain",
+			map[string]string{
+				"sniproxy.conf": "map hosting.map\n",
+				"hosting.map": "*.example.org 10.0.0.1:443\n",
+			},
+			"hosting.map",
+			1,
+		},
+		{
+			"Invalid backend",
+			map[string]string{
+				"sniproxy.conf": "map hosting.map\n",
+				"hosting.map": "# Customers\n\nexample.org 10.0.0.1\n",
+			},
+			"hosting.map",
+			3,
+		},
+		{
+			"Duplicate domain in the map",
+			map[string]string{
+				"sniproxy.conf": "map hosting.map\n",
+				"hosting.map": "example.org 10.0.0.1:443\nEXAMPLE.org 10.0.0.2:443\n",
+			},
+			"hosting.map",
+			2,
+		},
+		{
+			"Duplicate domain of a route",
+			map[string]string{
+				"sniproxy.conf": "example.org {\n\tbackend 1.2.3.4:443\n}\nmap hosting.map\n",
+				"hosting.map": "example.org 10.0.0.1:443\n",
+			},
+			"hosting.map",
+			1,
+		},
+		{
+			"Duplicate domain after the map",
+			map[string]string{
+				"sniproxy.conf": "map hosting.map\nexample.org {\n\tbackend 1.2.3.4:443\n}\n",
+				"hosting.map": "example.org 10.0.0.1:443\n",
+			},
+			"sniproxy.conf",
+			2,
+		},
+		{
+			"Missing map",
+			map[string]string{
+				"sniproxy.conf": "\nmap hosting.map\n",
+			},
+			"sniproxy.conf",
+			2,
+		},
+	}
+
+	for _, test := range(errors) {
+		dir := writeFiles(t, test.files)
+		err := (&Config{}).ReadFile(filepath.Join(dir, "sniproxy.conf"))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%s: expected a ParseError, got %v", test.desc, err)
+			continue
+		}
+		if perr.File != filepath.Join(dir, test.file) || perr.Line != test.line {
+			t.Errorf("%s: wrong error location: got %s:%d, wanted %s:%d",
+				 test.desc, perr.File, perr.Line, test.file, test.line)
+		}
+	}
+}
+
+func TestMatchALPN(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	backend 1.2.3.4:443
+	alpn h2
+}
+example.net {
+	backend 1.2.3.5:443
+	alpn http/1.1, acme-tls/1
+}
+*.example.net {
+	backend 1.2.3.6:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		sni   string
+		alpn  []string
+		route int
+	}{
+		{ "example.net", []string{"h2", "http/1.1"}, 0 },
+		{ "example.net", []string{"http/1.1"}, 1 },
+		{ "example.net", []string{"acme-tls/1"}, 1 },
+		{ "example.net", nil, -1 },
+		{ "www.example.net", []string{"h2"}, 2 },
+	}
+	for _, test := range(tests) {
+		route, _, err := c.Match(test.sni, test.alpn)
+		if test.route < 0 {
+			if err == nil {
+				t.Errorf("%s %v: matched a route while none should", test.sni, test.alpn)
+			}
+			continue
+		}
+		if route != c.Routes[test.route] {
+			t.Errorf("%s %v: wrong route matched", test.sni, test.alpn)
+		}
+	}
+
+	// Routes can only share domains if they match different protocols.
+	_, err = parseString("example.net {\n\tbackend 1.2.3.4:443\n\talpn h2, http/1.1\n}\n" +
+			     "example.net {\n\tbackend 1.2.3.5:443\n\talpn http/1.1, h2\n}\n")
+	if err == nil {
+		t.Errorf("Duplicate domain with the same protocols was accepted")
+	}
+}
+
+func TestMatchPort(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	backend 1.2.3.4:443
+	port 8443
+}
+example.net {
+	backend 1.2.3.5:443
+}
+*.example.org {
+	backend 1.2.3.6:443
+	port 8443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		sni   string
+		port  int
+		route int
+	}{
+		{ "example.net", 8443, 0 },
+		{ "example.net", 443, 1 },
+		{ "example.net", 0, 1 },
+		{ "www.example.org", 8443, 2 },
+		{ "www.example.org", 443, -1 },
+	}
+	for _, test := range(tests) {
+		route, _, err := c.MatchPort(test.sni, nil, test.port)
+		if test.route < 0 {
+			if err == nil {
+				t.Errorf("%s:%d: matched a route while none should", test.sni, test.port)
+			}
+			continue
+		}
+		if route != c.Routes[test.route] {
+			t.Errorf("%s:%d: wrong route matched", test.sni, test.port)
+		}
+	}
+
+	// Resolving without a port never uses port-restricted routes.
+	if backend, err := c.ResolvePort("example.net", nil, net.IPv4zero, 8443); err != nil || backend.Address != "1.2.3.4:443" {
+		t.Errorf("Resolved example.net:8443 to %v (%v)", backend, err)
+	}
+	if backend, err := c.Resolve("example.net", nil, net.IPv4zero); err != nil || backend.Address != "1.2.3.5:443" {
+		t.Errorf("Resolved example.net to %v (%v)", backend, err)
+	}
+
+	_, _, candidates, _ := c.MatchPortDebug("example.net", nil, 443)
+	if len(candidates) != 2 || candidates[0].Skipped != "port" || candidates[1].Skipped != "" {
+		t.Errorf("Wrong candidates: %v", candidates)
+	}
+
+	// Routes can only share domains if they are restricted to different
+	// ports.
+	_, err = parseString("example.net {\n\tbackend 1.2.3.4:443\n\tport 8443\n}\n" +
+			     "example.net {\n\tbackend 1.2.3.5:443\n\tport 8443\n}\n")
+	if err == nil {
+		t.Errorf("Duplicate domain with the same port was accepted")
+	}
+}
+
+func TestDialAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		dial    string
+	}{
+		{ "1.2.3.4:443", "tcp", "1.2.3.4:443" },
+		{ "[2001:db8::1]:443", "tcp", "[2001:db8::1]:443" },
+		{ ":8443", "tcp", "example.net:8443" },
+		{ "unix:/run/origin.sock", "unix", "/run/origin.sock" },
+	}
+
+	for _, test := range(tests) {
+		c, err := parseString("example.net {\n\tbackend " + test.address + "\n}\n")
+		if err != nil {
+			t.Errorf("%s: unexpected error (%s)", test.address, err)
+			continue
+		}
+		network, dial := c.Routes[0].Backends[0].DialAddress("example.net")
+		if network != test.network || dial != test.dial {
+			t.Errorf("%s: got %s %s, wanted %s %s", test.address, network, dial, test.network, test.dial)
+		}
+	}
+}
+
+func TestShadowed(t *testing.T) {
+	c, err := parseString(`
+*.example.net {
+	backend 1.2.3.4:443
+}
+www.example.net, example.net {
+	backend 1.2.3.5:443
+}
+www.example.net {
+	alpn h2
+	backend 1.2.3.6:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	warnings := c.Shadowed()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"www.example.net" (line 8)`) {
+		t.Errorf("Wrong warnings: %v", warnings)
+	}
+}
+
+func TestNextBackend(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	backend 1.2.3.4:443, 1.2.3.5:443 {
+		send-proxy
+	}
+	backend 1.2.3.6:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	route := c.Routes[0]
+	if len(route.Backends) != 3 {
+		t.Fatalf("Wrong number of backends: got %d, wanted 3", len(route.Backends))
+	}
+	if route.Backends[1].SendProxy != ProxyV1 || route.Backends[2].SendProxy != ProxyNone {
+		t.Errorf("Backend options were not applied correctly")
+	}
+
+	for i, want := range([]string{"1.2.3.4:443", "1.2.3.5:443", "1.2.3.6:443", "1.2.3.4:443"}) {
+		if got := route.NextBackend(nil).Address; got != want {
+			t.Errorf("Selection #%d: got %s, wanted %s", i, got, want)
+		}
+	}
+
+	// Unhealthy backends are skipped.
+	route.Backends[1].SetHealthy(false)
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[route.NextBackend(nil).Address]++
+	}
+	if seen["1.2.3.5:443"] != 0 || seen["1.2.3.4:443"] == 0 || seen["1.2.3.6:443"] == 0 {
+		t.Errorf("Wrong selection with an unhealthy backend: %v", seen)
+	}
+
+	for _, backend := range(route.Backends) {
+		backend.SetHealthy(false)
+	}
+	if route.NextBackend(nil) != nil {
+		t.Errorf("A backend was selected while none is healthy")
+	}
+}
+
+func TestALPNBackends(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	backend 1.2.3.4:443 {
+		alpn h2
+	}
+	backend 1.2.3.5:443 {
+		alpn http/1.1, http/1.0
+	}
+	backend 1.2.3.6:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	route := c.Routes[0]
+
+	tests := []struct {
+		desc      string
+		alpn      []string
+		unhealthy string
+		out       string
+	}{
+		{ "No ALPN", nil, "", "1.2.3.6:443" },
+		{ "Unknown protocol", []string{"h3"}, "", "1.2.3.6:443" },
+		{ "h2 only", []string{"h2"}, "", "1.2.3.4:443" },
+		{ "http/1.1 only", []string{"http/1.1"}, "", "1.2.3.5:443" },
+		{ "Second protocol of a backend", []string{"http/1.0"}, "", "1.2.3.5:443" },
+		{ "Backends order wins", []string{"http/1.1", "h2"}, "", "1.2.3.4:443" },
+		{ "Unhealthy preferred backend", []string{"h2", "http/1.1"}, "1.2.3.4:443", "1.2.3.5:443" },
+		{ "Fallback to the default backend", []string{"h2"}, "1.2.3.4:443", "1.2.3.6:443" },
+	}
+
+	for _, test := range(tests) {
+		for _, backend := range(route.Backends) {
+			backend.SetHealthy(backend.Address != test.unhealthy)
+		}
+		// Dedicated backends are never used by the balancing
+		// strategies.
+		for i := 0; i < 3; i++ {
+			backend := route.AcquireBackend(false, nil, test.alpn)
+			if backend == nil {
+				t.Fatalf("%s: no backend selected", test.desc)
+			}
+			backend.Release()
+			if backend.Address != test.out {
+				t.Errorf("%s: got %s, wanted %s", test.desc, backend.Address, test.out)
+			}
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	c, err := parseString(`
+default {
+	backend 1.2.3.4:443
+}
+example.net, *.example.net {
+	backend 1.2.3.5:443
+}
+~[a-z0-9-]+\\.example\\.org|example\\.com {
+	backend 1.2.3.6:443
+}
+~intranet {
+	backend 1.2.3.7:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		sni     string
+		pattern string
+	}{
+		{ "example.net", "example.net" },
+		{ "www.example.net", "*.example.net" },
+		{ "Example.NET", "example.net" },
+		{ "WWW.example.Net", "*.example.net" },
+		{ "WWW.Example.ORG", `~[a-z0-9-]+\.example\.org|example\.com` },
+		{ "www.example.org", `~[a-z0-9-]+\.example\.org|example\.com` },
+		{ "a.b.example.org", "default" },
+		{ "example.com", `~[a-z0-9-]+\.example\.org|example\.com` },
+		{ "www.example.com", "default" },
+		// Raw regular expressions without metacharacters.
+		{ "intranet", "~intranet" },
+		{ "Intranet", "~intranet" },
+		{ "~intranet", "default" },
+		{ "", "default" },
+	}
+	for _, test := range(tests) {
+		_, pattern, err := c.Match(test.sni, nil)
+		if err != nil || pattern != test.pattern {
+			t.Errorf("%q: got %q (%v), wanted %q", test.sni, pattern, err, test.pattern)
+		}
+	}
+
+	c, err = parseString("no-sni default\ndefault {\n\tbackend 1.2.3.4:443\n}\n")
+	if err != nil || c.NoSNI == nil || c.NoSNI != c.Default {
+		t.Errorf("No-sni was not set to the default route (%v)", err)
+	}
+	c, err = parseString("no-sni 1.2.3.6:443 {\n\tsend-proxy\n}\n")
+	if err != nil || c.NoSNI == nil || len(c.Routes) != 0 ||
+	   c.NoSNI.Backends[0].SendProxy != ProxyV1 {
+		t.Errorf("No-sni backend was not parsed correctly (%v)", err)
+	}
+
+	c, _ = parseString("example.net {\n\tbackend 1.2.3.5:443\n}\n")
+	if _, _, err := c.Match("example.com", nil); err == nil {
+		t.Errorf("Matched a route while none should")
+	}
+
+	c, _ = parseString("Example.NET {\n\tbackend 1.2.3.5:443\n}\n")
+	if _, pattern, err := c.Match("example.net", nil); err != nil || pattern != "Example.NET" {
+		t.Errorf("Domains are not matched case-insensitively (%v)", err)
+	}
+
+}
+
+func TestMatchPrecedence(t *testing.T) {
+	c, err := parseString(`
+~.*\\.example\\.com {
+	backend 1.2.3.4:443
+}
+*.example.com {
+	backend 1.2.3.5:443
+}
+*.api.example.com {
+	backend 1.2.3.6:443
+}
+api.example.com {
+	backend 1.2.3.7:443
+}
+a*.example.com {
+	backend 1.2.3.8:443
+}
+*b.example.com {
+	backend 1.2.3.9:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		sni     string
+		pattern string
+	}{
+		{ "api.example.com", "api.example.com" },
+		{ "v1.api.example.com", "*.api.example.com" },
+		{ "www.example.com", "*.example.com" },
+		{ "ab.example.com", "*b.example.com" },
+		{ "ac.example.com", "*.example.com" },
+		{ "www.example.com.example.org", "" },
+	}
+	for _, test := range(tests) {
+		_, pattern, _ := c.Match(test.sni, nil)
+		if pattern != test.pattern {
+			t.Errorf("%q: got %q, wanted %q", test.sni, pattern, test.pattern)
+		}
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	conf := `
+*.example.net {
+	backend 1.2.3.4:443
+}
+www.*.example.org {
+	backend 1.2.3.5:443
+}
+www*.example.com {
+	backend 1.2.3.6:443
+}
+`
+
+	tests := []struct {
+		sni    string
+		greedy string
+		strict string
+	}{
+		{ "www.example.net", "*.example.net", "*.example.net" },
+		{ "a.b.example.net", "*.example.net", "" },
+		{ "example.net", "", "" },
+		{ ".example.net", "*.example.net", "" },
+		{ "www.example.net.attacker.com", "", "" },
+		{ "www.eu.example.org", "www.*.example.org", "www.*.example.org" },
+		{ "www.a.b.example.org", "www.*.example.org", "" },
+		{ "www..example.org", "www.*.example.org", "" },
+		{ "www2.example.com", "www*.example.com", "www*.example.com" },
+		{ "www.example.com", "www*.example.com", "www*.example.com" },
+		{ "www.a.example.com", "www*.example.com", "" },
+	}
+
+	for _, mode := range([]string{ "greedy", "strict" }) {
+		c, err := parseString("wildcards " + mode + "\n" + conf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		for _, test := range(tests) {
+			want := test.greedy
+			if mode == "strict" {
+				want = test.strict
+			}
+			if _, pattern, _ := c.Match(test.sni, nil); pattern != want {
+				t.Errorf("%s: %q: got %q, wanted %q", mode, test.sni, pattern, want)
+			}
+		}
+	}
+
+	// Greedy wildcards are the default.
+	c, _ := parseString(conf)
+	if c.StrictWildcards {
+		t.Errorf("Wildcards are strict by default")
+	}
+}
+
+func TestIDNA(t *testing.T) {
+	c, err := parseString(`
+münchen.de {
+	backend 1.2.3.4:443
+}
+xn--zrich-kva.ch {
+	backend 1.2.3.5:443
+}
+*.köln.de {
+	backend 1.2.3.6:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		sni     string
+		pattern string
+	}{
+		{ "xn--mnchen-3ya.de", "münchen.de" },
+		{ "münchen.de", "münchen.de" },
+		{ "MÜNCHEN.de", "münchen.de" },
+		{ "zürich.ch", "xn--zrich-kva.ch" },
+		{ "XN--ZRICH-KVA.CH", "xn--zrich-kva.ch" },
+		{ "www.xn--kln-sna.de", "*.köln.de" },
+	}
+	for _, test := range(tests) {
+		sni, err := ToASCII(test.sni)
+		if err != nil {
+			t.Errorf("%q: unexpected error (%s)", test.sni, err)
+			continue
+		}
+		_, pattern, err := c.Match(sni, nil)
+		if err != nil || pattern != test.pattern {
+			t.Errorf("%q: got %q (%v), wanted %q", test.sni, pattern, err, test.pattern)
+		}
+	}
+
+	for _, sni := range([]string{ "xn--zz.de", "xn--ab-.de", "xn--a.de" }) {
+		if _, err := ToASCII(sni); err == nil {
+			t.Errorf("%q: invalid SNI was accepted", sni)
+		}
+	}
+}
+
+func TestToASCIIValidation(t *testing.T) {
+	tests := []struct {
+		desc  string
+		in    string
+		valid bool
+	}{
+		{ "Host name", "www.example.net", true },
+		{ "Digits and hyphens", "a-1.example.net", true },
+		{ "Underscore", "_service.example.net", true },
+		{ "Longest label", strings.Repeat("a", 63) + ".net", true },
+		{ "Longest name", strings.Repeat(strings.Repeat("a", 62) + ".", 4) + "a", true },
+		{ "Name too long", strings.Repeat(strings.Repeat("a", 62) + ".", 4) + "ab", false },
+		{ "Oversized value", strings.Repeat("a", 4096), false },
+		{ "Label too long", strings.Repeat("a", 64) + ".net", false },
+		{ "Leading dot", ".example.net", false },
+		{ "Trailing dot", "example.net.", false },
+		{ "Empty label", "www..example.net", false },
+		{ "Leading hyphen", "-www.example.net", false },
+		{ "Trailing hyphen", "www-.example.net", false },
+		{ "Space", "www example.net", false },
+		{ "Regular expression", "(a+)+.example.net", false },
+		{ "Wildcard", "*.example.net", false },
+		{ "Control character", "www.example.net\x00", false },
+		{ "Internationalized", "münchen.de", true },
+	}
+
+	for _, tt := range(tests) {
+		if _, err := ToASCII(tt.in); (err == nil) != tt.valid {
+			t.Errorf("%s: got %v, wanted valid: %t", tt.desc, err, tt.valid)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	c, err := parseString(`
+no-sni 1.2.3.9:443
+example.net {
+	backend 1.2.3.4:443
+	acme 1.2.3.5:443
+	allow 10.0.0.0/8, acme
+}
+example.com {
+	backend 1.2.3.6:443
+	deny 10.0.0.0/8
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c.Routes[1].Backends[0].SetHealthy(false)
+
+	tests := []struct {
+		desc    string
+		sni     string
+		alpn    []string
+		client  string
+		backend string
+		err     error
+	}{
+		{ "Allowed client", "example.net", nil, "10.0.0.1", "1.2.3.4:443", nil },
+		{ "Denied client", "example.net", nil, "192.168.0.1", "", ErrDenied },
+		{ "ACME bypassing ACLs", "example.net", []string{ "acme-tls/1" }, "192.168.0.1", "1.2.3.5:443", nil },
+		{ "Unknown domain", "example.org", nil, "10.0.0.1", "", ErrNoRoute },
+		{ "No SNI", "", nil, "10.0.0.1", "1.2.3.9:443", nil },
+		{ "Denied subnet", "example.com", nil, "10.0.0.1", "", ErrDenied },
+		{ "Unhealthy backend", "example.com", nil, "192.168.0.1", "", ErrNoBackend },
+	}
+	for _, test := range(tests) {
+		backend, err := c.Resolve(test.sni, test.alpn, net.ParseIP(test.client))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, wanted %v", test.desc, err, test.err)
+			continue
+		}
+		if err == nil && backend.Address != test.backend {
+			t.Errorf("%s: got backend %s, wanted %s", test.desc, backend.Address, test.backend)
+		}
+		if backend != nil && backend.ActiveConns() != 0 {
+			t.Errorf("%s: a connection slot was kept", test.desc)
+		}
+	}
+}
+
+// Returns all the patterns of a configuration, in order of precedence.
+func linearPatterns(c *Config) []*entry {
+	var patterns []*entry
+	for _, route := range(c.Routes) {
+		for _, domain := range(route.Domains) {
+			if domain.Regexp != nil && !isLiteral(domain.Pattern) {
+				patterns = append(patterns, &entry{
+					route: route,
+					domain: domain,
+					specificity: specificity(domain),
+					order: len(patterns),
+				})
+			}
+		}
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		return patterns[i].specificity > patterns[j].specificity
+	})
+	return patterns
+}
+
+// Matches an SNI by trying all patterns one by one, as done before wildcards
+// were indexed.
+func linearMatch(c *Config, patterns []*entry, sni string, alpn []string) string {
+	sni = strings.ToLower(sni)
+	for _, e := range(c.exact[sni]) {
+		if e.route.MatchALPN(alpn) {
+			return e.domain.Pattern
+		}
+	}
+
+	for _, e := range(patterns) {
+		if e.route.MatchALPN(alpn) && e.domain.MatchString(sni) {
+			return e.domain.Pattern
+		}
+	}
+	return "default"
+}
+
+func TestMatchDebug(t *testing.T) {
+	c, err := parseString(`
+wildcards strict
+www.example.net {
+	backend 1.2.3.4:443
+	alpn h2
+}
+*.example.net, ~^api[.] {
+	backend 1.2.3.5:443
+	alpn http/1.1
+}
+*.net {
+	backend 1.2.3.6:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		desc    string
+		sni     string
+		alpn    []string
+		pattern string
+		out     string
+	}{
+		{
+			"Exact domain",
+			"www.example.net",
+			[]string{"h2"},
+			"www.example.net",
+			"www.example.net/",
+		},
+		{
+			"Exact domain skipped for its protocols",
+			"www.example.net",
+			[]string{"http/1.1"},
+			"*.example.net",
+			"www.example.net/alpn *.example.net/",
+		},
+		{
+			"Strict wildcard and regular expression",
+			"a.b.example.net",
+			[]string{"h2"},
+			"",
+			"*.example.net/strict *.net/strict ~^api[.]/no match",
+		},
+	}
+
+	for _, test := range(tests) {
+		_, pattern, candidates, err := c.MatchDebug(test.sni, test.alpn)
+		if pattern != test.pattern || (err != nil) != (test.pattern == "") {
+			t.Errorf("%s: got %q (%v), wanted %q", test.desc, pattern, err, test.pattern)
+		}
+		var out []string
+		for _, c := range(candidates) {
+			out = append(out, c.Pattern + "/" + c.Skipped)
+		}
+		if strings.Join(out, " ") != test.out {
+			t.Errorf("%s: got candidates %q, wanted %q", test.desc, strings.Join(out, " "), test.out)
+		}
+	}
+}
+
+func TestMatchTrie(t *testing.T) {
+	conf := `
+default {
+	backend 1.2.3.4:443
+}
+*.example.net {
+	backend 1.2.3.4:443
+	alpn h2
+}
+*.example.net, *.b.example.net {
+	backend 1.2.3.4:443
+}
+*-b.example.net, *.net {
+	backend 1.2.3.4:443
+}
+~.*\\.b\\.example\\.net {
+	backend 1.2.3.4:443
+}
+a.*.example.net, *.a.b.example.net {
+	backend 1.2.3.4:443
+}
+`
+	snis := []string{
+		"example.net", "www.example.net", "a.b.example.net", "x-b.example.net",
+		"b.example.net", ".example.net", "a.a.b.example.net", "a.x.example.net",
+		"WWW.Example.Net", "net", "example.org", "a.b.c.example.net",
+	}
+
+	for _, mode := range(([]string{ "greedy", "strict" })) {
+		c, err := parseString("wildcards " + mode + "\n" + conf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		patterns := linearPatterns(c)
+		for _, sni := range(snis) {
+			for _, alpn := range([][]string{ nil, { "h2" } }) {
+				_, got, _ := c.Match(sni, alpn)
+				if want := linearMatch(c, patterns, sni, alpn); got != want {
+					t.Errorf("%s %q %v: got %q, wanted %q", mode, sni, alpn, got, want)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkWildcards(b *testing.B, match func(c *Config, patterns []*entry, sni string)) {
+	var conf strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&conf, "*.customer%d.example.com {\n\tbackend 1.2.3.4:443\n}\n", i)
+	}
+	c, err := parseString(conf.String())
+	if err != nil {
+		b.Fatalf("Unexpected error: %s", err)
+	}
+
+	patterns := linearPatterns(c)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		match(c, patterns, "www.customer4999.example.com")
+	}
+}
+
+func BenchmarkMatchTrie(b *testing.B) {
+	benchmarkWildcards(b, func(c *Config, _ []*entry, sni string) {
+		if _, pattern, _ := c.Match(sni, nil); pattern != "*.customer4999.example.com" {
+			b.Fatalf("Wrong match: %q", pattern)
+		}
+	})
+}
+
+func BenchmarkMatchLinear(b *testing.B) {
+	benchmarkWildcards(b, func(c *Config, patterns []*entry, sni string) {
+		if pattern := linearMatch(c, patterns, sni, nil); pattern != "*.customer4999.example.com" {
+			b.Fatalf("Wrong match: %q", pattern)
+		}
+	})
+}
+
+func BenchmarkMatch(b *testing.B) {
+	var conf strings.Builder
+	for i := 0; i < 1000; i++ {
+		if i % 10 == 0 {
+			fmt.Fprintf(&conf, "*.example%d.net {\n\tbackend 1.2.3.4:443\n}\n", i)
+		} else {
+			fmt.Fprintf(&conf, "example%d.net {\n\tbackend 1.2.3.4:443\n}\n", i)
+		}
+	}
+	c, err := parseString(conf.String())
+	if err != nil {
+		b.Fatalf("Unexpected error: %s", err)
+	}
+
+	b.Run("map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := c.Match("example999.net", nil); err != nil {
+				b.Fatalf("Unexpected error: %s", err)
+			}
+		}
+	})
+
+	// Baseline, trying each domain in turn as done before exact domains
+	// were looked up in a map.
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if pattern := linearScan(c, "example999.net"); pattern != "example999.net" {
+				b.Fatalf("Wrong match: %q", pattern)
+			}
+		}
+	})
+}
+
+// Matches an SNI by trying all domains in order, exact ones included.
+func linearScan(c *Config, sni string) string {
+	for _, route := range(c.Routes) {
+		for _, domain := range(route.Domains) {
+			if domain.Regexp != nil && domain.MatchString(sni) {
+				return domain.Pattern
+			}
+		}
+	}
+	return "default"
+}
+
+func TestWeightedBackend(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	backend 1.2.3.4:443 {
+		weight 3
+	}
+	backend 1.2.3.5:443
+	backend 1.2.3.6:443 {
+		weight 0
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	route := c.Routes[0]
+	seen := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		backend := route.NextBackend(nil)
+		seen[backend.Address]++
+		backend.Release()
+	}
+	if seen["1.2.3.4:443"] != 300 || seen["1.2.3.5:443"] != 100 || seen["1.2.3.6:443"] != 0 {
+		t.Errorf("Wrong distribution: %v", seen)
+	}
+
+	// Selections are spread, not made in bursts.
+	var order string
+	for i := 0; i < 4; i++ {
+		order += route.NextBackend(nil).Address[6:7]
+	}
+	if strings.Contains(order, "444") {
+		t.Errorf("Selections are not interleaved: %s", order)
+	}
+}
+
+func TestRandomBackend(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	balance random
+	backend 1.2.3.4:443 {
+		weight 3
+	}
+	backend 1.2.3.5:443
+	backend 1.2.3.6:443 {
+		weight 0
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	route := c.Routes[0]
+	if route.Balance != BalanceRandom {
+		t.Fatalf("Wrong balance strategy: got %d, wanted %d", route.Balance, BalanceRandom)
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		backend := route.NextBackend(nil)
+		seen[backend.Address]++
+		backend.Release()
+	}
+	// Roughly three quarters of the connections go to the first backend.
+	if seen["1.2.3.4:443"] < 2700 || seen["1.2.3.4:443"] > 3300 || seen["1.2.3.6:443"] != 0 {
+		t.Errorf("Wrong distribution: %v", seen)
+	}
+
+	route.Backends[0].SetHealthy(false)
+	for i := 0; i < 10; i++ {
+		backend := route.NextBackend(nil)
+		if backend.Address != "1.2.3.5:443" {
+			t.Fatalf("Unhealthy backend selected: %s", backend.Address)
+		}
+		backend.Release()
+	}
+
+	route.Backends[1].SetHealthy(false)
+	if backend := route.NextBackend(nil); backend != nil {
+		t.Errorf("Backend selected while none is healthy: %s", backend.Address)
+	}
+}
+
+// Selects backends from concurrent goroutines, using a given strategy.
+func benchmarkBalance(b *testing.B, balance string) {
+	c, err := parseString("example.net {\n\tbalance " + balance + "\n\tbackend 1.2.3.4:443, 1.2.3.5:443, 1.2.3.6:443\n}\n")
+	if err != nil {
+		b.Fatalf("Unexpected error: %s", err)
+	}
+	route := c.Routes[0]
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			route.NextBackend(nil).Release()
+		}
+	})
+}
+
+func BenchmarkBalanceRoundRobin(b *testing.B) {
+	benchmarkBalance(b, "round-robin")
+}
+
+func BenchmarkBalanceRandom(b *testing.B) {
+	benchmarkBalance(b, "random")
+}
+
+func TestLeastConnBackend(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	balance least-conn
+	backend 1.2.3.4:443, 1.2.3.5:443
+	backend 1.2.3.6:443 {
+		weight 2
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	route := c.Routes[0]
+	if route.Balance != BalanceLeastConn {
+		t.Fatalf("Wrong balance strategy: got %d, wanted %d", route.Balance, BalanceLeastConn)
+	}
+
+	// Long lived connections to the first backend.
+	for i := 0; i < 3; i++ {
+		route.Backends[0].Acquire()
+	}
+
+	// Active connections are balanced relative to the weights.
+	for i := 0; i < 9; i++ {
+		route.NextBackend(nil)
+	}
+	for i, want := range([]int{3, 3, 6}) {
+		if got := route.Backends[i].ActiveConns(); got != want {
+			t.Errorf("Backend #%d: got %d active connections, wanted %d", i, got, want)
+		}
+	}
+}
+
+func TestSourceBackend(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	balance source
+	backend 1.2.3.4:443, 1.2.3.5:443, 1.2.3.6:443
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	route := c.Routes[0]
+	if route.Balance != BalanceSource {
+		t.Fatalf("Wrong balance strategy: got %d, wanted %d", route.Balance, BalanceSource)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		client := net.IPv4(10, 0, 0, byte(i))
+		first := route.NextBackend(client)
+		first.Release()
+		for j := 0; j < 5; j++ {
+			backend := route.NextBackend(client)
+			backend.Release()
+			if backend != first {
+				t.Fatalf("%s: got %s, then %s", client, first.Address, backend.Address)
+			}
+		}
+		seen[first.Address] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Clients are not spread across backends: %v", seen)
+	}
+
+	// Clients are remapped to healthy backends.
+	route.Backends[0].SetHealthy(false)
+	for i := 0; i < 50; i++ {
+		backend := route.NextBackend(net.IPv4(10, 0, 0, byte(i)))
+		backend.Release()
+		if backend == route.Backends[0] {
+			t.Fatalf("Unhealthy backend was selected")
+		}
+	}
+
+	// Round-robin is used when the client is unknown.
+	route.Backends[0].SetHealthy(true)
+	if a, b := route.NextBackend(nil), route.NextBackend(nil); a == b {
+		t.Errorf("Same backend selected twice without a client IP")
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	backend 1.2.3.4:443 {
+		max-conns 1
+	}
+	backend 1.2.3.5:443 {
+		max-conns 2
+		max-conns-queue 1s
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Saturated backends are skipped.
+	route := c.Routes[0]
+	var acquired []*Backend
+	for i := 0; i < 3; i++ {
+		backend := route.AcquireBackend(false, nil, nil)
+		if backend == nil {
+			t.Fatalf("Selection #%d: no backend available", i)
+		}
+		acquired = append(acquired, backend)
+	}
+	if route.Backends[0].ActiveConns() != 1 || route.Backends[1].ActiveConns() != 2 {
+		t.Errorf("Wrong connection distribution: %d/%d",
+			 route.Backends[0].ActiveConns(), route.Backends[1].ActiveConns())
+	}
+	if route.NextBackend(nil) != nil {
+		t.Errorf("A backend was selected while all are saturated")
+	}
+
+	// Queued connections get the first slot freed.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		acquired[0].Release()
+	}()
+	if backend := route.AcquireBackend(false, nil, nil); backend != acquired[0] {
+		t.Errorf("Queued connection did not get the freed slot")
+	}
+
+	// Connections are rejected once the queue time is elapsed.
+	route.Backends[1].MaxConnsQueue = 20 * time.Millisecond
+	if route.AcquireBackend(false, nil, nil) != nil {
+		t.Errorf("A backend was selected while all are saturated")
+	}
+}
+
+// GeoIP database locating 10.0.0.0/8 in France and 192.168.0.0/16 in Germany.
+type fakeGeoIP struct{}
+
+func (fakeGeoIP) Country(ip net.IP) (string, error) {
+	switch {
+	case ip[len(ip)-4] == 10:
+		return "FR", nil
+	case ip[len(ip)-4] == 192:
+		return "DE", nil
+	}
+	return "", nil
+}
+
+func (fakeGeoIP) Close() error { return nil }
+
+// GeoIP database recording whether it was closed.
+type closingGeoIP struct {
+	fakeGeoIP
+	closed bool
+}
+
+func (db *closingGeoIP) Close() error {
+	db.closed = true
+	return nil
+}
+
+func TestCloseGeoIP(t *testing.T) {
+	// The database of an invalid configuration is closed.
+	db := &closingGeoIP{}
+	c := &Config{ GeoIP: db }
+	if err := c.Read(strings.NewReader("example.net {\n\tbackend\n}\n")); err == nil {
+		t.Fatalf("Invalid configuration was accepted")
+	}
+	if !db.closed || c.GeoIP != nil {
+		t.Errorf("GeoIP database of an invalid configuration was not closed")
+	}
+
+	db = &closingGeoIP{}
+	c = &Config{ GeoIP: db }
+	if err := c.Read(strings.NewReader("example.net {\n\tbackend 1.2.3.4:443\n}\n")); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if db.closed {
+		t.Errorf("GeoIP database of a valid configuration was closed")
+	}
+	c.Close()
+	if !db.closed {
+		t.Errorf("GeoIP database was not closed with the configuration")
+	}
+}
+
+func parseSubnets(t *testing.T, subnets ...string) []*net.IPNet {
+	var list []*net.IPNet
+	for _, s := range(subnets) {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, ipnet)
+	}
+	return list
+}
+
+func TestAllowsIP(t *testing.T) {
+	tests := []struct {
+		desc  string
+		allow []string
+		deny  []string
+		ip    string
+		out   bool
+	}{
+		{ "No rules", nil, nil, "10.0.0.1", true },
+		{ "Outside of the rules", []string{ "10.0.0.0/8" }, []string{ "10.1.0.0/16" }, "192.168.0.1", true },
+		{ "Allowed range within a denied one", []string{ "10.1.0.0/16" }, []string{ "10.0.0.0/8" }, "10.1.2.3", true },
+		{ "Denied range within an allowed one", []string{ "10.0.0.0/8" }, []string{ "10.1.0.0/16" }, "10.1.2.3", false },
+		{ "Allowed range within a denied one, outside", []string{ "10.1.0.0/16" }, []string{ "10.0.0.0/8" }, "10.2.0.1", false },
+		{ "Same range both allowed and denied", []string{ "10.0.0.0/8" }, []string{ "10.0.0.0/8" }, "10.0.0.1", false },
+		{ "Same IP both allowed and denied", []string{ "10.0.0.1/32" }, []string{ "10.0.0.1/32" }, "10.0.0.1", false },
+		{ "Allowed IP within a denied range", []string{ "10.0.0.1/32" }, []string{ "10.0.0.0/24" }, "10.0.0.1", true },
+		{ "Denied IP within an allowed range", []string{ "10.0.0.0/24" }, []string{ "10.0.0.1/32" }, "10.0.0.1", false },
+		{ "Allowed range, all others denied", []string{ "10.0.0.0/8" }, []string{ "0.0.0.0/0", "::/0" }, "10.0.0.1", true },
+		{ "Not allowed, all others denied", []string{ "10.0.0.0/8" }, []string{ "0.0.0.0/0", "::/0" }, "192.168.0.1", false },
+		{ "Allowed everything, denied range", []string{ "0.0.0.0/0" }, []string{ "10.0.0.0/8" }, "10.0.0.1", false },
+		{ "IPv6 allowed range within a denied one", []string{ "2001:db8:1::/48" }, []string{ "2001:db8::/32" }, "2001:db8:1::1", true },
+		{ "IPv6 denied range within an allowed one", []string{ "2001:db8::/32" }, []string{ "2001:db8:1::/48" }, "2001:db8:1::1", false },
+		{ "IPv6 same range both allowed and denied", []string{ "2001:db8::/32" }, []string{ "2001:db8::/32" }, "2001:db8::1", false },
+		{ "IPv6 not allowed, all others denied", []string{ "2001:db8::/32" }, []string{ "0.0.0.0/0", "::/0" }, "2001:db9::1", false },
+		{ "IPv4-mapped IPv6 address", []string{ "10.0.0.0/8" }, []string{ "0.0.0.0/0", "::/0" }, "::ffff:10.0.0.1", true },
+		{ "IPv6 address against IPv4 rules", nil, []string{ "10.0.0.0/8", "0.0.0.0/0" }, "2001:db8::1", true },
+		{ "IPv4 address against IPv6 rules", nil, []string{ "2001:db8::/32", "::/0" }, "10.0.0.1", true },
+	}
+
+	for _, test := range(tests) {
+		route := &Route{ Allow: parseSubnets(t, test.allow...), Deny: parseSubnets(t, test.deny...) }
+		if out := route.AllowsIP(net.ParseIP(test.ip)); out != test.out {
+			t.Errorf("%s: got %v, wanted %v", test.desc, out, test.out)
+		}
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	tests := []struct {
+		desc  string
+		route *Route
+		ip    string
+		out   bool
+	}{
+		{
+			"No rules",
+			&Route{},
+			"10.0.0.1",
+			true,
+		},
+		{
+			"Denied subnet",
+			&Route{ Deny: parseSubnets(t, "10.0.0.0/24") },
+			"10.0.0.1",
+			false,
+		},
+		{
+			"Allowed subnet within a denied one",
+			&Route{
+				Deny: parseSubnets(t, "10.0.0.0/8"),
+				Allow: parseSubnets(t, "10.0.0.0/24"),
+			},
+			"10.0.0.1",
+			true,
+		},
+		{
+			"Denied country",
+			&Route{ DenyCountry: []string{"FR"} },
+			"10.0.0.1",
+			false,
+		},
+		{
+			"Other country",
+			&Route{ DenyCountry: []string{"FR"} },
+			"192.168.0.1",
+			true,
+		},
+		{
+			"Allowed country, others being denied",
+			&Route{
+				AllowCountry: []string{"DE"},
+				Deny: parseSubnets(t, "0.0.0.0/0"),
+			},
+			"192.168.0.1",
+			true,
+		},
+		{
+			"Not an allowed country",
+			&Route{
+				AllowCountry: []string{"DE"},
+				Deny: parseSubnets(t, "0.0.0.0/0"),
+			},
+			"10.0.0.1",
+			false,
+		},
+		{
+			"Allowed subnet in a denied country",
+			&Route{
+				DenyCountry: []string{"FR"},
+				Allow: parseSubnets(t, "10.0.0.0/8"),
+				Deny: parseSubnets(t, "0.0.0.0/0"),
+			},
+			"10.0.0.1",
+			true,
+		},
+		{
+			"Denied subnet in an allowed country",
+			&Route{
+				AllowCountry: []string{"FR"},
+				Deny: parseSubnets(t, "10.0.0.0/8", "0.0.0.0/0"),
+			},
+			"10.0.0.1",
+			false,
+		},
+		{
+			"Country both allowed and denied",
+			&Route{
+				AllowCountry: []string{"FR"},
+				DenyCountry: []string{"FR"},
+			},
+			"10.0.0.1",
+			false,
+		},
+	}
+
+	for _, test := range(tests) {
+		if test.route.Allowed(net.ParseIP(test.ip), fakeGeoIP{}) != test.out {
+			t.Errorf(test.desc)
+		}
+	}
+}
+
+func TestACLDecision(t *testing.T) {
+	c, err := parseString(`
+allow.example.net {
+	backend 1.2.3.4:443
+	allow 10.0.0.0/8
+}
+deny.example.net {
+	backend 1.2.3.4:443
+	deny 10.0.0.0/8
+}
+open.example.net {
+	backend 1.2.3.4:443
+}
+both.example.net {
+	backend 1.2.3.4:443
+	allow 10.0.0.0/8
+	deny 0.0.0.0/0
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		desc  string
+		route int
+		ip    string
+		out   string
+	}{
+		{ "Allowed subnet", 0, "10.0.0.1", ACLAllowed },
+		{ "Not in the allow list", 0, "192.168.0.1", ACLDefaultDeny },
+		{ "Not in the allow list (IPv6)", 0, "2001:db8::1", ACLDefaultDeny },
+		{ "Denied subnet", 1, "10.0.0.1", ACLDenied },
+		{ "Not denied", 1, "192.168.0.1", ACLAllowed },
+		{ "No rules", 2, "10.0.0.1", ACLNone },
+		{ "Explicitly denied", 3, "192.168.0.1", ACLDenied },
+	}
+	for _, test := range(tests) {
+		if out := c.Routes[test.route].Check(net.ParseIP(test.ip), nil); out != test.out {
+			t.Errorf("%s: got %q, wanted %q", test.desc, out, test.out)
+		}
+	}
+}
+
+func TestAllowListDefaultDeny(t *testing.T) {
+	c, err := parseString(`
+example.net {
+	backend 1.2.3.4:443
+	allow 10.0.0.0/24, 10.0.0.5, 2001:db8::/64
+	deny 10.0.0.0/28
+}
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	route := c.Routes[0]
+
+	tests := []struct {
+		desc string
+		ip   string
+		out  string
+	}{
+		{ "Allowed host inside a denied range", "10.0.0.5", ACLAllowed },
+		{ "Denied range inside an allowed one", "10.0.0.6", ACLDenied },
+		{ "Allowed range", "10.0.0.100", ACLAllowed },
+		{ "Outside of the allowed ranges", "10.0.1.1", ACLDefaultDeny },
+		{ "Allowed IPv6 range", "2001:db8::1", ACLAllowed },
+		{ "Outside of the allowed IPv6 range", "2001:db8:1::1", ACLDefaultDeny },
+	}
+	for _, test := range(tests) {
+		if out := route.Check(net.ParseIP(test.ip), nil); out != test.out {
+			t.Errorf("%s: got %q, wanted %q", test.desc, out, test.out)
+		}
+	}
+}
+
+func TestJA3Allowed(t *testing.T) {
+	conf := `
+example.net {
+	backend 1.2.3.4:443
+	ja3-deny ADA70206E40642A3E4461F35503241D5
+}
+
+example.org {
+	backend 1.2.3.4:443
+	ja3-allow 40dd2a2184b94cda37a2732aa0fceab0, ada70206e40642a3e4461f35503241d5
+	ja3-deny ada70206e40642a3e4461f35503241d5
+}
+`
+	c, err := parseString(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		desc  string
+		route *Route
+		in    string
+		out   bool
+	}{
+		{
+			"Denied fingerprint",
+			c.Routes[0],
+			"ada70206e40642a3e4461f35503241d5",
+			false,
+		},
+		{
+			"Other fingerprint",
+			c.Routes[0],
+			"40dd2a2184b94cda37a2732aa0fceab0",
+			true,
+		},
+		{
+			"Unknown fingerprint",
+			c.Routes[0],
+			"",
+			true,
+		},
+		{
+			"Allowed fingerprint",
+			c.Routes[1],
+			"40dd2a2184b94cda37a2732aa0fceab0",
+			true,
+		},
+		{
+			"Both allowed and denied",
+			c.Routes[1],
+			"ada70206e40642a3e4461f35503241d5",
+			false,
+		},
+		{
+			"Not allowed",
+			c.Routes[1],
+			"",
+			false,
+		},
+	}
+
+	for _, test := range(tests) {
+		if out := test.route.AllowedJA3(test.in); out != test.out {
+			t.Errorf("%s: got %v, wanted %v", test.desc, out, test.out)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Maximum number of host names kept in the DNS cache of a backend. Backends
+// without a host use the SNI, which can be any host name matching their route.
+const dnsCacheSize = 1024
+
+// Addresses the host names of a backend resolved to, kept until they expire.
+type dnsCache struct {
+	mu      sync.Mutex
+	hosts   map[string]*dnsEntry
+	// Resolves host names, net.DefaultResolver.LookupIPAddr if nil.
+	resolve func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Addresses of a host name, protected by the lock of the cache.
+type dnsEntry struct {
+	ips       []net.IP
+	expires   time.Time
+	// Error of the last resolution, if it failed.
+	err       error
+	// Closed once the resolution in progress, if any, is done.
+	resolving chan struct{}
+	// Index of the address tried first on the next dial, when using
+	// round-robin.
+	next      int
+}
+
+// Resolves a backend host name, at most once every ttl. Stale addresses are
+// kept when the resolution fails, and used until the next attempt. Host names
+// are resolved without holding the lock, concurrent lookups of the same one
+// waiting for a single resolution.
+func (c *dnsCache) lookup(host string, ttl, timeout time.Duration) ([]net.IP, error) {
+	c.mu.Lock()
+	e := c.entry(host)
+	if time.Now().Before(e.expires) {
+		defer c.mu.Unlock()
+		return e.ips, nil
+	}
+
+	if done := e.resolving; done != nil {
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if len(e.ips) == 0 {
+			return nil, e.err
+		}
+		return e.ips, nil
+	}
+
+	done := make(chan struct{})
+	e.resolving = done
+	resolve := c.resolve
+	c.mu.Unlock()
+
+	if resolve == nil {
+		resolve = net.DefaultResolver.LookupIPAddr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	addrs, err := resolve(ctx, host)
+	cancel()
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("Could not resolve %s (no address)", host)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.resolving = nil
+	close(done)
+
+	e.err = err
+	if err != nil {
+		if len(e.ips) > 0 {
+			e.expires = time.Now().Add(ttl)
+			return e.ips, nil
+		}
+		return nil, err
+	}
+
+	e.ips = make([]net.IP, len(addrs))
+	for i, addr := range(addrs) {
+		e.ips[i] = addr.IP
+	}
+	e.expires = time.Now().Add(ttl)
+	return e.ips, nil
+}
+
+// Returns the entry of a host name, adding it if needed. Expired entries are
+// evicted when the cache is full, or any other one not being resolved if none
+// expired. Must be called with the lock held.
+func (c *dnsCache) entry(host string) *dnsEntry {
+	if e := c.hosts[host]; e != nil {
+		return e
+	}
+	if c.hosts == nil {
+		c.hosts = make(map[string]*dnsEntry)
+	}
+
+	if len(c.hosts) >= dnsCacheSize {
+		now := time.Now()
+		for h, e := range(c.hosts) {
+			if e.resolving == nil && !now.Before(e.expires) {
+				delete(c.hosts, h)
+			}
+		}
+		for h, e := range(c.hosts) {
+			if len(c.hosts) < dnsCacheSize {
+				break
+			}
+			if e.resolving == nil {
+				delete(c.hosts, h)
+			}
+		}
+	}
+
+	e := &dnsEntry{}
+	c.hosts[host] = e
+	return e
+}
+
+// Returns the index of the first address of a host name to try, rotating on
+// each call.
+func (c *dnsCache) rotate(host string, n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(host)
+	first := e.next % n
+	e.next = first + 1
+	return first
+}
+
+// Returns the addresses to dial in turn to reach a backend at address (see
+// DialAddress). Host names are resolved using the backend's DNS cache when
+// DNSTTL is set, otherwise address is returned as is and resolved when dialing.
+// If the resolution fails without any stale addresses to fall back on, address
+// is returned as is as well.
+func (b *Backend) ResolveAddress(network, address string) []string {
+	if b.DNSTTL == 0 || network == "unix" {
+		return []string{ address }
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return []string{ address }
+	}
+
+	ips, err := b.dns.lookup(host, b.DNSTTL, b.DialTimeout)
+	if err != nil || len(ips) == 0 {
+		return []string{ address }
+	}
+
+	first := 0
+	if b.DNSRoundRobin {
+		first = b.dns.rotate(host, len(ips))
+	}
+	addrs := make([]string, len(ips))
+	for i := range(ips) {
+		addrs[i] = net.JoinHostPort(ips[(first + i) % len(ips)].String(), port)
+	}
+	return addrs
+}
+
+// Connects to a backend at address (see DialAddress) using dialer, through its
+// SOCKS5 proxy if any, or trying its resolved addresses in turn within the
+// dialer timeout.
+func (b *Backend) DialWith(dialer *net.Dialer, network, address string) (net.Conn, error) {
+	if len(b.SOCKS5) > 0 {
+		return b.dialSOCKS5(dialer, network, address)
+	}
+
+	addrs := b.ResolveAddress(network, address)
+	if len(addrs) == 1 {
+		return dialer.Dial(network, addrs[0])
+	}
+
+	d := *dialer
+	if d.Timeout > 0 {
+		d.Deadline = time.Now().Add(d.Timeout)
+	}
+	var err error
+	for _, addr := range(addrs) {
+		var c net.Conn
+		if c, err = d.Dial(network, addr); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// Connects to a backend at address (see DialAddress), using its own dialer.
+func (b *Backend) Dial(network, address string) (net.Conn, error) {
+	return b.DialWith(b.Dialer(network), network, address)
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP looks up the country of IP addresses.
+type GeoIP interface {
+	// Returns the ISO 3166-1 code of the country an IP is located in, or
+	// an empty string if unknown.
+	Country(ip net.IP) (string, error)
+	// Closes the database. Lookups fail afterwards.
+	Close() error
+}
+
+// GeoIP implementation using a MaxMind database (GeoLite2 or GeoIP2, Country
+// or City).
+type maxMindDB struct {
+	// Protects reader, nil once closed.
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+}
+
+// Opens a MaxMind database.
+func OpenGeoIP(path string) (GeoIP, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &maxMindDB{ reader: reader }, nil
+}
+
+func (db *maxMindDB) Country(ip net.IP) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.reader == nil {
+		return "", errors.New("GeoIP database is closed")
+	}
+
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := db.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+func (db *maxMindDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.reader == nil {
+		return nil
+	}
+	err := db.reader.Close()
+	db.reader = nil
+	return err
+}
@@ -18,21 +18,26 @@ package config
 import (
 	"bufio"
 	"io"
+	"strings"
 	"unicode"
 )
 
 // Lexer gets values, token by token, from an io.Reader.
 type Lexer struct {
-	reader *bufio.Reader
-	tokens []*Token
-	cursor int
-	line   uint
+	reader      *bufio.Reader
+	tokens      []*Token
+	cursor      int
+	line        uint
+	// Annotations read since the last token, for the next one.
+	annotations map[string]string
 }
 
 // Token stores a value, and metadata associated to it.
 type Token struct {
-	Val  string
-	Line uint
+	Val         string
+	Line        uint
+	// Annotations ("# @key value" comment lines) preceding the token.
+	Annotations map[string]string
 }
 
 // Loads an io.Reader and wraps it into a bufio.Reader to prepare the Lexer for
@@ -56,14 +61,18 @@ func newLexer(input io.Reader) Lexer {
 // (#) is read. Values separated by a comma (,) are considered being members of
 // a list and will end up in the same uniq token; it's up to the upper layer to
 // split them. Commas (,) can be followed by spaces or new lines.
+// A backslash (\) makes the following rune literal. Escaped commas and
+// backslashes are kept escaped so the upper layer doesn't split lists on them
+// (see splitList).
 func (l *Lexer) parseNext() bool {
-	var comment, quote, list bool
+	var quote, list, escape bool
 	var val []rune
 
 	token := &Token{}
 
 	finalize := func() bool {
 		token.Val = string(val)
+		token.Annotations, l.annotations = l.annotations, nil
 		l.tokens = append(l.tokens, token)
 		return true
 	}
@@ -80,6 +89,21 @@ func (l *Lexer) parseNext() bool {
 			return false
 		}
 
+		// Escaped rune.
+		if escape && ch != '\n' {
+			escape = false
+			list = false
+			if len(val) == 0 {
+				token.Line = l.line
+			}
+			if ch == ',' || ch == '\\' {
+				val = append(val, '\\')
+			}
+			val = append(val, ch)
+			continue
+		}
+		escape = false
+
 		// End of quoted values.
 		if quote && ch == '"' {
 			return finalize()
@@ -98,22 +122,47 @@ func (l *Lexer) parseNext() bool {
 					return false
 				}
 				l.line++
-				comment = false
 			}
-			if !quote && !list && len(val) > 0 {
+			// Spaces are part of quoted values.
+			if quote {
+				val = append(val, ch)
+				continue
+			}
+			if !list && len(val) > 0 {
 				list = false
 				return finalize()
 			}
 			continue
 		}
 
-		// Detect the start of a comment.
-		if ch == '#' {
-			comment = true
+		// Comments: drop the rest of the line, which ends the current
+		// value unless in a list. Comment lines starting with "@" are
+		// annotations of the next token.
+		if ch == '#' && !quote {
+			var comment []rune
+			for ch != '\n' {
+				if ch, _, err = l.reader.ReadRune(); err != nil {
+					if len(val) > 0 {
+						return finalize()
+					}
+					return false
+				}
+				comment = append(comment, ch)
+			}
+			if len(val) == 0 && !list &&
+			   (len(l.tokens) == 0 || l.tokens[len(l.tokens) - 1].Line != l.line) {
+				l.annotate(string(comment))
+			}
+			l.line++
+			if !list && len(val) > 0 {
+				return finalize()
+			}
+			continue
 		}
 
-		// Discard commented runes.
-		if comment {
+		// Start of an escaped rune.
+		if ch == '\\' {
+			escape = true
 			continue
 		}
 
@@ -137,6 +186,23 @@ func (l *Lexer) parseNext() bool {
 	}
 }
 
+// Records an annotation from a comment line, if it is one: "@key value".
+func (l *Lexer) annotate(comment string) {
+	comment = strings.TrimSpace(comment)
+	if !strings.HasPrefix(comment, "@") {
+		return
+	}
+
+	key, value, _ := strings.Cut(comment[1:], " ")
+	if len(key) == 0 {
+		return
+	}
+	if l.annotations == nil {
+		l.annotations = make(map[string]string)
+	}
+	l.annotations[key] = strings.TrimSpace(value)
+}
+
 // Loads a token only if on the same line. Returns true if a token is found,
 // false otherwise.
 func (l *Lexer) Next() bool {
@@ -177,7 +243,7 @@ func (l *Lexer) NextLine() bool {
 
 // Returns the current token value.
 func (l *Lexer) Val() string {
-	if l.cursor == -1 || l.cursor + 1 == len(l.tokens) {
+	if l.cursor == -1 || l.cursor >= len(l.tokens) {
 		return ""
 	}
 
@@ -186,9 +252,63 @@ func (l *Lexer) Val() string {
 
 // Returns the next token value.
 func (l *Lexer) NextVal() string {
-	if l.cursor + 2 >= len(l.tokens) {
+	if l.cursor + 1 >= len(l.tokens) {
 		return ""
 	}
 
 	return l.tokens[l.cursor + 1].Val
 }
+
+// Returns the annotations of the current token, nil if none.
+func (l *Lexer) Annotations() map[string]string {
+	if l.cursor == -1 || l.cursor >= len(l.tokens) {
+		return nil
+	}
+
+	return l.tokens[l.cursor].Annotations
+}
+
+// Returns the line of the current token.
+func (l *Lexer) Line() uint {
+	if l.cursor == -1 || l.cursor >= len(l.tokens) {
+		return 0
+	}
+
+	return l.tokens[l.cursor].Line
+}
+
+// Splits a list value on commas, escaped commas and backslashes being part of
+// the values.
+func splitList(s string) []string {
+	var list []string
+	var val []rune
+
+	escape := false
+	for _, ch := range(s) {
+		if escape {
+			escape = false
+			if ch != ',' && ch != '\\' {
+				val = append(val, '\\')
+			}
+			val = append(val, ch)
+			continue
+		}
+
+		switch (ch) {
+		case '\\':
+			escape = true
+			break
+		case ',':
+			list = append(list, string(val))
+			val = nil
+			break
+		default:
+			val = append(val, ch)
+		}
+	}
+	if escape {
+		val = append(val, '\\')
+	}
+
+	return append(list, string(val))
+}
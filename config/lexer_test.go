@@ -0,0 +1,144 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns the values of the tokens read from a string.
+func lex(in string) []string {
+	l := newLexer(strings.NewReader(in))
+
+	var vals []string
+	for _, token := range(l.tokens) {
+		vals = append(vals, token.Val)
+	}
+	return vals
+}
+
+func TestLexer(t *testing.T) {
+	tests := []struct {
+		desc string
+		in   string
+		out  []string
+	}{
+		{
+			"Comment line",
+			"# comment\nbackend 1.2.3.4:443\n",
+			[]string{"backend", "1.2.3.4:443"},
+		},
+		{
+			"Comment after a value",
+			"backend 1.2.3.4:443 # comment { }\n",
+			[]string{"backend", "1.2.3.4:443"},
+		},
+		{
+			"Comment right after a value",
+			"backend 1.2.3.4:443# comment\n",
+			[]string{"backend", "1.2.3.4:443"},
+		},
+		{
+			"Comment in a list",
+			"deny 10.0.0.1, # comment\n\t10.0.0.2\n",
+			[]string{"deny", "10.0.0.1,10.0.0.2"},
+		},
+		{
+			"Escaped hash",
+			`example\#1.net {`,
+			[]string{"example#1.net", "{"},
+		},
+		{
+			"Escaped comma",
+			`a\,b, c`,
+			[]string{`a\,b,c`},
+		},
+		{
+			"Escaped space and backslash",
+			`a\ b\\c`,
+			[]string{`a b\\c`},
+		},
+		{
+			"Quoted value",
+			`"a # b, c" d`,
+			[]string{"a # b, c", "d"},
+		},
+	}
+
+	for _, test := range(tests) {
+		if got := lex(test.in); strings.Join(got, "|") != strings.Join(test.out, "|") {
+			t.Errorf("%s: got %q, wanted %q", test.desc, got, test.out)
+		}
+	}
+}
+
+func TestLexerAnnotations(t *testing.T) {
+	tests := []struct {
+		desc string
+		in   string
+		out  map[string]string
+	}{
+		{
+			"Annotations",
+			"# @owner team-x\n#@ticket  OPS-42 \nexample.net {\n",
+			map[string]string{ "owner": "team-x", "ticket": "OPS-42" },
+		},
+		{
+			"Annotation without a value",
+			"# @critical\nexample.net {\n",
+			map[string]string{ "critical": "" },
+		},
+		{
+			"Regular comment",
+			"# owner team-x\nexample.net {\n",
+			nil,
+		},
+		{
+			"Annotation after a value",
+			"backend 1.2.3.4:443 # @owner team-x\nexample.net {\n",
+			nil,
+		},
+	}
+
+	for _, test := range(tests) {
+		l := newLexer(strings.NewReader(test.in))
+		token := l.tokens[len(l.tokens) - 2]
+		if token.Val != "example.net" || !reflect.DeepEqual(token.Annotations, test.out) {
+			t.Errorf("%s: got %q %v, wanted %v", test.desc, token.Val, token.Annotations, test.out)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []string
+	}{
+		{ "a", []string{"a"} },
+		{ "a,b", []string{"a", "b"} },
+		{ `a\,b,c`, []string{"a,b", "c"} },
+		{ `a\\,b`, []string{`a\`, "b"} },
+		{ `a\b`, []string{`a\b`} },
+	}
+
+	for _, test := range(tests) {
+		if got := splitList(test.in); strings.Join(got, "|") != strings.Join(test.out, "|") {
+			t.Errorf("%q: got %q, wanted %q", test.in, got, test.out)
+		}
+	}
+}
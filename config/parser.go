@@ -15,14 +15,23 @@
 
 package config
 
+import (
+	"os"
+)
+
 type Directive struct {
-	Name       string
-	Args       []string
-	Directives []*Directive
+	Name        string
+	Args        []string
+	Directives  []*Directive
+	// File and line the directive was read from, for error reporting.
+	File        string
+	Line        uint
+	// Annotations ("# @key value" comment lines) preceding the directive.
+	Annotations map[string]string
 }
 
 func parseDirective(l *Lexer) *Directive {
-	d := &Directive{ Name: l.Val() }
+	d := &Directive{ Name: l.Val(), Line: l.Line(), Annotations: l.Annotations() }
 
 	// Quick hack, special case the first block.
 	// Real default: false
@@ -53,3 +62,36 @@ func parseDirective(l *Lexer) *Directive {
 
 	return d
 }
+
+// Expands environment variables (${VAR} or $VAR) in the arguments of a
+// directive and of its sub-directives. Unset variables are reported as errors.
+func (d *Directive) expand() error {
+	for i, arg := range(d.Args) {
+		var missing string
+		d.Args[i] = os.Expand(arg, func(name string) string {
+			val, ok := os.LookupEnv(name)
+			if !ok && missing == "" {
+				missing = name
+			}
+			return val
+		})
+		if missing != "" {
+			return parseError(d, "Environment variable %q is not set", missing)
+		}
+	}
+
+	for _, dir := range(d.Directives) {
+		if err := dir.expand(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets the file a directive and its sub-directives were read from.
+func (d *Directive) setFile(file string) {
+	d.File = file
+	for _, dir := range(d.Directives) {
+		dir.setFile(file)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Parses the directives read from r, without resolving includes nor expanding
+// environment variables. The returned root directive has no name and holds
+// the top-level directives.
+func ParseDirectives(r io.Reader) *Directive {
+	l := newLexer(r)
+	return parseDirective(&l)
+}
+
+// Writes a directive tree back as configuration text, one directive per line
+// with its block indented. When given a root directive (without a name) only
+// its sub-directives are written. Parsing the output gives back the same tree.
+func Print(w io.Writer, d *Directive) error {
+	bw := bufio.NewWriter(w)
+	if d.Name == "" {
+		for _, dir := range(d.Directives) {
+			printDirective(bw, dir, 0)
+		}
+	} else {
+		printDirective(bw, d, 0)
+	}
+	return bw.Flush()
+}
+
+func printDirective(w *bufio.Writer, d *Directive, depth int) {
+	keys := make([]string, 0, len(d.Annotations))
+	for key := range(d.Annotations) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range(keys) {
+		w.WriteString(strings.Repeat("\t", depth))
+		w.WriteString(strings.TrimSpace("# @" + key + " " + d.Annotations[key]) + "\n")
+	}
+
+	w.WriteString(strings.Repeat("\t", depth))
+	w.WriteString(quoteValue(d.Name))
+	for _, arg := range(d.Args) {
+		w.WriteByte(' ')
+		w.WriteString(quoteValue(arg))
+	}
+
+	if len(d.Directives) > 0 {
+		w.WriteString(" {\n")
+		for _, dir := range(d.Directives) {
+			printDirective(w, dir, depth + 1)
+		}
+		w.WriteString(strings.Repeat("\t", depth))
+		w.WriteByte('}')
+	}
+	w.WriteByte('\n')
+}
+
+// Escapes a value so the lexer reads it back as a single, identical token.
+// Escaped commas and backslashes are already kept escaped by the lexer and are
+// written as is.
+func quoteValue(val string) string {
+	if val == "" {
+		return `""`
+	}
+
+	var b strings.Builder
+	runes := []rune(val)
+	for i := 0; i < len(runes); i++ {
+		ch := runes[i]
+		switch {
+		case ch == '\\' && i + 1 < len(runes):
+			b.WriteRune(ch)
+			i++
+			ch = runes[i]
+			break
+		case unicode.IsSpace(ch), ch == '#', ch == '"' && i == 0:
+			b.WriteByte('\\')
+			break
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
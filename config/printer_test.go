@@ -0,0 +1,143 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/atenart/sniproxy/ratelimit"
+)
+
+const sampleConfig = `# Sample configuration.
+rate-limit 10 20
+keepalive 30s
+
+# @owner team-x
+# @ticket OPS-42
+example.net, *.example.net {
+	backend 1.2.3.4:443, 1.2.3.5:443 {
+		send-proxy-v2
+		send-proxy-v2-tag 0xe0 "tier 1"
+	}
+	acme 1.2.3.6:443	# ACME backend
+	allow 10.0.0.0/8, acme
+	deny "0.0.0.0/0"
+	alpn h2, http/1.1
+	balance least-conn
+}
+
+~[a-z]+[.]example[.]org {
+	backend [::1]:8443
+	retries 2
+}
+
+default {
+	backend 1.2.3.4:443
+	log off
+}
+`
+
+// Drops the line numbers of a directive tree, which aren't kept by Print.
+func clearLines(d *Directive) {
+	d.Line = 0
+	for _, dir := range(d.Directives) {
+		clearLines(dir)
+	}
+}
+
+// Drops the parts of a configuration which can't be compared: line numbers,
+// and the state of rate limiters as they hold their creation time.
+func normalize(c *Config) {
+	c.RateLimit = limiterSettings(c.RateLimit)
+	for _, route := range(c.Routes) {
+		route.RateLimit = limiterSettings(route.RateLimit)
+		for _, domain := range(route.Domains) {
+			domain.Line = 0
+		}
+	}
+}
+
+func limiterSettings(l *ratelimit.Limiter) *ratelimit.Limiter {
+	if l == nil {
+		return nil
+	}
+	return &ratelimit.Limiter{ Rate: l.Rate, Burst: l.Burst }
+}
+
+func TestPrintRoundTrip(t *testing.T) {
+	root := ParseDirectives(strings.NewReader(sampleConfig))
+
+	var out bytes.Buffer
+	if err := Print(&out, root); err != nil {
+		t.Fatalf("Could not print the configuration (%s)", err)
+	}
+
+	reread := ParseDirectives(bytes.NewReader(out.Bytes()))
+	clearLines(root)
+	clearLines(reread)
+	if !reflect.DeepEqual(root, reread) {
+		t.Errorf("Directives differ after round-trip:\n%s", out.String())
+	}
+
+	c1, err := parseString(sampleConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c2, err := parseString(out.String())
+	if err != nil {
+		t.Fatalf("Could not parse the printed configuration (%s):\n%s", err, out.String())
+	}
+	normalize(c1)
+	normalize(c2)
+	if !reflect.DeepEqual(c1, c2) {
+		t.Errorf("Configurations differ after round-trip:\n%s", out.String())
+	}
+}
+
+func TestQuoteValue(t *testing.T) {
+	tests := []struct {
+		desc string
+		in   string
+	}{
+		{ "Plain value", "1.2.3.4:443" },
+		{ "List", "example.net,*.example.net" },
+		{ "Empty value", "" },
+		{ "Spaces", "tier 1" },
+		{ "Comment", "a#b" },
+		{ "Leading quote", `"quoted` },
+		{ "Inner quote", `a"b` },
+		{ "Escaped comma", `a\,b` },
+		{ "Escaped backslash", `a\\b` },
+		{ "Braces", "{a}" },
+	}
+
+	for _, tt := range(tests) {
+		root := &Directive{ Directives: []*Directive{ { Name: "test", Args: []string{ tt.in, "next" } } } }
+
+		var out bytes.Buffer
+		if err := Print(&out, root); err != nil {
+			t.Fatalf("%s: could not print (%s)", tt.desc, err)
+		}
+
+		reread := ParseDirectives(bytes.NewReader(out.Bytes()))
+		if len(reread.Directives) != 1 || !reflect.DeepEqual(reread.Directives[0].Args, []string{ tt.in, "next" }) {
+			t.Errorf("%s: could not read back %q", tt.desc, out.String())
+		}
+	}
+}
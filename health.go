@@ -0,0 +1,107 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Starts the health checks of the current configuration. They are restarted
+// each time the configuration is replaced.
+func (p *Proxy) startHealthChecks() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.checking {
+		return
+	}
+	p.checking = true
+	p.restartHealthChecks()
+}
+
+// Stops the running health checks, if any, and starts the ones of the current
+// configuration. Must be called with p.mu held.
+func (p *Proxy) restartHealthChecks() {
+	if p.stopChecks != nil {
+		close(p.stopChecks)
+		p.stopChecks = nil
+	}
+	if p.Config == nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	for _, route := range(p.Config.Routes) {
+		if route.HealthCheck == 0 {
+			continue
+		}
+		for _, backend := range(route.Backends) {
+			go checkBackend(backend, route.HealthCheck, p.Dialer, stop)
+		}
+	}
+	p.stopChecks = stop
+}
+
+// Periodically checks a backend accepts connections, and updates its
+// health state accordingly. Connections are made using custom if set.
+func checkBackend(backend *config.Backend, interval time.Duration,
+		  custom func(string, string) (net.Conn, error), stop <-chan struct{}) {
+	// Backends using the SNI as their host can't be checked.
+	if backend.UsesSNI() {
+		return
+	}
+	network, address := backend.DialAddress("")
+
+	dialer := backend.Dialer(network)
+	dialer.Timeout = 3 * time.Second
+	if interval < dialer.Timeout {
+		dialer.Timeout = interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		var c net.Conn
+		var err error
+		if custom != nil {
+			c, err = custom(network, address)
+		} else {
+			c, err = backend.DialWith(dialer, network, address)
+		}
+		if err != nil {
+			if backend.SetHealthy(false) {
+				log.Printf("Backend %s is unhealthy (%s)", backend.Address, err)
+			}
+			continue
+		}
+		c.Close()
+
+		if backend.SetHealthy(true) {
+			log.Printf("Backend %s is healthy again", backend.Address)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Prefix of bind addresses referring to listeners passed by systemd (socket
+// activation), followed by their index.
+const fdPrefix = "fd://"
+
+// First file descriptor passed by systemd.
+var firstListenFD = 3
+
+// Checks a bind address can be used with an IP family (tcp, tcp4 or tcp6): its
+// IP, if explicit, must belong to the family.
+func checkBind(bind, family string) error {
+	switch (family) {
+	case "tcp", "tcp4", "tcp6":
+		break
+	default:
+		return fmt.Errorf("Invalid bind family %q (tcp, tcp4 or tcp6)", family)
+	}
+	if strings.HasPrefix(bind, fdPrefix) {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		return fmt.Errorf("Invalid bind address %q (%s)", bind, err)
+	}
+	return checkFamily(bind, net.ParseIP(host), family)
+}
+
+// Checks an IP belongs to a family, nil IPs (any address) belonging to all.
+func checkFamily(bind string, ip net.IP, family string) error {
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	if (family == "tcp4" && ip.To4() == nil) || (family == "tcp6" && ip.To4() != nil) {
+		return fmt.Errorf("Bind address %q is not a %s one", bind, family)
+	}
+	return nil
+}
+
+// Returns a TCP listener bound to an address for an IP family (see checkBind),
+// or one passed by systemd if the address is of the form fd://N. TCP Fast Open
+// can be enabled, and the options of lc (e.g. socket buffer sizes) applied, on
+// listeners bound by us; systemd has its own options for the others.
+func listen(bind, family string, tfo bool, lc net.ListenConfig) (net.Listener, error) {
+	if err := checkBind(bind, family); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(bind, fdPrefix) {
+		if control := lc.Control; tfo {
+			lc.Control = func(network, address string, c syscall.RawConn) error {
+				if err := setTFO(c); err != nil {
+					return fmt.Errorf("Could not enable TCP Fast Open on %s (%s)", address, err)
+				}
+				if control != nil {
+					return control(network, address, c)
+				}
+				return nil
+			}
+		}
+		return lc.Listen(context.Background(), family, bind)
+	}
+
+	index, err := strconv.Atoi(strings.TrimPrefix(bind, fdPrefix))
+	if err != nil || index < 0 {
+		return nil, fmt.Errorf("Invalid listener %q", bind)
+	}
+
+	// Listeners are only meant for us if LISTEN_PID is our PID.
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("No listener passed by systemd (%s)", bind)
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || index >= n {
+		return nil, fmt.Errorf("Listener %q was not passed by systemd", bind)
+	}
+
+	f := os.NewFile(uintptr(firstListenFD + index), bind)
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not use listener %q (%s)", bind, err)
+	}
+	if _, ok := l.(*net.TCPListener); !ok {
+		l.Close()
+		return nil, fmt.Errorf("Listener %q is not a TCP one", bind)
+	}
+	if err := checkFamily(bind, l.Addr().(*net.TCPAddr).IP, family); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestListenFD(t *testing.T) {
+	orig, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orig.Close()
+
+	// Pretend the listener was passed by systemd as the second one.
+	f, err := orig.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer func(fd int) { firstListenFD = fd }(firstListenFD)
+	firstListenFD = int(f.Fd()) - 1
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+
+	l, err := listen("fd://1", "tcp", false, net.ListenConfig{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	if l.Addr().String() != orig.Addr().String() {
+		t.Errorf("Wrong listener: got %s, wanted %s", l.Addr(), orig.Addr())
+	}
+
+	for _, bind := range([]string{ "fd://2", "fd://-1", "fd://foo" }) {
+		if _, err := listen(bind, "tcp", false, net.ListenConfig{}); err == nil {
+			t.Errorf("%s: invalid listener was accepted", bind)
+		}
+	}
+
+	t.Setenv("LISTEN_PID", "1")
+	if _, err := listen("fd://1", "tcp", false, net.ListenConfig{}); err == nil {
+		t.Errorf("Listener meant for another process was accepted")
+	}
+}
+
+func TestCheckBind(t *testing.T) {
+	tests := []struct {
+		desc    string
+		bind    string
+		family  string
+		success bool
+	}{
+		{ "Any address", ":443", "tcp", true },
+		{ "Any address, IPv4 only", ":443", "tcp4", true },
+		{ "Any address, IPv6 only", ":443", "tcp6", true },
+		{ "IPv4 address", "192.0.2.1:443", "tcp4", true },
+		{ "IPv6 address", "[2001:db8::1]:443", "tcp6", true },
+		{ "IPv4 address, IPv6 only", "192.0.2.1:443", "tcp6", false },
+		{ "IPv6 address, IPv4 only", "[2001:db8::1]:443", "tcp4", false },
+		{ "Unspecified IPv6 address, IPv4 only", "[::]:443", "tcp4", true },
+		{ "Host name", "localhost:443", "tcp6", true },
+		{ "Invalid family", ":443", "udp", false },
+		{ "Invalid address", "443", "tcp", false },
+		{ "systemd listener", "fd://0", "tcp4", true },
+	}
+
+	for _, test := range(tests) {
+		err := checkBind(test.bind, test.family)
+		if test.success && err != nil {
+			t.Errorf("%s: unexpected error (%s)", test.desc, err)
+		}
+		if !test.success && err == nil {
+			t.Errorf("%s: expected an error", test.desc)
+		}
+	}
+
+	// The family is passed to the listener.
+	l, err := listen("127.0.0.1:0", "tcp6", false, net.ListenConfig{})
+	if err == nil {
+		l.Close()
+		t.Errorf("IPv4 address was bound using tcp6")
+	}
+	l, err = listen("127.0.0.1:0", "tcp4", false, net.ListenConfig{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	l.Close()
+}
@@ -16,8 +16,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/atenart/sniproxy/clienthello"
 )
 
 func (conn *Conn) logf(format string, v ...interface{}) {
@@ -27,3 +37,221 @@ func (conn *Conn) logf(format string, v ...interface{}) {
 func (conn *Conn) log(v ...interface{}) {
 	log.Printf("%s %s", conn.RemoteAddr(), fmt.Sprint(v...))
 }
+
+// AccessEntry describes a connection, for access logging. Byte counts are from
+// the client's point of view.
+type AccessEntry struct {
+	Client              string
+	SNI                 string
+	// Highest TLS version offered by the client, eg. "TLS 1.3".
+	TLSVersion          string
+	// JA3 fingerprint of the ClientHello, identifying the client software.
+	Fingerprint         string
+	// Signature algorithms and key share groups offered by the client.
+	SignatureAlgorithms []uint16
+	KeyShares           []uint16
+	// Domain pattern of the matched route.
+	Route               string
+	Backend             string
+	BytesSent           int64
+	BytesReceived       int64
+	Start               time.Time
+	Duration            time.Duration
+	// Why the connection was closed.
+	Reason              string
+}
+
+// AccessLogger writes a record for each connection, once closed.
+type AccessLogger interface {
+	LogAccess(e *AccessEntry)
+}
+
+var defaultAccessLogger AccessLogger = NewJSONLogger(os.Stderr)
+
+// Returns an access logger for a given format (text, json or clf).
+func newAccessLogger(format string, w io.Writer) (AccessLogger, error) {
+	switch format {
+	case "text":
+		return NewTextLogger(w), nil
+	case "json":
+		return NewJSONLogger(w), nil
+	case "clf":
+		return NewCLFLogger(w), nil
+	}
+	return nil, fmt.Errorf("Unknown log format %q", format)
+}
+
+// Writes access logs as a line of key=value pairs.
+type textLogger struct {
+	logger *log.Logger
+}
+
+// Returns an access logger writing text lines to w.
+func NewTextLogger(w io.Writer) AccessLogger {
+	return &textLogger{
+		logger: log.New(w, "", log.LstdFlags),
+	}
+}
+
+func (l *textLogger) LogAccess(e *AccessEntry) {
+	l.logger.Printf("%s sni=%q tls=%q ja3=%q sigalgs=%q key_shares=%q route=%q backend=%q sent=%d received=%d duration=%s reason=%q",
+			e.Client, e.SNI, e.TLSVersion, e.Fingerprint, joinValues(e.SignatureAlgorithms),
+			joinValues(e.KeyShares), e.Route, e.Backend, e.BytesSent, e.BytesReceived,
+			e.Duration, e.Reason)
+}
+
+// Writes access logs as JSON objects, one per line.
+type jsonLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// Returns an access logger writing JSON objects to w.
+func NewJSONLogger(w io.Writer) AccessLogger {
+	return &jsonLogger{
+		enc: json.NewEncoder(w),
+	}
+}
+
+func (l *jsonLogger) LogAccess(e *AccessEntry) {
+	record := struct {
+		Time                string   `json:"time"`
+		Client              string   `json:"client"`
+		SNI                 string   `json:"sni"`
+		TLSVersion          string   `json:"tls_version,omitempty"`
+		Fingerprint         string   `json:"ja3,omitempty"`
+		SignatureAlgorithms []uint16 `json:"signature_algorithms,omitempty"`
+		KeyShares           []uint16 `json:"key_shares,omitempty"`
+		Route               string   `json:"route"`
+		Backend             string   `json:"backend"`
+		BytesSent           int64    `json:"bytes_sent"`
+		BytesReceived       int64    `json:"bytes_received"`
+		Duration            float64  `json:"duration"`
+		Reason              string   `json:"reason"`
+	}{
+		Time: e.Start.Format(time.RFC3339),
+		Client: e.Client,
+		SNI: e.SNI,
+		TLSVersion: e.TLSVersion,
+		Fingerprint: e.Fingerprint,
+		SignatureAlgorithms: e.SignatureAlgorithms,
+		KeyShares: e.KeyShares,
+		Route: e.Route,
+		Backend: e.Backend,
+		BytesSent: e.BytesSent,
+		BytesReceived: e.BytesReceived,
+		Duration: e.Duration.Seconds(),
+		Reason: e.Reason,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(&record); err != nil {
+		log.Printf("Could not write access log (%s)", err)
+	}
+}
+
+// Writes access logs in a format close to the Common Log Format, so they can be
+// processed by existing tools. As connections aren't HTTP requests, fields are
+// mapped as follows:
+//
+//	client - - [start] "sni backend" bytes-out bytes-in "reason" duration
+//
+// where bytes-out is the number of bytes sent to the client (the CLF size
+// field), bytes-in the number of bytes received from it and duration is in
+// seconds. Unknown values are written as "-".
+type clfLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Returns an access logger writing CLF-like lines to w.
+func NewCLFLogger(w io.Writer) AccessLogger {
+	return &clfLogger{
+		w: w,
+	}
+}
+
+func (l *clfLogger) LogAccess(e *AccessEntry) {
+	line := fmt.Sprintf("%s - - [%s] \"%s %s\" %d %d \"%s\" %.3f\n",
+			    clfField(e.Client), e.Start.Format("02/Jan/2006:15:04:05 -0700"),
+			    clfField(e.SNI), clfField(e.Backend), e.BytesReceived,
+			    e.BytesSent, clfField(e.Reason), e.Duration.Seconds())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.w, line); err != nil {
+		log.Printf("Could not write access log (%s)", err)
+	}
+}
+
+// Access log file, appended to. It can be reopened once rotated.
+type logFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// Opens a file to append access logs to, creating it if needed.
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{ path: path }
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(b)
+}
+
+// Opens the file again, in case it was moved away. On error the current file
+// keeps being used.
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not open access log %q (%s)", l.path, err)
+	}
+
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Joins values with dashes, as done in JA3 strings.
+func joinValues(values []uint16) string {
+	s := make([]string, len(values))
+	for i, v := range(values) {
+		s[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(s, "-")
+}
+
+// Records the fields of a ClientHello identifying the client software.
+func (e *AccessEntry) setHello(h *clienthello.Hello) {
+	e.Fingerprint = h.Fingerprint()
+	e.SignatureAlgorithms = h.SignatureAlgorithms
+	e.KeyShares = h.KeyShares
+}
+
+// Returns a value suitable for a CLF field: "-" if empty, without spaces nor
+// quotes otherwise.
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '"' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
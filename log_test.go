@@ -0,0 +1,97 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCLFLogger(t *testing.T) {
+	tests := []struct {
+		desc  string
+		entry *AccessEntry
+		out   string
+	}{
+		{
+			"Routed connection",
+			&AccessEntry{
+				Client: "1.2.3.4",
+				SNI: "example.net",
+				Route: "*.net",
+				Backend: "10.0.0.1:443",
+				BytesSent: 517,
+				BytesReceived: 4096,
+				Duration: 1500 * time.Millisecond,
+				Reason: "closed",
+			},
+			`1.2.3.4 - - [15/Oct/2026:07:13:28 +0000] "example.net 10.0.0.1:443" 4096 517 "closed" 1.500`,
+		},
+		{
+			"Unrouted connection",
+			&AccessEntry{
+				Client: "::1",
+				Reason: "invalid handshake",
+			},
+			`::1 - - [15/Oct/2026:07:13:28 +0000] "- -" 0 0 "invalid_handshake" 0.000`,
+		},
+	}
+
+	for _, test := range(tests) {
+		var buf bytes.Buffer
+		test.entry.Start = time.Date(2026, 10, 15, 7, 13, 28, 0, time.UTC)
+		NewCLFLogger(&buf).LogAccess(test.entry)
+		if got := buf.String(); got != test.out + "\n" {
+			t.Errorf("%s: got %q, wanted %q", test.desc, got, test.out)
+		}
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+
+	l, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	logger := NewCLFLogger(l)
+	logger.LogAccess(&AccessEntry{ Client: "1.2.3.4" })
+
+	// Rotate the file, logs keep going to the old one until reopened.
+	rotated := filepath.Join(dir, "access.log.1")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	logger.LogAccess(&AccessEntry{ Client: "1.2.3.5" })
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("Could not reopen the log file (%s)", err)
+	}
+	logger.LogAccess(&AccessEntry{ Client: "1.2.3.6" })
+
+	old, _ := os.ReadFile(rotated)
+	cur, _ := os.ReadFile(path)
+	if bytes.Count(old, []byte("\n")) != 2 || !bytes.HasPrefix(cur, []byte("1.2.3.6 ")) {
+		t.Errorf("Wrong logs after reopening:\n%s---\n%s", old, cur)
+	}
+
+	if _, err := openLogFile(filepath.Join(dir, "missing", "access.log")); err == nil {
+		t.Errorf("Opening a file in a missing directory did not fail")
+	}
+}
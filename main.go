@@ -16,20 +16,194 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
 )
 
 var (
-	conf = flag.String("conf", "", "Configuration file.")
-	bind = flag.String("bind", ":443", "Address and port to bind to.")
+	conf = flag.String("conf", "", "Configuration file, or - to read it from stdin.")
+	bind = flag.String("bind", ":443", "Address and port to bind to, or fd://N for the Nth socket passed by systemd. Multiple ones can be given, separated by commas.")
+	bindFamily = flag.String("bind-family", "tcp", "IP family to listen on: tcp (both), tcp4 or tcp6.")
+	quicBind = flag.String("quic-bind", "", "Address and port to route QUIC connections on, over UDP (empty to disable).")
+	metricsBind = flag.String("metrics-bind", ":9090", "Address and port to serve Prometheus metrics on (empty to disable).")
+	statsdAddr = flag.String("statsd-addr", "", "Address and port of a statsd server to send metrics to (empty to disable).")
+	statsdPrefix = flag.String("statsd-prefix", "sniproxy.", "Prefix of the metric names sent to statsd.")
+	statsdTags = flag.Bool("statsd-tags", false, "Tag per-route statsd metrics with the route, using the DogStatsD format.")
+	otlpEndpoint = flag.String("otlp-endpoint", "", "Base URL of an OpenTelemetry collector to export a span per connection to, over OTLP/HTTP (empty to disable).")
+	adminBind = flag.String("admin-bind", "", "Address and port to serve JSON stats and reloads on, e.g. localhost:8080 as it isn't authenticated (empty to disable).")
+	healthBind = flag.String("health-bind", "", "Address and port to serve the /healthz and /readyz probes on (empty to disable).")
+	pprofBind = flag.String("pprof-bind", "", "Address and port to serve profiling data on, under /debug/pprof/ (empty to disable).")
+	accessLog = flag.String("access-log", "", "File to append access logs to, reopened on SIGHUP (stderr if empty).")
+	logFormat = flag.String("log-format", "text", "Access logs format (text, json or clf).")
+	tfo = flag.Bool("tfo", false, "Enable TCP Fast Open on the listening sockets (Linux only).")
+	bufferSize = flag.Int("buffer-size", defaultBufferSize, "Size of the buffers used to proxy data, in bytes.")
+	sndbuf = flag.Int("sndbuf", 0, "Size of the socket send buffer of client and backend connections, in bytes (0 for the OS default).")
+	rcvbuf = flag.Int("rcvbuf", 0, "Size of the socket receive buffer of client and backend connections, in bytes (0 for the OS default).")
+	debug = flag.Bool("debug", false, "Log the route patterns considered for each connection.")
+	rejectAlert = flag.Bool("reject-alert", true, "Send a TLS alert before closing connections whose SNI doesn't match any route, or matching a route in maintenance.")
+	tarpitDelay = flag.Duration("tarpit-delay", 0, "Time denied connections are held open before being closed, to slow scanners down (0 to disable).")
+	tarpitMax = flag.Int("tarpit-max", defaultTarpitMax, "Maximum number of connections held open by -tarpit-delay.")
+	maxDials = flag.Int("max-dials", 0, "Maximum number of connections to backends being established at once (0 for unlimited).")
+	dialQueueTimeout = flag.Duration("dial-queue-timeout", defaultDialQueueTimeout, "Time connections wait for their turn to connect to a backend, when -max-dials is reached.")
+	handshakeTimeout = flag.Duration("handshake-timeout", defaultHandshakeTimeout, "Time given to clients to send their TLS handshake.")
+	maxHandshakeBytes = flag.Int("max-handshake-bytes", defaultMaxHandshakeBytes, "Maximum number of bytes read from clients while looking for their ClientHello.")
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "Time given to connections to finish when shutting down.")
+	check = flag.Bool("check", false, "Check the configuration and exit. An SNI, a client IP and a listening port can be given as arguments, to report where such a connection would be routed.")
+	redirectBind = flag.String("redirect-bind", ":80", "Address and port of the HTTP to HTTPS redirect server (off to disable).")
+	redirectStatus = flag.Int("redirect-status", http.StatusMovedPermanently, "HTTP status code of redirects (301 or 308).")
 )
 
-func newRedirect(redirectPort string) func(w http.ResponseWriter, r *http.Request) {
+// Returns an HTTP handler redirecting requests to HTTPS on the port the proxy
+// is bound to, using a given status code. The default HTTPS port is omitted, and
+// assumed for sockets passed by systemd.
+func newRedirect(bind string, status int) func(w http.ResponseWriter, r *http.Request) {
+	// The port of sockets passed by systemd isn't known.
+	var redirectPort string
+	if _, port, err := net.SplitHostPort(bind); err == nil && port != "443" && !strings.HasPrefix(bind, fdPrefix) {
+		redirectPort = ":" + port
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "https://"+r.Host+redirectPort+r.RequestURI, http.StatusMovedPermanently)
+		// Drop the port the request was made to, if any.
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+			if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+		}
+		http.Redirect(w, r, "https://"+host+redirectPort+r.RequestURI, status)
+	}
+}
+
+// Reloads the configuration, and reopens the access log file if any, each time
+// a SIGHUP is received. A configuration which fails to load is reported and the
+// current one is kept. A configuration read from stdin can't be reloaded.
+func reloadOnSIGHUP(p *Proxy, file string, logs *logFile) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	go func() {
+		for range sig {
+			if logs != nil {
+				if err := logs.Reopen(); err != nil {
+					log.Print(err)
+				}
+			}
+			if file == "-" {
+				continue
+			}
+			reloadConfig(p, file)
+		}
+	}()
+}
+
+// Reloads the configuration from a file, on SIGHUP or through the admin
+// endpoint. A configuration which fails to load is reported and the current
+// one is kept.
+func reloadConfig(p *Proxy, file string) error {
+	if err := p.Reload(file); err != nil {
+		log.Printf("Could not reload config %q, keeping the current one (%s)", file, err)
+		return err
+	}
+	log.Printf("Reloaded config %q", file)
+	return nil
+}
+
+// Shuts down the proxy and the redirect server (if any) on SIGINT or SIGTERM,
+// giving connections being routed some time to finish. The returned channel is
+// closed once the shutdown is complete.
+func shutdownOnSignal(p *Proxy, redirect *http.Server, timeout time.Duration) <-chan struct{} {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		s := <-sig
+		log.Printf("Received %s, shutting down", s)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if redirect != nil {
+			if err := redirect.Shutdown(ctx); err != nil {
+				log.Printf("Could not shut down the redirect server (%s)", err)
+			}
+		}
+		if err := p.Shutdown(ctx); err != nil {
+			log.Printf("Closed remaining connections after %s (%s)", timeout, err)
+		}
+		if err := p.Tracer.Close(ctx); err != nil {
+			log.Printf("Could not export the remaining spans (%s)", err)
+		}
+		close(done)
+	}()
+
+	return done
+}
+
+// Checks a configuration file without starting the proxy. Returns false if it
+// is invalid. Warnings do not make a configuration invalid. If an SNI and
+// optionally a client IP and a port are given, reports where such a connection
+// would be routed.
+func checkConfig(file string, args []string) bool {
+	c := &config.Config{}
+	if err := c.ReadFile(file); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+		return false
+	}
+	defer c.Close()
+
+	for _, warning := range(c.Shadowed()) {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", file, warning)
+	}
+	fmt.Printf("%s: configuration is valid\n", file)
+
+	if len(args) == 0 {
+		return true
+	}
+
+	client := net.IPv4zero
+	if len(args) > 1 {
+		if client = net.ParseIP(args[1]); client == nil {
+			fmt.Fprintf(os.Stderr, "Invalid client IP %q\n", args[1])
+			return false
+		}
+	}
+	port := 0
+	if len(args) > 2 {
+		var err error
+		if port, err = strconv.Atoi(args[2]); err != nil || port < 1 || port > 65535 {
+			fmt.Fprintf(os.Stderr, "Invalid port %q\n", args[2])
+			return false
+		}
+	}
+
+	backend, err := c.ResolvePort(args[0], nil, client, port)
+	switch {
+	case err != nil:
+		fmt.Printf("%s from %s: %s\n", args[0], client, err)
+		break
+	case backend == nil:
+		fmt.Printf("%s from %s: answered locally\n", args[0], client)
+		break
+	default:
+		fmt.Printf("%s from %s: routed to %s\n", args[0], client, backend.Address)
 	}
+	return true
 }
 
 func main() {
@@ -38,18 +212,160 @@ func main() {
 		log.Fatal("No config provided. Aborting.")
 	}
 
-	p := &Proxy{}
-	if err := p.Config.ReadFile(*conf); err != nil {
-		log.Fatalf("Could not read config %q (%s)", *conf, err)
+	if *check {
+		if !checkConfig(*conf, flag.Args()) {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	go func() {
-		if err := http.ListenAndServe(":80", http.HandlerFunc(newRedirect(*bind))); err != nil {
-			log.Fatalf("ListenAndServe error: %v", err)
+	var binds []string
+	for _, addr := range(strings.Split(*bind, ",")) {
+		addr = strings.TrimSpace(addr)
+		if err := checkBind(addr, *bindFamily); err != nil {
+			log.Fatal(err)
 		}
-	}()
+		binds = append(binds, addr)
+	}
+
+	// Access logs go to stderr, unless a file is given.
+	var logs *logFile
+	var logWriter io.Writer = os.Stderr
+	if *accessLog != "" {
+		f, err := openLogFile(*accessLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logs, logWriter = f, f
+	}
 
-	if err := p.ListenAndServe(*bind); err != nil {
+	logger, err := newAccessLogger(*logFormat, logWriter)
+	if err != nil {
 		log.Fatal(err)
 	}
+
+	if *bufferSize <= 0 {
+		log.Fatalf("Invalid buffer size %d", *bufferSize)
+	}
+	if *sndbuf < 0 {
+		log.Fatalf("Invalid socket send buffer size %d", *sndbuf)
+	}
+	if *rcvbuf < 0 {
+		log.Fatalf("Invalid socket receive buffer size %d", *rcvbuf)
+	}
+
+	// Metrics can be sent to both Prometheus and statsd.
+	var sinks []Metrics
+	if *metricsBind != "" {
+		sinks = append(sinks, PrometheusMetrics())
+	}
+	if *statsdAddr != "" {
+		statsd, err := NewStatsdMetrics(*statsdAddr, *statsdPrefix, *statsdTags)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sinks = append(sinks, statsd)
+	}
+
+	p := &Proxy{
+		AccessLog: logger,
+		Metrics: NewMultiMetrics(sinks...),
+		BufferSize: *bufferSize,
+		HandshakeTimeout: *handshakeTimeout,
+		MaxHandshakeBytes: *maxHandshakeBytes,
+		SendBuffer: *sndbuf,
+		ReceiveBuffer: *rcvbuf,
+		SilentReject: !*rejectAlert,
+		Debug: *debug,
+		TarpitDelay: *tarpitDelay,
+		TarpitMax: *tarpitMax,
+		MaxDials: *maxDials,
+		DialQueueTimeout: *dialQueueTimeout,
+	}
+	if *otlpEndpoint != "" {
+		tracer, err := NewOTLPTracer(*otlpEndpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.Tracer = tracer
+	}
+	if err := p.Reload(*conf); err != nil {
+		log.Fatalf("Could not read config %q (%s)", *conf, err)
+	}
+	reloadOnSIGHUP(p, *conf, logs)
+
+	if *metricsBind != "" {
+		go func() {
+			if err := serveMetrics(*metricsBind); err != nil {
+				log.Fatalf("Metrics server error: %v", err)
+			}
+		}()
+	}
+
+	if *adminBind != "" {
+		go func() {
+			if err := serveAdmin(*adminBind, p, *conf); err != nil {
+				log.Fatalf("Admin server error: %v", err)
+			}
+		}()
+	}
+
+	if *healthBind != "" {
+		go func() {
+			if err := serveHealth(*healthBind, p); err != nil {
+				log.Fatalf("Health server error: %v", err)
+			}
+		}()
+	}
+
+	if *pprofBind != "" {
+		go func() {
+			if err := servePprof(*pprofBind); err != nil {
+				log.Fatalf("Profiling server error: %v", err)
+			}
+		}()
+	}
+
+	if *redirectStatus != http.StatusMovedPermanently && *redirectStatus != http.StatusPermanentRedirect {
+		log.Fatalf("Invalid redirect status %d (301 or 308)", *redirectStatus)
+	}
+
+	var redirect *http.Server
+	if *redirectBind != "off" {
+		redirect = &http.Server{
+			Addr: *redirectBind,
+			Handler: http.HandlerFunc(newRedirect(binds[0], *redirectStatus)),
+		}
+		go func() {
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("ListenAndServe error: %v", err)
+			}
+		}()
+	}
+
+	done := shutdownOnSignal(p, redirect, *drainTimeout)
+
+	errc := make(chan error, len(binds) + 1)
+	for _, addr := range(binds) {
+		l, err := listen(addr, *bindFamily, *tfo, p.listenConfig())
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			errc <- p.Serve(l)
+		}()
+	}
+	servers := len(binds)
+	if *quicBind != "" {
+		servers++
+		go func() {
+			errc <- p.ListenAndServeQUIC(*quicBind)
+		}()
+	}
+	for range(servers) {
+		if err := <-errc; err != ErrProxyClosed {
+			log.Fatal(err)
+		}
+	}
+	<-done
 }
@@ -0,0 +1,89 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		desc     string
+		bind     string
+		status   int
+		host     string
+		location string
+	}{
+		{
+			"Default bind",
+			":443",
+			http.StatusMovedPermanently,
+			"example.net",
+			"https://example.net/foo?bar",
+		},
+		{
+			"Default port with an address",
+			"192.168.0.1:443",
+			http.StatusPermanentRedirect,
+			"example.net",
+			"https://example.net/foo?bar",
+		},
+		{
+			"Non-standard port",
+			"192.168.0.1:8443",
+			http.StatusMovedPermanently,
+			"example.net",
+			"https://example.net:8443/foo?bar",
+		},
+		{
+			"Request made to a non-standard port",
+			":8443",
+			http.StatusPermanentRedirect,
+			"example.net:8080",
+			"https://example.net:8443/foo?bar",
+		},
+		{
+			"Socket passed by systemd",
+			"fd://3",
+			http.StatusMovedPermanently,
+			"example.net",
+			"https://example.net/foo?bar",
+		},
+		{
+			"IPv6 host",
+			":443",
+			http.StatusMovedPermanently,
+			"[::1]:80",
+			"https://[::1]/foo?bar",
+		},
+	}
+
+	for _, test := range(tests) {
+		req := httptest.NewRequest("GET", "/foo?bar", nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+
+		newRedirect(test.bind, test.status)(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: wrong status: got %d, wanted %d", test.desc, rec.Code, test.status)
+		}
+		if got := rec.Header().Get("Location"); got != test.location {
+			t.Errorf("%s: wrong location: got %q, wanted %q", test.desc, got, test.location)
+		}
+	}
+}
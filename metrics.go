@@ -0,0 +1,296 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics.
+var (
+	connsAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_connections_total",
+		Help: "Total number of connections accepted.",
+	})
+	routeConns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sniproxy_route_connections_total",
+		Help: "Number of connections matched, by domain pattern.",
+	}, []string{"route"})
+	bytesIn = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_bytes_in_total",
+		Help: "Number of bytes proxied from clients to backends.",
+	})
+	bytesOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_bytes_out_total",
+		Help: "Number of bytes proxied from backends to clients.",
+	})
+	dialFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_backend_dial_failures_total",
+		Help: "Number of failed connections to backends.",
+	})
+	dialsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sniproxy_backend_dials_in_flight",
+		Help: "Number of connections to backends currently being established.",
+	})
+	sniFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_sni_parse_failures_total",
+		Help: "Number of TLS handshakes which could not be parsed.",
+	})
+	handshakesTooLarge = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_handshake_too_large_total",
+		Help: "Number of connections closed because their handshake exceeded the size limit.",
+	})
+	invalidSNI = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_invalid_sni_total",
+		Help: "Number of connections rejected because of a malformed SNI.",
+	})
+	rateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_rate_limited_total",
+		Help: "Number of connections dropped because of rate limiting.",
+	})
+	activeConns = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sniproxy_active_connections",
+		Help: "Number of connections currently being handled.",
+	})
+	connsLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sniproxy_connections_limited_total",
+		Help: "Number of connections exceeding max-connections or max-conns-per-ip.",
+	})
+	aclDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sniproxy_route_acl_decisions_total",
+		Help: "Number of connections checked against allow/deny rules, by domain pattern and decision (allowed, denied or default-deny).",
+	}, []string{"route", "decision"})
+	copyEnds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sniproxy_copy_ends_total",
+		Help: "Number of proxied streams ended, by peer responsible and reason (eof, reset, timeout, closed or error).",
+	}, []string{"peer", "reason"})
+	tlsVersions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sniproxy_client_tls_versions_total",
+		Help: "Number of handshakes parsed, by highest TLS version offered by the client.",
+	}, []string{"version"})
+	connDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "sniproxy_connection_duration_seconds",
+		Help: "Duration of the connections, from accept to close.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(connsAccepted, routeConns, bytesIn, bytesOut,
+				dialFailures, sniFailures, invalidSNI, rateLimited,
+				activeConns, connsLimited, copyEnds, tlsVersions,
+				connDuration, dialsInFlight, handshakesTooLarge,
+				aclDecisions)
+}
+
+// Metrics receives the events accounted for by the proxy. Implementations must
+// be safe for concurrent use and must not block.
+type Metrics interface {
+	// A connection was accepted.
+	ConnAccepted()
+	// A connection matched a route, identified by its domain pattern.
+	ConnRouted(route string)
+	// A connection was closed after a given duration.
+	ConnClosed(duration time.Duration)
+	// The number of connections being handled changed by delta.
+	ActiveConns(delta int)
+	// Bytes were proxied from a client to a backend (in), or the other way
+	// around (out).
+	BytesProxied(in, out int64)
+	// Connecting to a backend failed.
+	DialFailed()
+	// The number of connections to backends being established changed by
+	// delta.
+	DialsInFlight(delta int)
+	// A TLS handshake could not be parsed.
+	SNIFailed()
+	// A TLS handshake exceeded the size limit before being fully read.
+	HandshakeTooLarge()
+	// The SNI of a handshake is not a valid host name.
+	InvalidSNI()
+	// A handshake offering at most a given TLS version (eg. "TLS 1.3") was
+	// parsed. Unknown versions are reported as "other" (see versionLabel).
+	ClientVersion(version string)
+	// A connection was dropped because of rate limiting.
+	RateLimited()
+	// A connection exceeded max-connections or max-conns-per-ip.
+	ConnsLimited()
+	// A connection was checked against the allow/deny rules of a route,
+	// identified by its domain pattern, with a given decision ("allowed",
+	// "denied" or "default-deny").
+	ACLDecision(route, decision string)
+	// Proxying data in one direction ended, because of a peer ("client"
+	// or "backend") for a given reason (see classifyCopy).
+	CopyEnded(peer, reason string)
+}
+
+// Metrics sink updating the Prometheus metrics.
+type promMetrics struct{}
+
+func (promMetrics) ConnAccepted()                     { connsAccepted.Inc() }
+func (promMetrics) ConnRouted(route string)           { routeConns.WithLabelValues(route).Inc() }
+func (promMetrics) ConnClosed(duration time.Duration) { connDuration.Observe(duration.Seconds()) }
+func (promMetrics) ActiveConns(delta int)             { activeConns.Add(float64(delta)) }
+func (promMetrics) DialFailed()                       { dialFailures.Inc() }
+func (promMetrics) DialsInFlight(delta int)           { dialsInFlight.Add(float64(delta)) }
+func (promMetrics) SNIFailed()                        { sniFailures.Inc() }
+func (promMetrics) HandshakeTooLarge()                { handshakesTooLarge.Inc() }
+func (promMetrics) InvalidSNI()                       { invalidSNI.Inc() }
+func (promMetrics) ClientVersion(version string)      { tlsVersions.WithLabelValues(versionLabel(version)).Inc() }
+func (promMetrics) RateLimited()                      { rateLimited.Inc() }
+func (promMetrics) ConnsLimited()                     { connsLimited.Inc() }
+func (promMetrics) CopyEnded(peer, reason string)     { copyEnds.WithLabelValues(peer, reason).Inc() }
+
+func (promMetrics) BytesProxied(in, out int64) {
+	bytesIn.Add(float64(in))
+	bytesOut.Add(float64(out))
+}
+
+func (promMetrics) ACLDecision(route, decision string) {
+	aclDecisions.WithLabelValues(route, decision).Inc()
+}
+
+// Forwards events to several metrics sinks.
+type multiMetrics []Metrics
+
+func (m multiMetrics) ConnAccepted() {
+	for _, s := range(m) {
+		s.ConnAccepted()
+	}
+}
+
+func (m multiMetrics) ConnRouted(route string) {
+	for _, s := range(m) {
+		s.ConnRouted(route)
+	}
+}
+
+func (m multiMetrics) ConnClosed(duration time.Duration) {
+	for _, s := range(m) {
+		s.ConnClosed(duration)
+	}
+}
+
+func (m multiMetrics) ActiveConns(delta int) {
+	for _, s := range(m) {
+		s.ActiveConns(delta)
+	}
+}
+
+func (m multiMetrics) BytesProxied(in, out int64) {
+	for _, s := range(m) {
+		s.BytesProxied(in, out)
+	}
+}
+
+func (m multiMetrics) DialFailed() {
+	for _, s := range(m) {
+		s.DialFailed()
+	}
+}
+
+func (m multiMetrics) DialsInFlight(delta int) {
+	for _, s := range(m) {
+		s.DialsInFlight(delta)
+	}
+}
+
+func (m multiMetrics) SNIFailed() {
+	for _, s := range(m) {
+		s.SNIFailed()
+	}
+}
+
+func (m multiMetrics) HandshakeTooLarge() {
+	for _, s := range(m) {
+		s.HandshakeTooLarge()
+	}
+}
+
+func (m multiMetrics) InvalidSNI() {
+	for _, s := range(m) {
+		s.InvalidSNI()
+	}
+}
+
+func (m multiMetrics) ClientVersion(version string) {
+	for _, s := range(m) {
+		s.ClientVersion(version)
+	}
+}
+
+func (m multiMetrics) RateLimited() {
+	for _, s := range(m) {
+		s.RateLimited()
+	}
+}
+
+func (m multiMetrics) ConnsLimited() {
+	for _, s := range(m) {
+		s.ConnsLimited()
+	}
+}
+
+func (m multiMetrics) ACLDecision(route, decision string) {
+	for _, s := range(m) {
+		s.ACLDecision(route, decision)
+	}
+}
+
+func (m multiMetrics) CopyEnded(peer, reason string) {
+	for _, s := range(m) {
+		s.CopyEnded(peer, reason)
+	}
+}
+
+// Returns a sink forwarding events to all the given ones.
+func NewMultiMetrics(sinks ...Metrics) Metrics {
+	return multiMetrics(sinks)
+}
+
+// Returns the sink updating the Prometheus metrics.
+func PrometheusMetrics() Metrics {
+	return promMetrics{}
+}
+
+// TLS versions reported as is in metrics.
+var knownVersions = []string{ "SSLv3", "TLS 1.0", "TLS 1.1", "TLS 1.2", "TLS 1.3" }
+
+// Returns the label of a TLS version name in metrics. The version is chosen by
+// clients: others than the known ones are reported as "other", so they can't
+// create any number of series.
+func versionLabel(version string) string {
+	if slices.Contains(knownVersions, version) {
+		return version
+	}
+	return "other"
+}
+
+// Serves the metrics endpoint on a dedicated HTTP server.
+func serveMetrics(bind string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{
+		Addr: bind,
+		Handler: mux,
+	}
+	return srv.ListenAndServe()
+}
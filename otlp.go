@@ -0,0 +1,267 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of spans queued for export, before new ones get dropped.
+const otlpQueueLen = 1024
+
+// Maximum number of spans exported at once, and maximum time spans wait in the
+// queue before being exported.
+const (
+	otlpBatchSize     = 100
+	otlpBatchInterval = time.Second
+)
+
+// Exports a span per connection to an OpenTelemetry collector, using OTLP over
+// HTTP with the JSON encoding. Connections have no incoming trace context, so
+// each span is the root of a new trace. Spans are exported in batches by a
+// dedicated goroutine and dropped if it can't keep up, so tracing never slows
+// connections down.
+type OTLPTracer struct {
+	url      string
+	client   *http.Client
+	spans    chan *otlpSpan
+	// Closed to stop the tracer, and once the last spans are exported.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Export request, in the OTLP JSON format.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+// Span of a connection.
+type otlpSpan struct {
+	TraceID    string          `json:"traceId"`
+	SpanID     string          `json:"spanId"`
+	Name       string          `json:"name"`
+	Kind       int             `json:"kind"`
+	Start      string          `json:"startTimeUnixNano"`
+	End        string          `json:"endTimeUnixNano"`
+	Attributes []otlpAttribute `json:"attributes"`
+	Status     otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// Attribute value, 64-bit integers being encoded as strings.
+type otlpValue struct {
+	String *string `json:"stringValue,omitempty"`
+	Int    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// OTLP span kind and status code used.
+const (
+	otlpKindServer  = 2
+	otlpStatusError = 2
+)
+
+// Returns a tracer exporting spans to the collector at endpoint, the base URL
+// of its OTLP/HTTP receiver (eg. http://localhost:4318).
+func NewOTLPTracer(endpoint string) (*OTLPTracer, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("Invalid OTLP endpoint %q (not an HTTP URL)", endpoint)
+	}
+
+	t := &OTLPTracer{
+		url: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{ Timeout: 10 * time.Second },
+		spans: make(chan *otlpSpan, otlpQueueLen),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go t.send()
+	return t, nil
+}
+
+// Queues the span of a closed connection for export. Nil-safe, tracing being
+// disabled when the tracer is nil.
+func (t *OTLPTracer) trace(e *AccessEntry) {
+	if t == nil {
+		return
+	}
+
+	str := func(key, value string) otlpAttribute {
+		return otlpAttribute{ key, otlpValue{ String: &value } }
+	}
+	num := func(key string, value int64) otlpAttribute {
+		s := strconv.FormatInt(value, 10)
+		return otlpAttribute{ key, otlpValue{ Int: &s } }
+	}
+
+	var id [24]byte
+	for i := 0; i < len(id); i += 8 {
+		v := rand.Uint64()
+		for j := 0; j < 8; j++ {
+			id[i+j] = byte(v >> (8 * j))
+		}
+	}
+
+	span := &otlpSpan{
+		TraceID: hex.EncodeToString(id[:16]),
+		SpanID: hex.EncodeToString(id[16:]),
+		Name: "connection",
+		Kind: otlpKindServer,
+		Start: strconv.FormatInt(e.Start.UnixNano(), 10),
+		End: strconv.FormatInt(e.Start.Add(e.Duration).UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			str("client.address", e.Client),
+			str("sni", e.SNI),
+			str("route", e.Route),
+			str("backend", e.Backend),
+			num("bytes_sent", e.BytesSent),
+			num("bytes_received", e.BytesReceived),
+			str("reason", e.Reason),
+		},
+	}
+	if e.Reason != "closed" {
+		span.Status = otlpStatus{ otlpStatusError, e.Reason }
+	}
+
+	select {
+	case t.spans <- span:
+	default:
+	}
+}
+
+// Exports the queued spans and stops the tracer, spans traced afterwards being
+// dropped. Returns early if ctx is done first. Nil-safe.
+func (t *OTLPTracer) Close(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Exports the queued spans in batches, until the tracer is closed.
+func (t *OTLPTracer) send() {
+	defer close(t.done)
+	ticker := time.NewTicker(otlpBatchInterval)
+	defer ticker.Stop()
+
+	var batch []*otlpSpan
+	for {
+		select {
+		case span := <-t.spans:
+			if batch = append(batch, span); len(batch) < otlpBatchSize {
+				continue
+			}
+			break
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+			break
+		case <-t.stop:
+			t.flush(batch)
+			return
+		}
+
+		if err := t.export(batch); err != nil {
+			log.Printf("Could not export %d spans (%s)", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// Exports a pending batch and the spans still queued.
+func (t *OTLPTracer) flush(batch []*otlpSpan) {
+	for len(t.spans) > 0 {
+		batch = append(batch, <-t.spans)
+	}
+	for len(batch) > 0 {
+		n := min(len(batch), otlpBatchSize)
+		if err := t.export(batch[:n]); err != nil {
+			log.Printf("Could not export %d spans (%s)", n, err)
+		}
+		batch = batch[n:]
+	}
+}
+
+// Sends a batch of spans to the collector.
+func (t *OTLPTracer) export(spans []*otlpSpan) error {
+	var req otlpRequest
+	req.ResourceSpans = make([]otlpResourceSpans, 1)
+	rs := &req.ResourceSpans[0]
+	service := "sniproxy"
+	rs.Resource.Attributes = []otlpAttribute{ { "service.name", otlpValue{ String: &service } } }
+	rs.ScopeSpans = make([]otlpScopeSpans, 1)
+	rs.ScopeSpans[0].Scope.Name = "sniproxy"
+	rs.ScopeSpans[0].Spans = spans
+
+	b, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	// Drain the body so the connection can be reused.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPTracer(t *testing.T) {
+	requests := make(chan *otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- &req
+	}))
+	defer srv.Close()
+
+	tracer, err := NewOTLPTracer(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	start := time.Unix(1700000000, 0)
+	tracer.trace(&AccessEntry{
+		Client: "192.0.2.1",
+		SNI: "example.net",
+		Backend: "1.2.3.4:443",
+		BytesSent: 10,
+		BytesReceived: 20,
+		Start: start,
+		Duration: time.Second,
+		Reason: "backend reset",
+	})
+
+	var req *otlpRequest
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No spans exported")
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("Got %d spans, wanted 1", len(spans))
+	}
+	span := spans[0]
+	if len(span.TraceID) != 32 || len(span.SpanID) != 16 {
+		t.Errorf("Wrong IDs: %q, %q", span.TraceID, span.SpanID)
+	}
+	if span.Start != "1700000000000000000" || span.End != "1700000001000000000" {
+		t.Errorf("Wrong times: %s - %s", span.Start, span.End)
+	}
+	if span.Status.Code != otlpStatusError || span.Status.Message != "backend reset" {
+		t.Errorf("Wrong status: %+v", span.Status)
+	}
+
+	attrs := make(map[string]string)
+	for _, a := range(span.Attributes) {
+		switch {
+		case a.Value.String != nil:
+			attrs[a.Key] = *a.Value.String
+		case a.Value.Int != nil:
+			attrs[a.Key] = *a.Value.Int
+		}
+	}
+	if attrs["sni"] != "example.net" || attrs["backend"] != "1.2.3.4:443" ||
+	   attrs["bytes_sent"] != "10" || attrs["bytes_received"] != "20" {
+		t.Errorf("Wrong attributes: %v", attrs)
+	}
+
+	// Queued spans are exported when closing the tracer, without waiting
+	// for the batch interval.
+	closing, err := NewOTLPTracer(srv.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	closing.trace(&AccessEntry{ Start: start, Reason: "closed" })
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := closing.Close(ctx); err != nil {
+		t.Errorf("Could not close the tracer (%s)", err)
+	}
+	select {
+	case req = <-requests:
+		if n := len(req.ResourceSpans[0].ScopeSpans[0].Spans); n != 1 {
+			t.Errorf("Got %d spans on close, wanted 1", n)
+		}
+	default:
+		t.Errorf("No spans exported on close")
+	}
+
+	if _, err := NewOTLPTracer("localhost:4318"); err == nil {
+		t.Errorf("Endpoint without a scheme was accepted")
+	}
+
+	// Tracing is disabled with a nil tracer.
+	var disabled *OTLPTracer
+	disabled.trace(&AccessEntry{})
+	if err := disabled.Close(ctx); err != nil {
+		t.Errorf("Could not close a nil tracer (%s)", err)
+	}
+}
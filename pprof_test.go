@@ -0,0 +1,43 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofHandler(t *testing.T) {
+	tests := []struct {
+		desc   string
+		path   string
+		status int
+	}{
+		{ "Index", "/debug/pprof/", http.StatusOK },
+		{ "Goroutines", "/debug/pprof/goroutine?debug=1", http.StatusOK },
+		{ "Outside of the prefix", "/metrics", http.StatusNotFound },
+	}
+
+	h := pprofHandler()
+	for _, tt := range(tests) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, wanted %d", tt.desc, rec.Code, tt.status)
+		}
+	}
+}
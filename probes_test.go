@@ -0,0 +1,73 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns the status codes of the liveness and readiness probes.
+func probe(h http.Handler) (int, int) {
+	var codes [2]int
+	for i, path := range([]string{ "/healthz", "/readyz" }) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		codes[i] = rec.Code
+	}
+	return codes[0], codes[1]
+}
+
+func TestProbes(t *testing.T) {
+	p := &Proxy{}
+	h := newProbesHandler(p)
+
+	if live, ready := probe(h); live != http.StatusOK || ready != http.StatusServiceUnavailable {
+		t.Errorf("Without configuration: got %d/%d", live, ready)
+	}
+
+	path := filepath.Join(t.TempDir(), "sniproxy.conf")
+	os.WriteFile(path, []byte("example.net {\n\tbackend 192.0.2.1:443\n}\n"), 0644)
+	if err := p.Reload(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ready := probe(h); ready != http.StatusServiceUnavailable {
+		t.Errorf("Without listener: got %d", ready)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(l)
+	for i := 0; i < 100 && !p.Ready(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if live, ready := probe(h); live != http.StatusOK || ready != http.StatusOK {
+		t.Errorf("Serving: got %d/%d", live, ready)
+	}
+
+	p.Shutdown(context.Background())
+	if live, ready := probe(h); live != http.StatusOK || ready != http.StatusServiceUnavailable {
+		t.Errorf("Shut down: got %d/%d", live, ready)
+	}
+}
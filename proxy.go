@@ -17,173 +17,1367 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/atenart/sniproxy/clienthello"
 	"github.com/atenart/sniproxy/config"
+	"golang.org/x/time/rate"
 )
 
 // Represents the proxy itself.
 type Proxy struct {
-	Config config.Config
+	// Config can be swapped at runtime (see SetConfig) and must only be
+	// accessed while holding mu.
+	mu     sync.RWMutex
+	Config *config.Config
+
+	// Health checks state, protected by mu.
+	checking   bool
+	stopChecks chan struct{}
+
+	// Semaphore limiting the number of connections, protected by mu. It is
+	// replaced when a configuration with another limit is loaded.
+	slots chan struct{}
+
+	// Number of connections per client IP.
+	perIP ipConns
+
+	// Access logs are written to AccessLog. A JSON logger writing to
+	// stderr is used if none is set.
+	AccessLog AccessLogger
+
+	// Events are accounted for in Metrics, the Prometheus metrics if unset.
+	// Several sinks can be combined using NewMultiMetrics.
+	Metrics Metrics
+
+	// Size of the buffers used to proxy data, defaultBufferSize if unset.
+	// Buffers are pooled and shared by all connections.
+	BufferSize  int
+	buffers     *sync.Pool
+	buffersOnce sync.Once
+
+	// Time given to clients to send their TLS handshake (and PROXY header),
+	// defaultHandshakeTimeout if unset.
+	HandshakeTimeout time.Duration
+
+	// Maximum number of bytes read from clients while looking for their
+	// ClientHello, defaultMaxHandshakeBytes if unset.
+	MaxHandshakeBytes int
+
+	// Sizes of the socket send and receive buffers of client and backend
+	// TCP connections, in bytes, the OS defaults if unset. They are set
+	// before connecting to backends, and on the listeners (see
+	// listenConfig) for clients.
+	SendBuffer    int
+	ReceiveBuffer int
+	sockBufs      *sockBuffers
+	sockBufsOnce  sync.Once
+
+	// Connections whose SNI doesn't match any route, or matching a route in
+	// maintenance, are closed without sending a TLS alert first.
+	SilentReject bool
+
+	// Logs the route patterns considered for each connection.
+	Debug bool
+
+	// Exports a span per connection, if set.
+	Tracer *OTLPTracer
+
+	// Denied connections are held open for TarpitDelay before being closed,
+	// if set. At most TarpitMax connections (defaultTarpitMax if unset) are
+	// held, others being closed right away.
+	TarpitDelay time.Duration
+	TarpitMax   int
+	pit         *tarpit
+	pitOnce     sync.Once
+
+	// At most MaxDials connections to backends are being established at
+	// once, if set. Others wait for up to DialQueueTimeout
+	// (defaultDialQueueTimeout if unset) before failing.
+	MaxDials         int
+	DialQueueTimeout time.Duration
+	dials            chan struct{}
+	dialsOnce        sync.Once
+
+	// Connects to backends if set, e.g. to use a custom transport or to test
+	// without the network. Backends are otherwise connected to using their
+	// own options (dial-timeout, source and backend-dns-ttl), which Dialer
+	// is in charge of when set.
+	Dialer func(network, address string) (net.Conn, error)
+
+	// Listeners and connections being routed, protected by connMu. Used
+	// for shutting down the proxy.
+	connMu     sync.Mutex
+	listeners  map[io.Closer]struct{}
+	conns      map[*Conn]struct{}
+	inShutdown bool
+	closing    chan struct{}
+	wg         sync.WaitGroup
 }
 
+// Default time given to clients to send their TLS handshake.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// Default maximum number of bytes read while looking for a ClientHello.
+const defaultMaxHandshakeBytes = 64 * 1024
+
+// Default size of the buffers used to proxy data.
+const defaultBufferSize = 32 * 1024
+
+// Default time connections wait for a backend dial slot, when limited.
+const defaultDialQueueTimeout = time.Second
+
+// Delay before retrying to connect to a backend, multiplied by the number of
+// attempts made.
+const retryBackoff = 100 * time.Millisecond
+
+// Returned by ListenAndServe after a call to Shutdown.
+var ErrProxyClosed = errors.New("Proxy closed")
+
+// Returned when reading a ClientHello goes past the handshake size limit.
+var errHandshakeTooLarge = errors.New("Handshake exceeds the size limit")
+
 // Represents a connection being routed.
 type Conn struct {
 	*net.TCPConn
-	Config *config.Config
+	Config  *config.Config
+	logger  AccessLogger
+	metrics Metrics
+	buffers *sync.Pool
+	dial    func(network, address string, backend *config.Backend) (net.Conn, error)
+
+	// Time given to the client to send its TLS handshake.
+	handshakeTimeout time.Duration
+	// Maximum number of bytes read while looking for the ClientHello.
+	maxHandshake     int
+	// Whether to skip the TLS alert when the SNI doesn't match any route,
+	// or matches a route in maintenance.
+	silentReject     bool
+	// Whether to log the route patterns considered.
+	debug            bool
+	// Number of connections per client IP, shared by all connections.
+	perIP            *ipConns
+	// Where denied connections are held, if enabled.
+	tarpit           *tarpit
+	// Exports a span once the connection is closed, if set.
+	tracer           *OTLPTracer
+
+	// Addresses conveyed by an inbound PROXY header, if any.
+	remote net.Addr
+	local  net.Addr
 }
 
-// Listen and serve the connections.
+// Returns the client address, as conveyed by an inbound PROXY header if any.
+func (conn *Conn) RemoteAddr() net.Addr {
+	if conn.remote != nil {
+		return conn.remote
+	}
+	return conn.TCPConn.RemoteAddr()
+}
+
+// Returns the address the client connected to, as conveyed by an inbound PROXY
+// header if any.
+func (conn *Conn) LocalAddr() net.Addr {
+	if conn.local != nil {
+		return conn.local
+	}
+	return conn.TCPConn.LocalAddr()
+}
+
+// Listen and serve the connections. Can be called multiple times to listen on
+// multiple addresses, the configuration being shared.
 func (p *Proxy) ListenAndServe(bind string) error {
-	l, err := net.Listen("tcp", bind)
+	return p.ListenAndServeContext(context.Background(), bind)
+}
+
+// Same as ListenAndServe, but stops once ctx is done (see ServeContext).
+func (p *Proxy) ListenAndServeContext(ctx context.Context, bind string) error {
+	lc := p.listenConfig()
+	l, err := lc.Listen(ctx, "tcp", bind)
 	if err != nil {
 		return err
 	}
+	return p.ServeContext(ctx, l)
+}
+
+// Serves the connections accepted on a TCP listener, which is closed once
+// done. Can be called multiple times to serve multiple listeners, the
+// configuration being shared.
+func (p *Proxy) Serve(l net.Listener) error {
+	return p.ServeContext(context.Background(), l)
+}
+
+// Same as Serve, but once ctx is done the listener is closed and the
+// connections it accepted are waited for, before returning the context's
+// error. Other listeners are not affected.
+func (p *Proxy) ServeContext(ctx context.Context, l net.Listener) error {
 	defer l.Close()
 
+	if !p.trackListener(l, true) {
+		return ErrProxyClosed
+	}
+	defer p.trackListener(l, false)
+	p.startHealthChecks()
+
+	// Closing the listener interrupts Accept.
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
+	// Connections accepted on this listener, drained when ctx is done.
+	var served sync.WaitGroup
+
 	// Accept connections and handle them to a go routine.
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			if p.shuttingDown() {
+				return ErrProxyClosed
+			}
+			if ctx.Err() != nil {
+				served.Wait()
+				return ctx.Err()
+			}
 			return err
 		}
 
+		// Connections keep using the configuration they were accepted
+		// with, even if a new one is loaded in the meantime.
 		conn := &Conn{
 			TCPConn: c.(*net.TCPConn),
-			Config: &p.Config,
+			Config: p.currentConfig(),
+			logger: p.accessLogger(),
+			metrics: p.metrics(),
+			buffers: p.bufferPool(),
+			dial: p.dial,
+			handshakeTimeout: p.handshakeTimeout(),
+			maxHandshake: p.maxHandshakeBytes(),
+			silentReject: p.SilentReject,
+			debug: p.Debug,
+			perIP: &p.perIP,
+			tarpit: p.tarpit(),
+			tracer: p.Tracer,
+		}
+		conn.metrics.ConnAccepted()
+
+		// Drop connections from clients exceeding the rate limit right
+		// away. When accepting PROXY headers, the client is only known
+		// once the header is read.
+		if limiter := conn.Config.RateLimit; limiter != nil && !conn.Config.AcceptProxy &&
+		   !limiter.Allow(conn.RemoteAddr().(*net.TCPAddr).IP) {
+			conn.metrics.RateLimited()
+			conn.Close()
+			continue
 		}
 
-		go conn.dispatch()
+		// Enforce the global connection limit.
+		slots := p.connSlots(conn.Config)
+		if !p.acquireSlot(ctx, slots, conn.Config.MaxConnsPause) {
+			conn.Close()
+			continue
+		}
+
+		if !p.trackConn(conn, true) {
+			releaseSlot(slots)
+			conn.Close()
+			continue
+		}
+		served.Add(1)
+		go func() {
+			defer served.Done()
+			defer releaseSlot(slots)
+			defer p.trackConn(conn, false)
+			conn.dispatch()
+		}()
 	}
+}
+
+// Stops accepting new connections and waits for the ones being routed to
+// finish. If the context expires first, the remaining connections are closed
+// and the context's error is returned.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.connMu.Lock()
+	if !p.inShutdown {
+		p.inShutdown = true
+		close(p.closingChan())
+	}
+	for l := range(p.listeners) {
+		l.Close()
+	}
+	p.connMu.Unlock()
+
+	// Connections held in the tarpit are denied anyway.
+	p.tarpit().closeAll()
+
+	p.mu.Lock()
+	if p.stopChecks != nil {
+		close(p.stopChecks)
+		p.stopChecks = nil
+	}
+	p.checking = false
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.connMu.Lock()
+		for conn := range(p.conns) {
+			conn.Close()
+		}
+		p.connMu.Unlock()
+		return ctx.Err()
+	}
+}
 
+// Reports whether the proxy is shutting down.
+func (p *Proxy) shuttingDown() bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return p.inShutdown
+}
+
+// Reports whether the proxy is ready to route connections: a configuration is
+// loaded, at least one listener is served and the proxy isn't shutting down.
+func (p *Proxy) Ready() bool {
+	if p.currentConfig() == nil {
+		return false
+	}
+
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return !p.inShutdown && len(p.listeners) > 0
+}
+
+// Returns a channel closed once the proxy starts shutting down. Must be called
+// with connMu held.
+func (p *Proxy) closingChan() chan struct{} {
+	if p.closing == nil {
+		p.closing = make(chan struct{})
+	}
+	return p.closing
+}
+
+// Returns the semaphore limiting the number of connections allowed by c, nil if
+// they are not limited. Connections accepted before the limit changed still
+// hold a slot of the previous semaphore and aren't counted in the new one.
+func (p *Proxy) connSlots(c *config.Config) chan struct{} {
+	if c.MaxConns <= 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cap(p.slots) != c.MaxConns {
+		p.slots = make(chan struct{}, c.MaxConns)
+	}
+	return p.slots
+}
+
+// Takes a connection slot. When none is available, returns false right away,
+// or waits for one if wait is set. Waiting stops if the proxy shuts down or ctx
+// is done.
+func (p *Proxy) acquireSlot(ctx context.Context, slots chan struct{}, wait bool) bool {
+	if slots == nil {
+		return true
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	p.metrics().ConnsLimited()
+	if !wait {
+		return false
+	}
+
+	p.connMu.Lock()
+	closing := p.closingChan()
+	p.connMu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-closing:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Gives back a connection slot.
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// Counts the connections of each client IP.
+type ipConns struct {
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// Accounts for a new connection from ip, unless it already has max of them.
+// Reports whether the connection was accounted for.
+func (t *ipConns) acquire(ip net.IP, max int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := string(ip.To16())
+	if t.conns[key] >= max {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = make(map[string]int)
+	}
+	t.conns[key]++
+	return true
+}
+
+// Accounts for a closed connection from ip. Clients without connections left
+// are forgotten.
+func (t *ipConns) release(ip net.IP) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := string(ip.To16())
+	if t.conns[key] <= 1 {
+		delete(t.conns, key)
+		return
+	}
+	t.conns[key]--
+}
+
+// Adds or removes a listener (TCP, or UDP for QUIC) from the set of listeners
+// to close on shutdown. Returns false if a listener can't be added as the proxy
+// is shutting down.
+func (p *Proxy) trackListener(l io.Closer, add bool) bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if !add {
+		delete(p.listeners, l)
+		return true
+	}
+
+	if p.inShutdown {
+		return false
+	}
+	if p.listeners == nil {
+		p.listeners = make(map[io.Closer]struct{})
+	}
+	p.listeners[l] = struct{}{}
+	return true
+}
+
+// Adds or removes a connection from the set of connections being routed.
+// Returns false if a connection can't be added as the proxy is shutting down.
+func (p *Proxy) trackConn(conn *Conn, add bool) bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if !add {
+		delete(p.conns, conn)
+		p.metrics().ActiveConns(-1)
+		p.wg.Done()
+		return true
+	}
+
+	if p.inShutdown {
+		return false
+	}
+	if p.conns == nil {
+		p.conns = make(map[*Conn]struct{})
+	}
+	p.conns[conn] = struct{}{}
+	p.metrics().ActiveConns(1)
+	p.wg.Add(1)
+	return true
+}
+
+// Returns the access logger to use.
+func (p *Proxy) accessLogger() AccessLogger {
+	if p.AccessLog == nil {
+		return defaultAccessLogger
+	}
+	return p.AccessLog
+}
+
+// Returns the metrics sink to use.
+func (p *Proxy) metrics() Metrics {
+	if p.Metrics == nil {
+		return promMetrics{}
+	}
+	return p.Metrics
+}
+
+// Returns the time given to clients to send their TLS handshake.
+func (p *Proxy) handshakeTimeout() time.Duration {
+	if p.HandshakeTimeout <= 0 {
+		return defaultHandshakeTimeout
+	}
+	return p.HandshakeTimeout
+}
+
+// Returns the maximum number of bytes read while looking for a ClientHello.
+func (p *Proxy) maxHandshakeBytes() int {
+	if p.MaxHandshakeBytes <= 0 {
+		return defaultMaxHandshakeBytes
+	}
+	return p.MaxHandshakeBytes
+}
+
+// Returns the tarpit holding denied connections, nil if disabled.
+func (p *Proxy) tarpit() *tarpit {
+	if p.TarpitDelay <= 0 {
+		return nil
+	}
+
+	p.pitOnce.Do(func() {
+		max := p.TarpitMax
+		if max <= 0 {
+			max = defaultTarpitMax
+		}
+		p.pit = &tarpit{ delay: p.TarpitDelay, max: max }
+	})
+	return p.pit
+}
+
+// Returns a ListenConfig setting the socket buffer sizes of the listeners, and
+// thus of the connections they accept.
+func (p *Proxy) listenConfig() net.ListenConfig {
+	var lc net.ListenConfig
+	if bufs := p.sockBuffers(); bufs != nil {
+		lc.Control = bufs.control
+	}
+	return lc
+}
+
+// Returns the socket buffer sizes to apply to connections, nil if unset.
+func (p *Proxy) sockBuffers() *sockBuffers {
+	if p.SendBuffer <= 0 && p.ReceiveBuffer <= 0 {
+		return nil
+	}
+
+	p.sockBufsOnce.Do(func() {
+		p.sockBufs = &sockBuffers{ snd: p.SendBuffer, rcv: p.ReceiveBuffer }
+	})
+	return p.sockBufs
+}
+
+// Returns the semaphore limiting concurrent backend dials, nil if unlimited.
+func (p *Proxy) dialSlots() chan struct{} {
+	if p.MaxDials <= 0 {
+		return nil
+	}
+
+	p.dialsOnce.Do(func() {
+		p.dials = make(chan struct{}, p.MaxDials)
+	})
+	return p.dials
+}
+
+// Connects to a backend. When dials are limited, waits for a slot first.
+func (p *Proxy) dial(network, address string, backend *config.Backend) (net.Conn, error) {
+	if dials := p.dialSlots(); dials != nil {
+		wait := p.DialQueueTimeout
+		if wait <= 0 {
+			wait = defaultDialQueueTimeout
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case dials <- struct{}{}:
+			timer.Stop()
+			break
+		case <-timer.C:
+			return nil, fmt.Errorf("Could not connect to %s (too many dials in progress)", address)
+		}
+		defer func() { <-dials }()
+	}
+
+	m := p.metrics()
+	m.DialsInFlight(1)
+	defer m.DialsInFlight(-1)
+
+	return p.connect(network, address, backend)
+}
+
+// Connects to a backend using the proxy's Dialer if set, or the backend's own
+// dialer.
+func (p *Proxy) connect(network, address string, backend *config.Backend) (net.Conn, error) {
+	if p.Dialer != nil {
+		return p.Dialer(network, address)
+	}
+	dialer := backend.Dialer(network)
+	if bufs := p.sockBuffers(); bufs != nil && network == "tcp" {
+		dialer.Control = bufs.control
+	}
+	c, err := backend.DialWith(dialer, network, address)
+	if err != nil && backend.Source != nil {
+		return nil, fmt.Errorf("Could not connect to %s from %s (%s)", address, backend.Source, err)
+	}
+	return c, err
+}
+
+// Returns the pool of buffers used to proxy data.
+func (p *Proxy) bufferPool() *sync.Pool {
+	p.buffersOnce.Do(func() {
+		size := p.BufferSize
+		if size <= 0 {
+			size = defaultBufferSize
+		}
+		p.buffers = newBufferPool(size)
+	})
+	return p.buffers
+}
+
+// Returns a pool of buffers of a given size.
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			b := make([]byte, size)
+			return &b
+		},
+	}
+}
+
+// Reader and writer hiding the io.WriterTo and io.ReaderFrom implementations of
+// the underlying ones (e.g. of TCP connections), so copies go through a buffer.
+type plainReader struct{ io.Reader }
+type plainWriter struct{ io.Writer }
+
+// Copies data from src to dst using a buffer from a pool. The buffer is
+// returned to the pool once done, even on error.
+func copyBuffered(dst io.Writer, src io.Reader, pool *sync.Pool) (int64, error) {
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	return io.CopyBuffer(plainWriter{ dst }, plainReader{ src }, *buf)
+}
+
+// Returns the configuration currently in use.
+func (p *Proxy) currentConfig() *config.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Config
+}
+
+// Atomically replaces the configuration used for new connections.
+func (p *Proxy) SetConfig(c *config.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Keep the global rate limiter state if its parameters did not change,
+	// so reloading doesn't reset it.
+	if old := p.Config; old != nil && old.RateLimit != nil && c.RateLimit != nil &&
+	   old.RateLimit.Rate == c.RateLimit.Rate && old.RateLimit.Burst == c.RateLimit.Burst {
+		c.RateLimit = old.RateLimit
+	}
+
+	// Connections accepted with the previous configuration can still look
+	// up its GeoIP database until their SNI is known: it is closed once they
+	// had time to send their handshake. Later lookups fail.
+	if old := p.Config; old != nil && old.GeoIP != nil && old.GeoIP != c.GeoIP {
+		time.AfterFunc(p.handshakeTimeout(), func() { old.GeoIP.Close() })
+	}
+	p.Config = c
+
+	if p.checking {
+		p.restartHealthChecks()
+	}
+}
+
+// Reads a configuration file and, if valid, swaps it with the current one.
+// On error the current configuration is kept.
+func (p *Proxy) Reload(file string) error {
+	c := &config.Config{}
+	if err := c.ReadFile(file); err != nil {
+		return err
+	}
+
+	p.SetConfig(c)
 	return nil
 }
 
 // Dispatch a net.Conn. This cannot fail.
 func (conn *Conn) dispatch() {
-	defer conn.Close()
 	client := conn.RemoteAddr().(*net.TCPAddr).IP
 
+	// Log the connection once it's done.
+	entry := &AccessEntry{
+		Client: client.String(),
+		Start: time.Now(),
+		Reason: "closed",
+	}
+	// Denied connections can be held open for a while, to slow scanners
+	// down.
+	defer func() {
+		if tarpitReason(entry.Reason) && conn.tarpit.hold(conn.TCPConn) {
+			return
+		}
+		conn.Close()
+	}()
+	// Routes can disable access logging.
+	logAccess := true
+	defer func() {
+		entry.Duration = time.Since(entry.Start)
+		conn.metrics.ConnClosed(entry.Duration)
+		routeStats.record(entry)
+		conn.tracer.trace(entry)
+		if !logAccess {
+			return
+		}
+		conn.logger.LogAccess(entry)
+	}()
+
 	// Set a deadline for reading the TLS handshake.
-	if err := conn.SetReadDeadline(time.Now().Add(3*time.Second)); err != nil {
+	if err := conn.SetReadDeadline(time.Now().Add(conn.handshakeTimeout)); err != nil {
 		conn.alert(tlsInternalError)
 		conn.logf("Could not set a read deadline (%s)", err)
+		entry.Reason = "internal error"
 		return
 	}
 
-	var buf bytes.Buffer
-	sni, acme, err := extractInfo(io.TeeReader(conn, &buf))
+	// Read the inbound PROXY header, and use the addresses it conveys.
+	if conn.Config.AcceptProxy {
+		src, dst, err := readProxyHeader(conn.TCPConn)
+		if err != nil {
+			conn.log(err)
+			entry.Reason = "invalid proxy header"
+			if isTimeout(err) {
+				entry.Reason = "handshake timeout"
+			}
+			return
+		}
+		if src != nil {
+			conn.remote, conn.local = src, dst
+			client = src.IP
+			entry.Client = client.String()
+		}
+
+		if limiter := conn.Config.RateLimit; limiter != nil && !limiter.Allow(client) {
+			conn.metrics.RateLimited()
+			entry.Reason = "rate limited"
+			return
+		}
+	}
+
+	if max := conn.Config.MaxConnsPerIP; max > 0 {
+		if !conn.perIP.acquire(client, max) {
+			conn.metrics.ConnsLimited()
+			entry.Reason = "too many connections"
+			return
+		}
+		defer conn.perIP.release(client)
+	}
+
+	// When a non-tls route is configured, plaintext connections are told
+	// apart by their first byte, which isn't a TLS handshake record type.
+	// The byte is replayed otherwise.
+	var hello io.Reader = &handshakeReader{ conn, conn.maxHandshake }
+	var first []byte
+	if conn.Config.NonTLS != nil {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(hello, b); err == nil {
+			first = b
+			hello = io.MultiReader(bytes.NewReader(first), hello)
+		}
+	}
+	nonTLS := len(first) > 0 && first[0] != recordTypeHandshake
+
+	var info *clienthello.Info
+	var peeked []byte
+	var err error
+	if nonTLS {
+		info, peeked = &clienthello.Info{}, first
+	} else {
+		info, peeked, err = clienthello.Parse(hello)
+	}
+	if err != nil && isTimeout(err) {
+		conn.log(err)
+		entry.Reason = "handshake timeout"
+		return
+	}
+	if errors.Is(err, errHandshakeTooLarge) {
+		conn.metrics.HandshakeTooLarge()
+		conn.logf("Handshake exceeds %d bytes", conn.maxHandshake)
+		entry.Reason = "handshake too large"
+		return
+	}
 	if err != nil {
+		conn.metrics.SNIFailed()
 		conn.alert(tlsInternalError)
 		conn.log(err)
+		entry.Reason = "invalid handshake"
 		return
 	}
+	acme := info.ACME()
+	if !nonTLS {
+		entry.SNI = info.SNI
+		entry.TLSVersion = info.VersionName()
+		conn.metrics.ClientVersion(entry.TLSVersion)
+		if info.Hello != nil {
+			entry.setHello(info.Hello)
+		}
+	}
 
 	// We found an SNI, reset the read deadline.
 	if err := conn.SetReadDeadline(time.Time{}); err != nil {
 		conn.alert(tlsInternalError)
 		conn.logf("Could not clear the read deadline (%s)", err)
+		entry.Reason = "internal error"
 		return
 	}
 
-	route, err := conn.Match(sni)
-	if err != nil {
-		conn.alert(tlsUnrecognizedName)
-		conn.log(err)
+	var debugf func(format string, v ...interface{})
+	if conn.debug {
+		debugf = conn.logf
+	}
+	// Routes are matched against the port of the listener, even when the
+	// client's destination is conveyed by a PROXY header.
+	port := conn.TCPConn.LocalAddr().(*net.TCPAddr).Port
+	var route *config.Route
+	var pattern, sni string
+	var rerr *routeError
+	if nonTLS {
+		route, pattern = conn.Config.NonTLS, "non-tls"
+	} else {
+		route, pattern, sni, rerr = matchRoute(conn.Config, info, port, debugf)
+	}
+	if rerr != nil {
+		if rerr.reason == "invalid sni" {
+			conn.metrics.InvalidSNI()
+		}
+		conn.rejectName()
+		conn.log(rerr)
+		entry.Reason = rerr.reason
+		return
+	}
+	conn.metrics.ConnRouted(pattern)
+	entry.Route = pattern
+	logAccess = route.Log
+
+	if route.Maintenance {
+		if !conn.silentReject {
+			conn.alert(tlsInternalError)
+		}
+		conn.logf("Route %q is in maintenance", pattern)
+		entry.Reason = "maintenance"
+		return
+	}
+
+	if route.RateLimit != nil && !route.RateLimit.Allow(client) {
+		conn.metrics.RateLimited()
+		entry.Reason = "rate limited"
+		return
+	}
+
+	// ACME challenges can be answered locally.
+	if acme && route.ACMESelf != nil {
+		allowed := route.AllowACME ||
+			   (checkACL(conn.Config, route, pattern, client, conn.metrics, debugf) &&
+			    route.AllowedJA3(entry.Fingerprint))
+		if !allowed {
+			conn.alert(tlsAccessDenied)
+			conn.logf("Denied %s / %s access to the ACME responder", client.String(), sni)
+			entry.Reason = "denied"
+			return
+		}
+		entry.Backend = "acme-self"
+		if err := route.ACMESelf.Serve(conn.TCPConn, peeked, sni); err != nil {
+			conn.log(err)
+			entry.Reason = "acme error"
+		}
 		return
 	}
 
 	// Choose backend.
-	backend := route.Backend
-	if acme && route.ACME != nil {
-		backend = route.ACME
+	backend := route.AcquireBackend(acme, client, info.ALPN)
+	if backend == nil {
+		conn.logf("No backend available for %s", sni)
+		entry.Reason = "no backend"
+		return
 	}
+	// The backend can change when retrying to connect.
+	defer func() {
+		if backend != nil {
+			backend.Release()
+		}
+	}()
+	entry.Backend = backend.Address
 
 	if acme && route.AllowACME {
 		goto bypassACLs
 	}
 
 	// Check if the client has the right to connect to a given backend.
-	if !clientAllowed(route, client) {
+	if !checkACL(conn.Config, route, pattern, client, conn.metrics, debugf) ||
+	   !route.AllowedJA3(entry.Fingerprint) {
 		conn.alert(tlsAccessDenied)
 		conn.logf("Denied %s / %s access to %s", client.String(), sni, backend.Address)
+		entry.Reason = "denied"
 		return
 	}
 
 bypassACLs:
-	host, port, err := net.SplitHostPort(backend.Address)
-	if len(host) == 0 {
-		host = sni
-	}
-	if err != nil {
+	// Connect to the backend, retrying as configured. The backend chosen
+	// for a new attempt can be a different one.
+	var upstream upstreamConn
+	for attempt := 0; ; attempt++ {
+		network, address := backend.DialAddress(sni)
+		up, err := conn.dial(network, address, backend)
+		if err == nil {
+			upstream = asUpstream(up)
+			break
+		}
+		conn.metrics.DialFailed()
 		conn.log(err)
-		return
-	}
-	upstream := func() *net.TCPConn {
-		up, err := net.DialTimeout("tcp", host+":"+port, 3*time.Second)
-		if err != nil {
-			conn.alert(tlsInternalError)
-			conn.log(err)
-			return nil
+
+		if attempt >= route.Retries {
+			break
 		}
-		return up.(*net.TCPConn)
-	}()
+		time.Sleep(time.Duration(attempt + 1) * retryBackoff)
+
+		backend.Release()
+		if backend = route.AcquireBackend(acme, client, info.ALPN); backend == nil {
+			break
+		}
+		entry.Backend = backend.Address
+	}
 	if upstream == nil {
+		conn.alert(tlsInternalError)
+		entry.Reason = "backend unreachable"
 		return
 	}
 	defer upstream.Close()
 
-	// Check if the HAProxy PROXY protocol header has to be sent.
+	// Check if the HAProxy PROXY protocol header has to be sent. Unless
+	// preserved, the addresses read from an inbound PROXY header are
+	// replaced by the immediate peer ones.
 	if backend.SendProxy != config.ProxyNone {
-		if err := proxyHeader(backend.SendProxy, conn, upstream); err != nil {
+		var client net.Conn = conn
+		if !conn.Config.ProxyPreserve {
+			client = conn.TCPConn
+		}
+		if err := proxyHeader(backend, client, upstream, info); err != nil {
 			log.Print(err)
+			entry.Reason = "backend error"
 			return
 		}
 	}
 
-	// Replay the handshake we read.
-	if _, err := io.Copy(upstream, &buf); err != nil {
-		conn.alert(tlsInternalError)
-		conn.logf("Failed to replay handshake to %s", backend.Address)
-		return
+	// Ends data is proxied between: the connections themselves, or TLS
+	// connections on top of them when re-encrypting. ACME challenges are
+	// always passed through.
+	var clientEnd, backendEnd net.Conn = conn.TCPConn, upstream
+	var replayed int64
+	if route.TLSBackend != nil && !acme {
+		front, back, err := reencrypt(conn.TCPConn, upstream, peeked, info.ALPN, sni,
+					      route.TLSBackend, conn.handshakeTimeout)
+		if err != nil {
+			conn.log(err)
+			entry.Reason = "tls error"
+			return
+		}
+		clientEnd, backendEnd = front, back
+	} else {
+		// Replay the handshake we read.
+		n, err := upstream.Write(peeked)
+		replayed = int64(n)
+		if err != nil {
+			conn.alert(tlsInternalError)
+			conn.logf("Failed to replay handshake to %s", backend.Address)
+			entry.Reason = "backend error"
+			return
+		}
+	}
+
+	// Readers used to proxy the data, closing idle connections if needed.
+	var fromClient, fromBackend io.Reader = clientEnd, backendEnd
+	if backend.IdleTimeout > 0 {
+		peers := []net.Conn{conn.TCPConn, upstream}
+		extendDeadlines(peers, backend.IdleTimeout)
+		fromClient = &idleReader{clientEnd, peers, backend.IdleTimeout}
+		fromBackend = &idleReader{backendEnd, peers, backend.IdleTimeout}
+	}
+	if route.RateBytes > 0 {
+		fromClient = newThrottledReader(fromClient, route.RateBytes)
+		fromBackend = newThrottledReader(fromBackend, route.RateBytes)
 	}
 
 	var wg sync.WaitGroup
+	var resIn, resOut copyResult
 	wg.Add(2)
 
 	go func () {
 		defer wg.Done()
-		if _, err := io.Copy(upstream, conn.TCPConn); err != nil {
-			conn.logf("Error copying to %s (%s): %s", conn.RemoteAddr(), sni, err)
+		n, err := copyBuffered(backendEnd, fromClient, conn.buffers)
+		resIn = classifyCopy(err, "client", "backend")
+		conn.copyDone(resIn, err, sni, backend.Address)
+		conn.metrics.BytesProxied(replayed + n, 0)
+		entry.BytesSent = replayed + n
+		if resIn.reason != copyEOF {
+			conn.abort(upstream)
+			return
 		}
-		upstream.CloseRead()
-		conn.CloseWrite()
+		// Propagate the half-close, the other direction keeps going.
+		closeWrite(backendEnd, upstream)
+		conn.CloseRead()
 	}()
 	go func () {
 		defer wg.Done()
-		if _, err := io.Copy(conn.TCPConn, upstream); err != nil {
-			conn.logf("Error copying to %s (%s): %s", backend.Address, sni, err)
+		n, err := copyBuffered(clientEnd, fromBackend, conn.buffers)
+		resOut = classifyCopy(err, "backend", "client")
+		conn.copyDone(resOut, err, sni, backend.Address)
+		conn.metrics.BytesProxied(0, n)
+		entry.BytesReceived = n
+		if resOut.reason != copyEOF {
+			conn.abort(upstream)
+			return
 		}
-		conn.CloseRead()
-		upstream.CloseWrite()
+		closeWrite(clientEnd, conn.TCPConn)
+		upstream.CloseRead()
 	}()
 
-	// Send keep alive messages to both the client and the backend.
-	conn.SetKeepAlive(true)
-	conn.SetKeepAlivePeriod(time.Minute)
-	upstream.SetKeepAlive(true)
-	upstream.SetKeepAlivePeriod(time.Minute)
+	// Send keep alive messages to both the client and the backend (if
+	// using TCP), and set TCP_NODELAY as configured.
+	peers := []*net.TCPConn{conn.TCPConn}
+	if up, ok := upstream.(*net.TCPConn); ok {
+		peers = append(peers, up)
+	}
+	for _, c := range(peers) {
+		c.SetNoDelay(route.NoDelay)
+		if conn.Config.KeepAlive == 0 {
+			c.SetKeepAlive(false)
+			continue
+		}
+		c.SetKeepAlive(true)
+		c.SetKeepAlivePeriod(conn.Config.KeepAlive)
+	}
+
+	// Close both ends of connections lasting too long, whatever their
+	// activity.
+	var expired atomic.Bool
+	if route.MaxDuration > 0 {
+		timer := time.AfterFunc(route.MaxDuration, func() {
+			expired.Store(true)
+			conn.abort(upstream)
+		})
+		defer timer.Stop()
+	}
 
 	conn.logf("Routing %s to %s", sni, backend.Address)
 
 	wg.Wait()
+	entry.Reason = closeReason(resIn, resOut)
+	if expired.Load() {
+		conn.logf("Maximum duration exceeded (%s)", sni)
+		entry.Reason = "max-duration exceeded"
+	}
+}
+
+// Reports why a connection could not be matched to a route.
+type routeError struct {
+	// Reason reported in access logs.
+	reason string
+	msg    string
+}
+
+func (e *routeError) Error() string {
+	return e.msg
+}
+
+// Checks a client against the allow/deny rules of a route matched using a given
+// pattern, for both TCP and QUIC connections, and accounts for the decision.
+// Denied clients are logged using debugf, if set.
+func checkACL(c *config.Config, route *config.Route, pattern string, client net.IP, m Metrics, debugf func(format string, v ...interface{})) bool {
+	decision := route.Check(client, c.GeoIP)
+	if decision == config.ACLNone {
+		return true
+	}
+	m.ACLDecision(pattern, decision)
+	if decision == config.ACLAllowed {
+		return true
+	}
+	if debugf != nil {
+		debugf("Client %s denied by the rules of %q (%s)", client, pattern, decision)
+	}
+	return false
+}
+
+// Finds the route of a connection given its ClientHello, for both TCP and QUIC
+// connections received on a given local port. Returns the route, the domain
+// pattern which matched and the SNI converted to ASCII. The patterns considered
+// are logged using debugf, if set.
+func matchRoute(c *config.Config, info *clienthello.Info, port int, debugf func(format string, v ...interface{})) (*config.Route, string, string, *routeError) {
+	// Connections without an SNI extension can't be matched to a route,
+	// use the no-sni one if configured.
+	if !info.HasSNI {
+		if c.NoSNI == nil {
+			return nil, "", "", &routeError{ "no sni", "No SNI extension in the handshake" }
+		}
+		return c.NoSNI, "no-sni", "", nil
+	}
+
+	sni, err := config.ToASCII(info.SNI)
+	if err != nil {
+		return nil, "", "", &routeError{ "invalid sni", fmt.Sprintf("Invalid SNI %q (%s)", info.SNI, err) }
+	}
+
+	var route *config.Route
+	var pattern string
+	if debugf == nil {
+		route, pattern, err = c.MatchPort(sni, info.ALPN, port)
+	} else {
+		var candidates []config.Candidate
+		route, pattern, candidates, err = c.MatchPortDebug(sni, info.ALPN, port)
+		debugf("Matching %s (alpn %v): considered %s, matched %q", sni, info.ALPN,
+		       formatCandidates(candidates), pattern)
+	}
+	if err != nil {
+		return nil, "", "", &routeError{ "no route", err.Error() }
+	}
+	return route, pattern, sni, nil
+}
+
+// Formats the patterns considered when matching a route, eg. "[*.example.net
+// (alpn), example.*]".
+func formatCandidates(candidates []config.Candidate) string {
+	var list []string
+	for _, c := range(candidates) {
+		if c.Skipped == "" {
+			list = append(list, c.Pattern)
+			continue
+		}
+		list = append(list, fmt.Sprintf("%s (%s)", c.Pattern, c.Skipped))
+	}
+	return "[" + strings.Join(list, ", ") + "]"
+}
+
+// Ways copying data in one direction of a proxied connection can end.
+const (
+	// The source closed its side of the connection.
+	copyEOF     = "eof"
+	// A peer reset the connection (or it was broken).
+	copyReset   = "reset"
+	// No data was received in time (see idle-timeout).
+	copyTimeout = "timeout"
+	// The connection was closed locally, e.g. when shutting down.
+	copyClosed  = "closed"
+	// Any other error.
+	copyError   = "error"
+)
+
+// How copying data in one direction ended, and the peer ("client" or
+// "backend") it is attributed to.
+type copyResult struct {
+	peer   string
+	reason string
+}
+
+// Classifies the error which ended copying data from src to dst, both naming a
+// peer. Errors are attributed to the peer being written to if writing failed,
+// to the source otherwise. Copies ending normally have a nil error.
+func classifyCopy(err error, src, dst string) copyResult {
+	res := copyResult{ src, copyEOF }
+	if err == nil {
+		return res
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "write" {
+		res.peer = dst
+	}
+
+	switch {
+	case isTimeout(err):
+		res.reason = copyTimeout
+		break
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		res.reason = copyReset
+		break
+	case errors.Is(err, net.ErrClosed):
+		res.reason = copyClosed
+		break
+	default:
+		res.reason = copyError
+	}
+	return res
+}
+
+// Logs and accounts for the end of one direction of the connection.
+func (conn *Conn) copyDone(res copyResult, err error, sni, backend string) {
+	conn.metrics.CopyEnded(res.peer, res.reason)
+
+	peer := res.peer
+	if peer == "backend" {
+		peer += " " + backend
+	}
+	switch (res.reason) {
+	case copyEOF, copyClosed:
+		return
+	case copyReset:
+		conn.logf("Connection reset by the %s (%s)", peer, sni)
+		break
+	case copyTimeout:
+		conn.logf("Idle timeout waiting for the %s (%s)", peer, sni)
+		break
+	default:
+		conn.logf("Error proxying data with the %s (%s): %s", peer, sni, err)
+	}
+}
+
+// Closes both ends of a broken connection, so proxying stops in the other
+// direction as well.
+func (conn *Conn) abort(upstream net.Conn) {
+	upstream.Close()
+	conn.TCPConn.Close()
+}
+
+// Returns why a proxied connection was closed, given how both directions
+// ended. Timeouts take precedence over resets, and resets over other errors.
+func closeReason(results ...copyResult) string {
+	reason := "closed"
+	for _, res := range(results) {
+		switch (res.reason) {
+		case copyTimeout:
+			return "idle timeout"
+		case copyReset:
+			reason = res.peer + " reset"
+			break
+		case copyClosed, copyError:
+			if reason == "closed" {
+				reason = "copy error"
+			}
+			break
+		}
+	}
+	return reason
+}
+
+// Connection to a backend, either over TCP or a Unix domain socket.
+type upstreamConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// Connection returned by a custom Dialer which can't be half-closed. Half-closes
+// aren't propagated, the connection being closed once both directions are over.
+type fullConn struct {
+	net.Conn
+}
+
+func (fullConn) CloseRead() error  { return nil }
+func (fullConn) CloseWrite() error { return nil }
+
+// Returns a connection to a backend as an upstreamConn.
+func asUpstream(c net.Conn) upstreamConn {
+	if up, ok := c.(upstreamConn); ok {
+		return up
+	}
+	return fullConn{ c }
 }
 
+// Reader extending the read deadline of both ends of a proxied connection each
+// time data is read, so connections idle in both directions get closed.
+type idleReader struct {
+	net.Conn
+	peers   []net.Conn
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		extendDeadlines(r.peers, r.timeout)
+	}
+	return n, err
+}
+
+// Reader limiting the throughput of another one, using a token bucket refilled
+// at a given number of bytes per second.
+type throttledReader struct {
+	io.Reader
+	limiter *rate.Limiter
+}
+
+// Returns a reader limited to bytesPerSec, allowing bursts of a tenth of a
+// second worth of data.
+func newThrottledReader(r io.Reader, bytesPerSec int) *throttledReader {
+	burst := max(bytesPerSec / 10, 1)
+	return &throttledReader{ r, rate.NewLimiter(rate.Limit(bytesPerSec), burst) }
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	// Never read more than what the bucket can hold.
+	if len(b) > r.limiter.Burst() {
+		b = b[:r.limiter.Burst()]
+	}
+
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		if werr := r.limiter.WaitN(context.Background(), n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// Sets the read deadline of connections to now + timeout.
+func extendDeadlines(conns []net.Conn, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, c := range(conns) {
+		c.SetReadDeadline(deadline)
+	}
+}
+
+// Reader failing with errHandshakeTooLarge once n bytes were read, used while
+// looking for a ClientHello.
+type handshakeReader struct {
+	r io.Reader
+	n int
+}
+
+func (h *handshakeReader) Read(b []byte) (int, error) {
+	if h.n <= 0 {
+		return 0, errHandshakeTooLarge
+	}
+	if len(b) > h.n {
+		b = b[:h.n]
+	}
+	n, err := h.r.Read(b)
+	h.n -= n
+	return n, err
+}
+
+// Reports whether an error is a timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// TLS record type of handshake messages.
+const recordTypeHandshake = 22
+
 // TLS alert message descriptions.
 const (
        tlsAccessDenied     = 49
@@ -191,6 +1385,14 @@ const (
        tlsUnrecognizedName = 112
 )
 
+// Sends an unrecognized_name alert, for connections whose SNI doesn't match any
+// route, unless disabled.
+func (conn *Conn) rejectName() {
+	if !conn.silentReject {
+		conn.alert(tlsUnrecognizedName)
+	}
+}
+
 // Sends an alert message with a fatal level to the remote.
 func (conn *Conn) alert(desc byte) {
 	// Craft an alert message (content type 21, TLS version 3.x, level: 2).
@@ -209,47 +1411,3 @@ func (conn *Conn) alert(desc byte) {
 		conn.logf("Failed to send an alert message (%s)", err)
 	}
 }
-
-// Matches a connection to a backend.
-func (conn *Conn) Match(sni string) (*config.Route, error) {
-	// Loop over each route described in the configuration.
-	for _, route := range conn.Config.Routes {
-		// Loop over each domain of a given route.
-		for _, domain := range route.Domains {
-			if domain.MatchString(sni) {
-				return route, nil
-			}
-		}
-	}
-
-	return nil, fmt.Errorf("No route matching the requested domain (%s)", sni)
-}
-
-// Check an IP against a route deny/allow rules.
-// The more specific subnet takes precedence, and Deny wins over Allow in case
-// none is more specific.
-func clientAllowed(route *config.Route, ip net.IP) bool {
-	// Check if filtering is enabled for the route.
-	if len(route.Allow) == 0 && len(route.Deny) == 0 {
-		return true
-	}
-
-	var cidr int = 0
-	for _, subnet := range(route.Allow) {
-		if subnet.Contains(ip) {
-			sz, _ := subnet.Mask.Size()
-			if sz > cidr {
-				cidr = sz
-			}
-		}
-	}
-	for _, subnet := range(route.Deny) {
-		if subnet.Contains(ip) {
-			sz, _ := subnet.Mask.Size()
-			if sz >= cidr {
-				return false
-			}
-		}
-	}
-	return true
-}
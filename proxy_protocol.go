@@ -17,27 +17,61 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/atenart/sniproxy/clienthello"
 	"github.com/atenart/sniproxy/config"
 )
 
+// PROXY protocol v2 TLV types.
+const (
+	pp2TypeALPN      = 0x01
+	pp2TypeAuthority = 0x02
+	pp2TypeSSL       = 0x20
+)
+
+// PROXY protocol v2 SSL TLV sub-types and client flags.
+const (
+	pp2SubtypeSSLVersion = 0x21
+	pp2ClientSSL         = 0x01
+)
+
+// PROXY protocol v2 signature.
+var proxyV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
 // Handles sending an HAProxy PROXY header to a backend.
-func proxyHeader(version uint, client, upstream net.Conn) error {
+func proxyHeader(backend *config.Backend, client, upstream net.Conn, info *clienthello.Info) error {
 	var header bytes.Buffer
 
 	// Retrieve the PROXY header to be sent.
-	switch (version) {
+	switch (backend.SendProxy) {
 	case config.ProxyV1:
-		header = proxyHeaderV1(client)
+		header = proxyHeaderV1(client, backend.ProxyDest)
 		break
 	case config.ProxyV2:
-		header = proxyHeaderV2(client)
+		tlvs := proxyTLVs(backend.SendProxyTLVs, info)
+		if backend.SendProxySSL {
+			tlvs = append(tlvs, proxySSLTLV(info)...)
+			// The SSL TLV has no SNI sub-type, the authority TLV
+			// carries it.
+			if !slices.Contains(backend.SendProxyTLVs, pp2TypeAuthority) && len(info.SNI) > 0 {
+				tlvs = appendTLV(tlvs, pp2TypeAuthority, info.SNI)
+			}
+		}
+		for _, tag := range(backend.SendProxyTags) {
+			tlvs = appendTLV(tlvs, tag.Type, tag.Value)
+		}
+		header = proxyHeaderV2(client, backend.ProxyDest, tlvs)
 		break
 	default:
-		return fmt.Errorf("PROXY protocol version not supported (%d)", version)
+		return fmt.Errorf("PROXY protocol version not supported (%d)", backend.SendProxy)
 	}
 
 	// Send the PROXY header to the backend.
@@ -48,72 +82,299 @@ func proxyHeader(version uint, client, upstream net.Conn) error {
 	return nil
 }
 
-// Returns an HAProxy PROXY header (protocol v1).
-func proxyHeaderV1(conn net.Conn) bytes.Buffer {
-	client := conn.RemoteAddr().(*net.TCPAddr)
-	local := conn.LocalAddr().(*net.TCPAddr)
+// Returns the client and local TCP addresses of a connection, and whether both
+// are IPv4 addresses. Returns nil addresses if the connection isn't using TCP.
+// If dest isn't nil it is reported in place of the local address.
+func proxyAddrs(conn net.Conn, dest *net.TCPAddr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+	if dest != nil {
+		local = dest
+	}
 
-	inetProto := "TCP6"
-	if local.IP.To4() != nil {
-		inetProto = "TCP4"
+	// IPv4 clients connecting to an IPv6 socket are seen as using
+	// IPv4-mapped addresses, both are then reported as IPv4.
+	ipv4 := client.IP.To4() != nil && local.IP.To4() != nil
+	return client, local, ipv4
+}
+
+// Formats an IP address for an IPv6 PROXY v1 header, where IPv4 addresses must
+// be written as IPv4-mapped IPv6 addresses.
+func formatIPv6(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
 	}
+	return ip.String()
+}
 
+// Returns an HAProxy PROXY header (protocol v1).
+func proxyHeaderV1(conn net.Conn, dest *net.TCPAddr) bytes.Buffer {
 	var buf bytes.Buffer
-	buf.WriteString(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", inetProto,
-				    client.IP.String(), local.IP.String(),
-				    client.Port, local.Port))
+
+	client, local, ipv4 := proxyAddrs(conn, dest)
+	if client == nil {
+		buf.WriteString("PROXY UNKNOWN\r\n")
+		return buf
+	}
+
+	if ipv4 {
+		buf.WriteString(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n",
+					    client.IP.To4().String(), local.IP.To4().String(),
+					    client.Port, local.Port))
+	} else {
+		buf.WriteString(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n",
+					    formatIPv6(client.IP), formatIPv6(local.IP),
+					    client.Port, local.Port))
+	}
 	return buf
 }
 
-// Returns an HAProxy PROXY header (protocol v2).
+// Returns the TLVs to append to a PROXY header (protocol v2). TLVs for which no
+// information is available are omitted.
+func proxyTLVs(types []uint8, info *clienthello.Info) []byte {
+	var tlvs []byte
+	for _, t := range(types) {
+		var value string
+
+		switch (t) {
+		case pp2TypeAuthority:
+			value = info.SNI
+			break
+		// The protocol to be used isn't known as the handshake isn't
+		// over yet, use the client's preferred one.
+		case pp2TypeALPN:
+			if len(info.ALPN) > 0 {
+				value = info.ALPN[0]
+			}
+			break
+		}
+		if len(value) == 0 {
+			continue
+		}
+
+		tlvs = appendTLV(tlvs, t, value)
+	}
+	return tlvs
+}
+
+// Returns the SSL TLV describing the client's TLS handshake. Connections are
+// passed through, so no client certificate was sent (and none verified) as far
+// as the proxy knows.
+func proxySSLTLV(info *clienthello.Info) []byte {
+	value := []byte{ pp2ClientSSL, 0, 0, 0, 1 }
+	if version := sslVersion(info.Version); len(version) > 0 {
+		value = appendTLV(value, pp2SubtypeSSLVersion, version)
+	}
+	return appendTLV(nil, pp2TypeSSL, string(value))
+}
+
+// Returns the name of a TLS version as reported in SSL TLVs, eg. "TLSv1.3", or
+// an empty string if unknown.
+func sslVersion(version uint16) string {
+	switch (version) {
+	case tls.VersionSSL30:
+		return "SSLv3"
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return ""
+}
+
+// Appends a TLV to a list of encoded ones.
+func appendTLV(tlvs []byte, t uint8, value string) []byte {
+	tlvs = append(tlvs, t, byte(len(value) >> 8), byte(len(value)))
+	return append(tlvs, value...)
+}
+
+// Returns an HAProxy PROXY header (protocol v2), followed by optional TLVs.
+// The header always carries the client's TCP addresses, including when sent to
+// a Unix socket backend: the AF_UNIX family is never used.
 // See https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
-func proxyHeaderV2(conn net.Conn) bytes.Buffer {
-	client := conn.RemoteAddr().(*net.TCPAddr)
-	local := conn.LocalAddr().(*net.TCPAddr)
-	ipv4 := local.IP.To4() != nil
+func proxyHeaderV2(conn net.Conn, dest *net.TCPAddr, tlvs []byte) bytes.Buffer {
+	client, local, ipv4 := proxyAddrs(conn, dest)
 
 	var buf bytes.Buffer
 
 	// Protocol signature.
-	buf.Write([]byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a})
+	buf.Write(proxyV2Signature)
 
 	// Command. Must be \x2 followed by \x0 for 'local' or \x1 for 'proxy'.
 	buf.WriteByte(0x21)
 
 	// Transport protocol and address family. The highest 4 bits represent
-	// the address family (0x1: AF_INET, 0x2: AF_INET6) and the lowest 4
-	// bits the protocol (0x1: SOCK_STREAM).
-	// The address family part is set at the begining of the function.
-	if ipv4 {
+	// the address family (0x0: AF_UNSPEC, 0x1: AF_INET, 0x2: AF_INET6) and
+	// the lowest 4 bits the protocol (0x0: UNSPEC, 0x1: SOCK_STREAM).
+	var addrLen int
+	if client == nil {
+		buf.WriteByte(0x00)
+	} else if ipv4 {
 		buf.WriteByte(0x11)
+		addrLen = 12
 	} else {
 		buf.WriteByte(0x21)
+		addrLen = 36
 	}
 
 	tmp := make([]byte, 2)
 
-	// Address length.
-	if ipv4 {
-		binary.BigEndian.PutUint16(tmp, 12)
-	} else {
-		binary.BigEndian.PutUint16(tmp, 36)
-	}
+	// Address and TLVs length.
+	binary.BigEndian.PutUint16(tmp, uint16(addrLen + len(tlvs)))
 	buf.Write(tmp)
 
-	// Addresses (client, local).
-	if ipv4 {
-		buf.Write(client.IP.To4())
-		buf.Write(local.IP.To4())
-	} else {
-		buf.Write(client.IP.To16())
-		buf.Write(local.IP.To16())
+	// Unknown addresses are omitted, the receiver must ignore them.
+	if client != nil {
+		// Addresses (client, local).
+		if ipv4 {
+			buf.Write(client.IP.To4())
+			buf.Write(local.IP.To4())
+		} else {
+			buf.Write(client.IP.To16())
+			buf.Write(local.IP.To16())
+		}
+
+		// TCP ports (client, local).
+		binary.BigEndian.PutUint16(tmp, uint16(client.Port))
+		buf.Write(tmp)
+		binary.BigEndian.PutUint16(tmp, uint16(local.Port))
+		buf.Write(tmp)
 	}
 
-	// TCP ports (client, local).
-	binary.BigEndian.PutUint16(tmp, uint16(client.Port))
-	buf.Write(tmp)
-	binary.BigEndian.PutUint16(tmp, uint16(local.Port))
-	buf.Write(tmp)
+	buf.Write(tlvs)
 
 	return buf
 }
+
+// Reads an HAProxy PROXY header (protocol v1 or v2) and returns the source and
+// destination addresses it conveys. Nil addresses are returned if the header
+// doesn't convey TCP addresses (LOCAL command, UNKNOWN or unsupported family),
+// in which case the connection's own addresses should be used. Nothing is read
+// past the header.
+func readProxyHeader(r io.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	// Both the v2 signature and the shortest v1 header are at least 12
+	// bytes long.
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, fmt.Errorf("Could not read the PROXY header (%w)", err)
+	}
+
+	if bytes.Equal(b, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return readProxyHeaderV1(r, b)
+	}
+	return nil, nil, fmt.Errorf("Invalid PROXY header signature")
+}
+
+// Reads the rest of an HAProxy PROXY header (protocol v1), which starts with
+// the bytes already read.
+func readProxyHeaderV1(r io.Reader, b []byte) (*net.TCPAddr, *net.TCPAddr, error) {
+	// Read byte by byte, not to consume data past the header. Headers
+	// are at most 107 bytes long, including the CRLF.
+	c := make([]byte, 1)
+	for !bytes.HasSuffix(b, []byte("\r\n")) {
+		if len(b) >= 107 {
+			return nil, nil, fmt.Errorf("PROXY v1 header is too long")
+		}
+		if _, err := io.ReadFull(r, c); err != nil {
+			return nil, nil, fmt.Errorf("Could not read the PROXY header (%w)", err)
+		}
+		b = append(b, c[0])
+	}
+
+	fields := strings.Split(string(b[:len(b)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("Invalid PROXY v1 header")
+	}
+
+	src, err := parseProxyAddr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// Parses an address and a port from a PROXY v1 header.
+func parseProxyAddr(addr, port string, ipv4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil || (ip.To4() != nil) != ipv4 {
+		return nil, fmt.Errorf("Invalid PROXY v1 address %q", addr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PROXY v1 port %q", port)
+	}
+	return &net.TCPAddr{ IP: ip, Port: int(p) }, nil
+}
+
+// Reads the rest of an HAProxy PROXY header (protocol v2), after its signature.
+func readProxyHeaderV2(r io.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	var header struct {
+		VersionCommand uint8
+		Family         uint8
+		Length         uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, nil, fmt.Errorf("Could not read the PROXY header (%w)", err)
+	}
+	if header.VersionCommand >> 4 != 2 || header.VersionCommand & 0xf > 1 {
+		return nil, nil, fmt.Errorf("Invalid PROXY v2 version and command (%#x)", header.VersionCommand)
+	}
+
+	// Addresses and TLVs. TLVs are ignored.
+	b := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, fmt.Errorf("Could not read the PROXY header (%s)", err)
+	}
+
+	// LOCAL command, the connection was not proxied.
+	if header.VersionCommand & 0xf == 0 {
+		return nil, nil, nil
+	}
+
+	var ipLen int
+	switch (header.Family) {
+	// TCP over IPv4.
+	case 0x11:
+		ipLen = 4
+		break
+	// TCP over IPv6.
+	case 0x21:
+		ipLen = 16
+		break
+	default:
+		return nil, nil, nil
+	}
+	if len(b) < 2 * ipLen + 4 {
+		return nil, nil, fmt.Errorf("PROXY v2 header is too short")
+	}
+
+	src := &net.TCPAddr{
+		IP: net.IP(b[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(b[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP: net.IP(b[ipLen:2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(b[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,683 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/clienthello"
+	"github.com/atenart/sniproxy/config"
+)
+
+// A net.Conn only providing its addresses.
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func newAddrConn(client, local string) *addrConn {
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", client)
+	localAddr, _ := net.ResolveTCPAddr("tcp", local)
+	return &addrConn{ local: localAddr, remote: remoteAddr }
+}
+
+// Decoded PROXY v2 header.
+type proxyV2 struct {
+	family        byte
+	client, local net.IP
+	cport, lport  uint16
+	tlvs          map[byte]string
+}
+
+// Decodes a PROXY v2 header, only supporting TCP over IPv4 and IPv6 or unknown
+// families.
+func decodeProxyV2(t *testing.T, b []byte) *proxyV2 {
+	sig := []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+	if len(b) < 16 || !bytes.Equal(b[:12], sig) {
+		t.Fatalf("Invalid PROXY v2 signature")
+	}
+	if b[12] != 0x21 {
+		t.Fatalf("Invalid PROXY v2 command (%#x)", b[12])
+	}
+
+	h := &proxyV2{ family: b[13], tlvs: make(map[byte]string) }
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	b = b[16:]
+	if len(b) != length {
+		t.Fatalf("Wrong PROXY v2 length: got %d, wanted %d", length, len(b))
+	}
+
+	var ipLen int
+	switch h.family {
+	case 0x00:
+		break
+	case 0x11:
+		ipLen = 4
+	case 0x21:
+		ipLen = 16
+	default:
+		t.Fatalf("Unsupported PROXY v2 family (%#x)", h.family)
+	}
+
+	if ipLen > 0 {
+		if len(b) < 2*ipLen + 4 {
+			t.Fatalf("PROXY v2 address block is too short")
+		}
+		h.client = net.IP(b[:ipLen])
+		h.local = net.IP(b[ipLen:2*ipLen])
+		h.cport = binary.BigEndian.Uint16(b[2*ipLen:])
+		h.lport = binary.BigEndian.Uint16(b[2*ipLen+2:])
+		b = b[2*ipLen+4:]
+	}
+
+	for len(b) > 0 {
+		if len(b) < 3 {
+			t.Fatalf("Truncated TLV header")
+		}
+		l := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b[3:]) < l {
+			t.Fatalf("Truncated TLV value")
+		}
+		h.tlvs[b[0]] = string(b[3:3+l])
+		b = b[3+l:]
+	}
+
+	return h
+}
+
+func TestProxyHeaderV2TLVs(t *testing.T) {
+	tests := []struct {
+		desc string
+		tlvs []uint8
+		info *clienthello.Info
+		want map[byte]string
+	}{
+		{
+			"No TLV",
+			nil,
+			&clienthello.Info{ SNI: "example.net", ALPN: []string{"h2"} },
+			map[byte]string{},
+		},
+		{
+			"Authority",
+			[]uint8{config.ProxyTLVAuthority},
+			&clienthello.Info{ SNI: "example.net", ALPN: []string{"h2"} },
+			map[byte]string{ 0x02: "example.net" },
+		},
+		{
+			"Authority and ALPN",
+			[]uint8{config.ProxyTLVAuthority, config.ProxyTLVALPN},
+			&clienthello.Info{ SNI: "example.net", ALPN: []string{"h2", "http/1.1"} },
+			map[byte]string{ 0x01: "h2", 0x02: "example.net" },
+		},
+		{
+			"No information available",
+			[]uint8{config.ProxyTLVAuthority, config.ProxyTLVALPN},
+			&clienthello.Info{},
+			map[byte]string{},
+		},
+	}
+
+	conn := newAddrConn("192.168.0.1:4242", "10.0.0.1:443")
+	for _, test := range(tests) {
+		header := proxyHeaderV2(conn, nil, proxyTLVs(test.tlvs, test.info))
+		h := decodeProxyV2(t, header.Bytes())
+
+		if h.family != 0x11 || !h.client.Equal(net.ParseIP("192.168.0.1")) ||
+		   !h.local.Equal(net.ParseIP("10.0.0.1")) || h.cport != 4242 || h.lport != 443 {
+			t.Errorf("%s: wrong address block", test.desc)
+		}
+		if len(h.tlvs) != len(test.want) {
+			t.Errorf("%s: wrong number of TLVs: got %d, wanted %d", test.desc, len(h.tlvs), len(test.want))
+		}
+		for typ, val := range(test.want) {
+			if h.tlvs[typ] != val {
+				t.Errorf("%s: wrong TLV %#x: got %q, wanted %q", test.desc, typ, h.tlvs[typ], val)
+			}
+		}
+	}
+}
+
+func TestProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		desc string
+		conn net.Conn
+		out  string
+	}{
+		{
+			"IPv4",
+			newAddrConn("192.168.0.1:4242", "10.0.0.1:443"),
+			"PROXY TCP4 192.168.0.1 10.0.0.1 4242 443\r\n",
+		},
+		{
+			"IPv6",
+			newAddrConn("[2001:db8::1]:4242", "[2001:db8::2]:443"),
+			"PROXY TCP6 2001:db8::1 2001:db8::2 4242 443\r\n",
+		},
+		{
+			"IPv4 client on a dual-stack socket",
+			newAddrConn("[::ffff:192.168.0.1]:4242", "[::ffff:10.0.0.1]:443"),
+			"PROXY TCP4 192.168.0.1 10.0.0.1 4242 443\r\n",
+		},
+		{
+			"Mixed families",
+			newAddrConn("192.168.0.1:4242", "[2001:db8::2]:443"),
+			"PROXY TCP6 ::ffff:192.168.0.1 2001:db8::2 4242 443\r\n",
+		},
+		{
+			"Unknown family",
+			&addrConn{ local: &net.UnixAddr{}, remote: &net.UnixAddr{} },
+			"PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for _, test := range(tests) {
+		header := proxyHeaderV1(test.conn, nil)
+		if header.String() != test.out {
+			t.Errorf("%s: got %q, wanted %q", test.desc, header.String(), test.out)
+		}
+	}
+}
+
+func TestProxyHeaderV2Families(t *testing.T) {
+	tests := []struct {
+		desc          string
+		conn          net.Conn
+		family        byte
+		client, local string
+	}{
+		{
+			"IPv4",
+			newAddrConn("192.168.0.1:4242", "10.0.0.1:443"),
+			0x11,
+			"192.168.0.1",
+			"10.0.0.1",
+		},
+		{
+			"IPv6",
+			newAddrConn("[2001:db8::1]:4242", "[2001:db8::2]:443"),
+			0x21,
+			"2001:db8::1",
+			"2001:db8::2",
+		},
+		{
+			"IPv4 client on a dual-stack socket",
+			newAddrConn("[::ffff:192.168.0.1]:4242", "[::ffff:10.0.0.1]:443"),
+			0x11,
+			"192.168.0.1",
+			"10.0.0.1",
+		},
+		{
+			"Mixed families",
+			newAddrConn("192.168.0.1:4242", "[2001:db8::2]:443"),
+			0x21,
+			"::ffff:192.168.0.1",
+			"2001:db8::2",
+		},
+	}
+
+	for _, test := range(tests) {
+		header := proxyHeaderV2(test.conn, nil, nil)
+		h := decodeProxyV2(t, header.Bytes())
+
+		if h.family != test.family {
+			t.Errorf("%s: wrong family: got %#x, wanted %#x", test.desc, h.family, test.family)
+		}
+		if !h.client.Equal(net.ParseIP(test.client)) || !h.local.Equal(net.ParseIP(test.local)) ||
+		   h.cport != 4242 || h.lport != 443 {
+			t.Errorf("%s: wrong address block", test.desc)
+		}
+		if test.family == 0x21 && len(h.client) != 16 {
+			t.Errorf("%s: IPv6 addresses must be 16 bytes long", test.desc)
+		}
+	}
+
+	header := proxyHeaderV2(&addrConn{ local: &net.UnixAddr{}, remote: &net.UnixAddr{} }, nil, nil)
+	if h := decodeProxyV2(t, header.Bytes()); h.family != 0x00 || h.client != nil {
+		t.Errorf("Unknown family: wrong header")
+	}
+}
+
+func TestProxyHeaderDest(t *testing.T) {
+	conn := newAddrConn("192.168.0.1:4242", "10.0.0.1:443")
+	dest := &net.TCPAddr{ IP: net.ParseIP("203.0.113.1"), Port: 8443 }
+
+	v1 := proxyHeaderV1(conn, dest)
+	if v1.String() != "PROXY TCP4 192.168.0.1 203.0.113.1 4242 8443\r\n" {
+		t.Errorf("Wrong v1 header: %q", v1.String())
+	}
+
+	v2 := proxyHeaderV2(conn, dest, nil)
+	h := decodeProxyV2(t, v2.Bytes())
+	if h.family != 0x11 || !h.local.Equal(dest.IP) || h.lport != 8443 {
+		t.Errorf("Wrong v2 destination: %s:%d", h.local, h.lport)
+	}
+
+	// An IPv6 destination turns the header into an IPv6 one.
+	dest = &net.TCPAddr{ IP: net.ParseIP("2001:db8::2"), Port: 443 }
+	v1 = proxyHeaderV1(conn, dest)
+	if v1.String() != "PROXY TCP6 ::ffff:192.168.0.1 2001:db8::2 4242 443\r\n" {
+		t.Errorf("Wrong v1 header: %q", v1.String())
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v1 := proxyHeaderV1(newAddrConn("[2001:db8::1]:4242", "[2001:db8::2]:443"), nil)
+	v2 := proxyHeaderV2(newAddrConn("192.168.0.1:4242", "10.0.0.1:443"), nil, []byte{0x02, 0, 1, 'a'})
+
+	tests := []struct {
+		desc    string
+		in      []byte
+		src     string
+		dst     string
+		success bool
+	}{
+		{
+			"PROXY v1, TCP4",
+			[]byte("PROXY TCP4 192.168.0.1 10.0.0.1 4242 443\r\n"),
+			"192.168.0.1:4242",
+			"10.0.0.1:443",
+			true,
+		},
+		{
+			"PROXY v1, TCP6",
+			v1.Bytes(),
+			"[2001:db8::1]:4242",
+			"[2001:db8::2]:443",
+			true,
+		},
+		{
+			"PROXY v1, UNKNOWN",
+			[]byte("PROXY UNKNOWN\r\n"),
+			"",
+			"",
+			true,
+		},
+		{
+			"PROXY v2, TCP over IPv4 with TLVs",
+			v2.Bytes(),
+			"192.168.0.1:4242",
+			"10.0.0.1:443",
+			true,
+		},
+		{
+			"PROXY v2, LOCAL command",
+			craft(proxyV2Signature, []byte{0x20, 0x11, 0, 12}, make([]byte, 12)),
+			"",
+			"",
+			true,
+		},
+		{
+			"PROXY v1, address family mismatch",
+			[]byte("PROXY TCP4 2001:db8::1 10.0.0.1 4242 443\r\n"),
+			"",
+			"",
+			false,
+		},
+		{
+			"PROXY v1, invalid port",
+			[]byte("PROXY TCP4 192.168.0.1 10.0.0.1 4242 65536\r\n"),
+			"",
+			"",
+			false,
+		},
+		{
+			"PROXY v1, missing CRLF",
+			[]byte("PROXY TCP4 192.168.0.1 10.0.0.1 4242 443"),
+			"",
+			"",
+			false,
+		},
+		{
+			"PROXY v2, wrong version",
+			craft(proxyV2Signature, []byte{0x11, 0x11, 0, 12}, make([]byte, 12)),
+			"",
+			"",
+			false,
+		},
+		{
+			"PROXY v2, truncated addresses",
+			craft(proxyV2Signature, []byte{0x21, 0x11, 0, 8}, make([]byte, 8)),
+			"",
+			"",
+			false,
+		},
+		{
+			"TLS handshake",
+			[]byte{22, 3, 1, 0, 0, 1, 0, 0, 0, 3, 3, 0},
+			"",
+			"",
+			false,
+		},
+	}
+
+	for _, test := range(tests) {
+		// Data following the header must not be consumed.
+		r := bytes.NewBuffer(craft(test.in, []byte("hello")))
+		src, dst, err := readProxyHeader(r)
+		if (test.success && (err != nil)) || (!test.success && (err == nil)) {
+			t.Errorf("%s: unexpected result (%v)", test.desc, err)
+			continue
+		}
+		if !test.success {
+			continue
+		}
+
+		if addrString(src) != test.src || addrString(dst) != test.dst {
+			t.Errorf("%s: got %s -> %s, wanted %s -> %s", test.desc,
+				 addrString(src), addrString(dst), test.src, test.dst)
+		}
+		if r.String() != "hello" {
+			t.Errorf("%s: data past the header was consumed", test.desc)
+		}
+	}
+}
+
+func addrString(addr *net.TCPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func craft(bs ...[]byte) []byte {
+	var packet []byte
+	for _, b := range(bs) {
+		packet = append(packet, b...)
+	}
+	return packet
+}
+
+// A net.Conn recording the data written to it.
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
+
+func TestProxyHeaderTags(t *testing.T) {
+	backend := &config.Backend{
+		SendProxy: config.ProxyV2,
+		SendProxyTLVs: []uint8{config.ProxyTLVAuthority},
+		SendProxyTags: []config.ProxyTag{ { Type: 0xe0, Value: "tier1" }, { Type: 0xe1 } },
+	}
+	upstream := &recordConn{}
+	conn := newAddrConn("192.168.0.1:4242", "10.0.0.1:443")
+	if err := proxyHeader(backend, conn, upstream, &clienthello.Info{ SNI: "example.net" }); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	h := decodeProxyV2(t, upstream.buf.Bytes())
+	if len(h.tlvs) != 3 || h.tlvs[0x02] != "example.net" || h.tlvs[0xe0] != "tier1" {
+		t.Errorf("Wrong TLVs: %v", h.tlvs)
+	}
+	if v, ok := h.tlvs[0xe1]; !ok || v != "" {
+		t.Errorf("Empty tag was not sent")
+	}
+}
+
+func TestProxyHeaderSSL(t *testing.T) {
+	tests := []struct {
+		desc string
+		tlvs []uint8
+		info *clienthello.Info
+		ssl  []byte
+		sni  string
+	}{
+		{
+			"TLS 1.3",
+			nil,
+			&clienthello.Info{ SNI: "example.net", Version: 0x0304 },
+			craft([]byte{ 0x01, 0, 0, 0, 1, 0x21, 0, 7 }, []byte("TLSv1.3")),
+			"example.net",
+		},
+		{
+			"Authority TLV already sent",
+			[]uint8{ config.ProxyTLVAuthority },
+			&clienthello.Info{ SNI: "example.net", Version: 0x0303 },
+			craft([]byte{ 0x01, 0, 0, 0, 1, 0x21, 0, 7 }, []byte("TLSv1.2")),
+			"example.net",
+		},
+		{
+			"Unknown version, no SNI",
+			nil,
+			&clienthello.Info{ Version: 0x0305 },
+			[]byte{ 0x01, 0, 0, 0, 1 },
+			"",
+		},
+	}
+	for _, test := range(tests) {
+		backend := &config.Backend{ SendProxy: config.ProxyV2, SendProxyTLVs: test.tlvs, SendProxySSL: true }
+		upstream := &recordConn{}
+		conn := newAddrConn("192.168.0.1:4242", "10.0.0.1:443")
+		if err := proxyHeader(backend, conn, upstream, test.info); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		h := decodeProxyV2(t, upstream.buf.Bytes())
+		if ssl := h.tlvs[0x20]; ssl != string(test.ssl) {
+			t.Errorf("%s: wrong SSL TLV: %x, wanted %x", test.desc, ssl, test.ssl)
+		}
+		if sni, ok := h.tlvs[0x02]; sni != test.sni || ok != (test.sni != "") {
+			t.Errorf("%s: wrong authority TLV: %q", test.desc, sni)
+		}
+		// The authority TLV is sent once.
+		if n := bytes.Count(upstream.buf.Bytes(), []byte("example.net")); n > 1 {
+			t.Errorf("%s: authority sent %d times", test.desc, n)
+		}
+	}
+}
+
+// Starts a backend reading the PROXY header of the connections it receives,
+// and reporting its version and the client address it conveys.
+func startProxyBackend(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	headers := make(chan string, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			first := make([]byte, 1)
+			if _, err := io.ReadFull(c, first); err != nil {
+				headers <- err.Error()
+				c.Close()
+				continue
+			}
+			version := "v1"
+			if first[0] == proxyV2Signature[0] {
+				version = "v2"
+			}
+			src, _, err := readProxyHeader(io.MultiReader(bytes.NewReader(first), c))
+			if err != nil {
+				headers <- err.Error()
+			} else {
+				headers <- version + " " + src.String()
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().String(), headers
+}
+
+func TestProxyPreserve(t *testing.T) {
+	backend, headers := startProxyBackend(t)
+	inV1 := []byte("PROXY TCP4 192.0.2.1 192.0.2.2 4242 443\r\n")
+	v2 := proxyHeaderV2(newAddrConn("192.0.2.1:4242", "192.0.2.2:443"), nil, nil)
+	inV2 := v2.Bytes()
+
+	tests := []struct {
+		desc      string
+		in        []byte
+		sendProxy string
+		preserve  string
+		out       string
+	}{
+		{ "v1 to v1, preserved", inV1, "send-proxy", "on", "v1 192.0.2.1:4242" },
+		{ "v1 to v2, preserved", inV1, "send-proxy-v2", "on", "v2 192.0.2.1:4242" },
+		{ "v2 to v1, preserved", inV2, "send-proxy", "on", "v1 192.0.2.1:4242" },
+		{ "v2 to v2, preserved", inV2, "send-proxy-v2", "on", "v2 192.0.2.1:4242" },
+		{ "v1 to v1, rewritten", inV1, "send-proxy", "off", "v1 " },
+		{ "v1 to v2, rewritten", inV1, "send-proxy-v2", "off", "v2 " },
+		{ "v2 to v1, rewritten", inV2, "send-proxy", "off", "v1 " },
+		{ "v2 to v2, rewritten", inV2, "send-proxy-v2", "off", "v2 " },
+	}
+	for _, test := range(tests) {
+		conf := "accept-proxy\nproxy-preserve " + test.preserve + "\n" +
+			"example.net {\n\tbackend " + backend + " {\n\t\t" + test.sendProxy + "\n\t}\n}\n"
+		c := startProxy(t, &Proxy{}, conf)
+		out := test.out
+		if test.preserve == "off" {
+			// The immediate peer is the test client itself.
+			out += c.LocalAddr().String()
+		}
+
+		_, hello := clientHello(t, "example.net")
+		c.Write(test.in)
+		c.Write(hello)
+
+		select {
+		case header := <-headers:
+			if header != out {
+				t.Errorf("%s: got %q, wanted %q", test.desc, header, out)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no connection to the backend", test.desc)
+		}
+	}
+}
+
+// Starts a SOCKS5 proxy supporting CONNECT without authentication, reporting the
+// addresses it was asked to connect to. Returns its address.
+func startSOCKS5(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	targets := make(chan string, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+
+				// Greeting, then a CONNECT request to an IPv4
+				// address or a domain.
+				b := make([]byte, 262)
+				if _, err := io.ReadFull(c, b[:2]); err != nil {
+					return
+				}
+				io.ReadFull(c, b[:b[1]])
+				c.Write([]byte{ 5, 0 })
+				if _, err := io.ReadFull(c, b[:4]); err != nil {
+					return
+				}
+				var host string
+				switch (b[3]) {
+				case 1:
+					io.ReadFull(c, b[:4])
+					host = net.IP(b[:4]).String()
+					break
+				case 3:
+					io.ReadFull(c, b[:1])
+					io.ReadFull(c, b[1:1+b[0]])
+					host = string(b[1:1+b[0]])
+					break
+				}
+				io.ReadFull(c, b[:2])
+				target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[:2]))))
+				targets <- target
+
+				up, err := net.Dial("tcp", target)
+				if err != nil {
+					c.Write([]byte{ 5, 5, 0, 1, 0, 0, 0, 0, 0, 0 })
+					return
+				}
+				defer up.Close()
+				c.Write([]byte{ 5, 0, 0, 1, 0, 0, 0, 0, 0, 0 })
+				go io.Copy(up, c)
+				io.Copy(c, up)
+			}()
+		}
+	}()
+	return l.Addr().String(), targets
+}
+
+func TestSOCKS5Backend(t *testing.T) {
+	backend, headers := startProxyBackend(t)
+	socks, targets := startSOCKS5(t)
+
+	conf := "example.net {\n\tbackend " + backend + " {\n\t\tsocks5 " + socks + "\n\t\tsend-proxy\n\t}\n}\n"
+	c := startProxy(t, &Proxy{}, conf)
+	_, hello := clientHello(t, "example.net")
+	c.Write(hello)
+
+	select {
+	case target := <-targets:
+		if target != backend {
+			t.Errorf("SOCKS5 proxy asked to connect to %s", target)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No connection to the SOCKS5 proxy")
+	}
+
+	// The PROXY header goes through the tunnel.
+	select {
+	case header := <-headers:
+		if want := "v1 " + c.LocalAddr().String(); header != want {
+			t.Errorf("Got %q, wanted %q", header, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("No connection to the backend")
+	}
+
+	// Connections through the SOCKS5 proxy are plain TCP ones, supporting
+	// half-closes and TCP options.
+	c2 := &config.Config{}
+	if err := c2.Read(strings.NewReader(conf)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	up, err := c2.Routes[0].Backends[0].Dial("tcp", backend)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer up.Close()
+	if _, ok := up.(*net.TCPConn); !ok {
+		t.Errorf("Wrong connection type %T", up)
+	}
+}
@@ -0,0 +1,979 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/atenart/sniproxy/clienthello"
+	"github.com/atenart/sniproxy/config"
+)
+
+// Returns the ClientHello sent by a Go TLS client, parsed and raw.
+func clientHello(t *testing.T, sni string, protos ...string) (*clienthello.Info, []byte) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{ ServerName: sni, NextProtos: protos }).Handshake()
+		client.Close()
+	}()
+
+	info, raw, err := clienthello.Parse(server)
+	if err != nil {
+		t.Fatalf("Could not parse the ClientHello (%s)", err)
+	}
+	return info, raw
+}
+
+func TestACMEBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sniproxy.conf")
+	os.WriteFile(path, []byte(`
+example.net {
+	backend 1.2.3.4:443
+	acme 1.2.3.5:443
+}
+example.com {
+	backend 1.2.3.6:443
+}
+`), 0644)
+	c := &config.Config{}
+	if err := c.ReadFile(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		desc    string
+		sni     string
+		protos  []string
+		backend string
+	}{
+		{ "ACME challenge", "example.net", []string{ "acme-tls/1" }, "1.2.3.5:443" },
+		{ "Regular connection", "example.net", []string{ "h2", "http/1.1" }, "1.2.3.4:443" },
+		{ "No ALPN", "example.net", nil, "1.2.3.4:443" },
+		{ "ACME challenge without ACME backend", "example.com", []string{ "acme-tls/1" }, "1.2.3.6:443" },
+	}
+	for _, test := range(tests) {
+		info, _ := clientHello(t, test.sni, test.protos...)
+		route, _, err := c.Match(info.SNI, info.ALPN)
+		if err != nil {
+			t.Errorf("%s: unexpected error (%s)", test.desc, err)
+			continue
+		}
+		backend := route.AcquireBackend(info.ACME(), nil, info.ALPN)
+		if backend == nil || backend.Address != test.backend {
+			t.Errorf("%s: wrong backend %v, wanted %s", test.desc, backend, test.backend)
+			continue
+		}
+		backend.Release()
+	}
+}
+
+// Starts a backend answering with the number of bytes received, once clients
+// are done sending data. Returns its address.
+func startBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				n, _ := io.Copy(io.Discard, c)
+				fmt.Fprintf(c, "received %d bytes", n)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Starts a proxy using a given configuration and returns a connection to it.
+func startProxy(t *testing.T, p *Proxy, conf string) net.Conn {
+	path := filepath.Join(t.TempDir(), "sniproxy.conf")
+	os.WriteFile(path, []byte(conf), 0644)
+	if p.AccessLog == nil {
+		p.AccessLog = NewTextLogger(io.Discard)
+	}
+	if err := p.Reload(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Find a free port for the proxy.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	go p.ListenAndServe(addr)
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+
+	var c net.Conn
+	for i := 0; i < 100; i++ {
+		if c, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Could not connect to the proxy (%s)", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Sends a ClientHello and a request through a proxy connection, half-closes
+// it and returns the response.
+func exchange(t *testing.T, c net.Conn, sni string) (string, int) {
+	_, hello := clientHello(t, sni)
+	c.Write(hello)
+	c.Write([]byte("request"))
+	c.(*net.TCPConn).CloseWrite()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, _ := io.ReadAll(c)
+	return string(resp), len(hello) + len("request")
+}
+
+func TestHalfClose(t *testing.T) {
+	backend := startBackend(t)
+	c := startProxy(t, &Proxy{}, "example.net {\n\tbackend " + backend + "\n}\n")
+
+	resp, n := exchange(t, c, "example.net")
+	if want := fmt.Sprintf("received %d bytes", n); resp != want {
+		t.Errorf("Wrong response after a half-close: %q, wanted %q", resp, want)
+	}
+}
+
+func TestFQDNSNI(t *testing.T) {
+	backend := startBackend(t)
+	c := startProxy(t, &Proxy{}, "example.net {\n\tbackend " + backend + "\n}\n")
+
+	// Go clients strip the trailing dot, craft it in a same length SNI.
+	_, hello := clientHello(t, "example.nett")
+	hello = bytes.Replace(hello, []byte("example.nett"), []byte("example.net."), 1)
+	c.Write(hello)
+	c.(*net.TCPConn).CloseWrite()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, _ := io.ReadAll(c)
+	if want := fmt.Sprintf("received %d bytes", len(hello)); string(resp) != want {
+		t.Errorf("Wrong response for a fully qualified SNI: %q, wanted %q", resp, want)
+	}
+}
+
+func TestNonTLS(t *testing.T) {
+	backend := startBackend(t)
+	_, hello := clientHello(t, "example.net")
+	request := []byte("GET / HTTP/1.0\r\n\r\n")
+
+	tests := []struct {
+		desc  string
+		in    []byte
+		route string
+	}{
+		{ "Plaintext", request, "non-tls" },
+		{ "TLS", hello, "example.net" },
+	}
+	for _, test := range(tests) {
+		entries := make(entryLogger, 1)
+		conf := "non-tls " + backend + "\nexample.net {\n\tbackend " + backend + "\n}\n"
+		c := startProxy(t, &Proxy{ AccessLog: entries }, conf)
+		c.Write(test.in)
+		c.(*net.TCPConn).CloseWrite()
+
+		// The whole data is received by the backend.
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, _ := io.ReadAll(c)
+		if want := fmt.Sprintf("received %d bytes", len(test.in)); string(resp) != want {
+			t.Errorf("%s: wrong response %q, wanted %q", test.desc, resp, want)
+		}
+		select {
+		case e := <-entries:
+			if e.Route != test.route {
+				t.Errorf("%s: wrong route %q, wanted %q", test.desc, e.Route, test.route)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no access log entry", test.desc)
+		}
+	}
+}
+
+// Access logger handing entries over a channel.
+type entryLogger chan *AccessEntry
+
+func (l entryLogger) LogAccess(e *AccessEntry) { l <- e }
+
+func TestHandshakeTimeout(t *testing.T) {
+	entries := make(entryLogger, 1)
+	p := &Proxy{ AccessLog: entries, HandshakeTimeout: 100 * time.Millisecond }
+	c := startProxy(t, p, "example.net {\n\tbackend 192.0.2.1:443\n}\n")
+
+	// The client connects but never sends anything.
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Errorf("Connection was not closed (%s)", err)
+	}
+
+	select {
+	case e := <-entries:
+		if e.Reason != "handshake timeout" {
+			t.Errorf("Wrong reason: %q", e.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("No access log entry")
+	}
+}
+
+func TestMaxHandshakeBytes(t *testing.T) {
+	backend := startBackend(t)
+	_, hello := clientHello(t, "example.net")
+
+	tests := []struct {
+		desc   string
+		max    int
+		reason string
+	}{
+		{ "Fits", len(hello), "closed" },
+		{ "Too large", len(hello) - 1, "handshake too large" },
+	}
+	for _, test := range(tests) {
+		entries := make(entryLogger, 1)
+		p := &Proxy{ AccessLog: entries, MaxHandshakeBytes: test.max }
+		c := startProxy(t, p, "example.net {\n\tbackend " + backend + "\n}\n")
+		exchange(t, c, "example.net")
+
+		select {
+		case e := <-entries:
+			if e.Reason != test.reason {
+				t.Errorf("%s: wrong reason %q, wanted %q", test.desc, e.Reason, test.reason)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no access log entry", test.desc)
+		}
+	}
+}
+
+func TestRejectAlert(t *testing.T) {
+	tests := []struct {
+		desc   string
+		silent bool
+		out    string
+	}{
+		{ "Alert", false, string([]byte{ 21, 3, 0, 0, 2, 2, tlsUnrecognizedName }) },
+		{ "Silent", true, "" },
+	}
+
+	for _, tt := range(tests) {
+		c := startProxy(t, &Proxy{ SilentReject: tt.silent }, "example.net {\n\tbackend 192.0.2.1:443\n}\n")
+		if resp, _ := exchange(t, c, "unknown.example.org"); resp != tt.out {
+			t.Errorf("%s: got %q, wanted %q", tt.desc, resp, tt.out)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	backend := startBackend(t)
+	alert := string([]byte{ 21, 3, 0, 0, 2, 2, tlsInternalError })
+
+	tests := []struct {
+		desc   string
+		conf   string
+		silent bool
+		out    string
+		reason string
+	}{
+		{ "Maintenance", "\tmaintenance\n", false, alert, "maintenance" },
+		{ "Maintenance without alert", "\tmaintenance on\n", true, "", "maintenance" },
+		{ "Maintenance off", "\tmaintenance off\n", false, "received", "closed" },
+	}
+
+	for _, tt := range(tests) {
+		entries := make(entryLogger, 1)
+		p := &Proxy{ AccessLog: entries, SilentReject: tt.silent }
+		c := startProxy(t, p, "example.net {\n\tbackend " + backend + "\n" + tt.conf + "}\n")
+		if resp, _ := exchange(t, c, "example.net"); !strings.HasPrefix(resp, tt.out) || (tt.out == "" && resp != "") {
+			t.Errorf("%s: got %q, wanted %q", tt.desc, resp, tt.out)
+		}
+		if e := <-entries; e.Reason != tt.reason {
+			t.Errorf("%s: wrong reason %q", tt.desc, e.Reason)
+		}
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	backend := startBackend(t)
+	entries := make(entryLogger, 1)
+	p := &Proxy{ AccessLog: entries }
+	c := startProxy(t, p, "example.net {\n\tbackend " + backend + "\n\tmax-duration 200ms\n}\n")
+
+	// The client never closes its side, the backend waits forever.
+	_, hello := clientHello(t, "example.net")
+	c.Write(hello)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Errorf("Connection was not closed (%s)", err)
+	}
+	if e := <-entries; e.Reason != "max-duration exceeded" {
+		t.Errorf("Wrong reason %q", e.Reason)
+	}
+
+	// Connections ending in time are not affected.
+	c = startProxy(t, p, "example.net {\n\tbackend " + backend + "\n\tmax-duration 1m\n}\n")
+	if resp, _ := exchange(t, c, "example.net"); !strings.HasPrefix(resp, "received") {
+		t.Errorf("Wrong response %q", resp)
+	}
+	if e := <-entries; e.Reason != "closed" {
+		t.Errorf("Wrong reason %q", e.Reason)
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	delay := 300 * time.Millisecond
+	p := &Proxy{ TarpitDelay: delay, TarpitMax: 1 }
+	c := startProxy(t, p, "example.net {\n\tbackend 192.0.2.1:443\n}\n")
+	pit := p.tarpit()
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	// The first denied connection is held.
+	start := time.Now()
+	held := make(chan time.Duration, 1)
+	go func() {
+		exchange(t, c, "unknown.example.org")
+		held <- time.Since(start)
+	}()
+	for i := 0; ; i++ {
+		pit.mu.Lock()
+		n := len(pit.conns)
+		pit.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Denied connection was not held")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The tarpit is full, others are closed right away.
+	start2 := time.Now()
+	exchange(t, c2, "unknown.example.org")
+	if d := time.Since(start2); d >= delay {
+		t.Errorf("Connection over the tarpit limit was held for %s", d)
+	}
+
+	if d := <-held; d < delay {
+		t.Errorf("Denied connection was closed after %s, wanted at least %s", d, delay)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	backend := startBackend(t)
+
+	tests := []struct {
+		desc  string
+		mode  string
+		pause bool
+	}{
+		{ "Close", "close", false },
+		{ "Pause", "pause", true },
+	}
+
+	for _, tt := range(tests) {
+		t.Run(tt.desc, func(t *testing.T) {
+			// The first connection holds the only slot, as it never
+			// sends its handshake.
+			p := &Proxy{}
+			c := startProxy(t, p, "max-connections 1 " + tt.mode + "\nexample.net {\n\tbackend " + backend + "\n}\n")
+
+			c2, err := net.Dial("tcp", c.RemoteAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c2.Close()
+
+			resps := make(chan string, 1)
+			go func() {
+				resp, _ := exchange(t, c2, "example.net")
+				resps <- resp
+			}()
+
+			select {
+			case resp := <-resps:
+				if tt.pause {
+					t.Fatalf("Connection was not paused: %q", resp)
+				}
+				if resp != "" {
+					t.Errorf("Connection over the limit was proxied: %q", resp)
+				}
+				return
+			case <-time.After(200 * time.Millisecond):
+				if !tt.pause {
+					t.Fatalf("Connection over the limit was not closed")
+				}
+			}
+
+			if stats := p.Stats(); stats.ActiveConns != 1 || stats.MaxConns != 1 {
+				t.Errorf("Wrong stats: %d active connections, %d max", stats.ActiveConns, stats.MaxConns)
+			}
+
+			// Freeing the slot resumes the paused connection.
+			c.Close()
+			select {
+			case resp := <-resps:
+				if !strings.HasPrefix(resp, "received") {
+					t.Errorf("Paused connection was not proxied: %q", resp)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("Paused connection was not resumed")
+			}
+		})
+	}
+}
+
+func TestIPConns(t *testing.T) {
+	var conns ipConns
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+
+	if !conns.acquire(a, 2) || !conns.acquire(a, 2) || !conns.acquire(b, 2) {
+		t.Fatalf("Connections under the limit were rejected")
+	}
+	if conns.acquire(a, 2) {
+		t.Errorf("Connection over the limit was accepted")
+	}
+
+	conns.release(a)
+	if !conns.acquire(a.To4(), 2) {
+		t.Errorf("Connection was rejected after another one closed")
+	}
+
+	conns.release(a)
+	conns.release(a)
+	conns.release(b)
+	if len(conns.conns) != 0 {
+		t.Errorf("Clients without connections were not forgotten: %v", conns.conns)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	backend := startBackend(t)
+	entries := make(entryLogger, 2)
+	p := &Proxy{ AccessLog: entries }
+
+	// The first connection holds the only slot of its client.
+	c := startProxy(t, p, "max-conns-per-ip 1\nexample.net {\n\tbackend " + backend + "\n}\n")
+	for i := 0; i < 100; i++ {
+		p.perIP.mu.Lock()
+		n := len(p.perIP.conns)
+		p.perIP.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	if resp, _ := exchange(t, c2, "example.net"); resp != "" {
+		t.Errorf("Connection over the limit was proxied: %q", resp)
+	}
+	select {
+	case e := <-entries:
+		if e.Reason != "too many connections" {
+			t.Errorf("Wrong reason: %q", e.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No access log entry")
+	}
+
+	c.Close()
+	<-entries
+	p.perIP.mu.Lock()
+	defer p.perIP.mu.Unlock()
+	if len(p.perIP.conns) != 0 {
+		t.Errorf("Client was not forgotten: %v", p.perIP.conns)
+	}
+}
+
+func TestClassifyCopy(t *testing.T) {
+	opErr := func(op string, err error) error {
+		return &net.OpError{ Op: op, Net: "tcp", Err: &os.SyscallError{ Syscall: op, Err: err } }
+	}
+
+	tests := []struct {
+		desc string
+		err  error
+		out  copyResult
+	}{
+		{ "End of stream", nil, copyResult{ "client", copyEOF } },
+		{ "Reset while reading", opErr("read", syscall.ECONNRESET), copyResult{ "client", copyReset } },
+		{ "Reset while writing", opErr("write", syscall.ECONNRESET), copyResult{ "backend", copyReset } },
+		{ "Broken pipe", opErr("write", syscall.EPIPE), copyResult{ "backend", copyReset } },
+		{ "Timeout", &net.OpError{ Op: "read", Err: os.ErrDeadlineExceeded }, copyResult{ "client", copyTimeout } },
+		{ "Closed", &net.OpError{ Op: "read", Err: net.ErrClosed }, copyResult{ "client", copyClosed } },
+		{ "Other error", errors.New("failure"), copyResult{ "client", copyError } },
+	}
+
+	for _, tt := range(tests) {
+		if res := classifyCopy(tt.err, "client", "backend"); res != tt.out {
+			t.Errorf("%s: got %+v, wanted %+v", tt.desc, res, tt.out)
+		}
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	tests := []struct {
+		desc string
+		in   []copyResult
+		out  string
+	}{
+		{ "Normal close", []copyResult{ { "client", copyEOF }, { "backend", copyEOF } }, "closed" },
+		{ "Backend reset", []copyResult{ { "client", copyEOF }, { "backend", copyReset } }, "backend reset" },
+		{ "Timeout first", []copyResult{ { "client", copyReset }, { "backend", copyTimeout } }, "idle timeout" },
+		{ "Reset over errors", []copyResult{ { "client", copyError }, { "backend", copyReset } }, "backend reset" },
+		{ "Other error", []copyResult{ { "client", copyClosed }, { "backend", copyEOF } }, "copy error" },
+	}
+
+	for _, tt := range(tests) {
+		if reason := closeReason(tt.in...); reason != tt.out {
+			t.Errorf("%s: got %q, wanted %q", tt.desc, reason, tt.out)
+		}
+	}
+}
+
+func TestBackendReset(t *testing.T) {
+	// The backend resets connections as soon as it reads data.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Read(make([]byte, 1))
+			c.(*net.TCPConn).SetLinger(0)
+			c.Close()
+		}
+	}()
+
+	entries := make(entryLogger, 1)
+	c := startProxy(t, &Proxy{ AccessLog: entries }, "example.net {\n\tbackend " + l.Addr().String() + "\n}\n")
+	_, hello := clientHello(t, "example.net")
+	c.Write(hello)
+
+	select {
+	case e := <-entries:
+		if e.Reason != "backend reset" {
+			t.Errorf("Wrong reason: %q", e.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("No access log entry")
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sniproxy.conf")
+	os.WriteFile(path, []byte("example.net {\n\tbackend 192.0.2.1:443\n}\n"), 0644)
+	p := &Proxy{ AccessLog: NewTextLogger(io.Discard), HandshakeTimeout: 200 * time.Millisecond }
+	if err := p.Reload(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- p.ServeContext(ctx, l) }()
+
+	// The connection never sends its handshake, it is drained once it
+	// times out.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 100 && p.Stats().ActiveConns == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("Wrong error: %v", err)
+		}
+		if time.Since(start) < 100 * time.Millisecond {
+			t.Errorf("The connection was not drained")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serving did not stop")
+	}
+
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Errorf("The listener was not closed")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	backend := startBackend(t)
+
+	tests := []struct {
+		desc    string
+		conf    string
+		fail    int
+		dialed  []string
+		success bool
+	}{
+		{
+			"No retry",
+			"example.net {\n\tbackend " + backend + "\n}\n",
+			1,
+			[]string{ backend },
+			false,
+		},
+		{
+			"Same backend",
+			"example.net {\n\tbackend " + backend + "\n\tretries 2\n}\n",
+			2,
+			[]string{ backend, backend, backend },
+			true,
+		},
+		{
+			"Not enough retries",
+			"example.net {\n\tbackend " + backend + "\n\tretries 1\n}\n",
+			2,
+			[]string{ backend, backend },
+			false,
+		},
+		{
+			"Next backend",
+			"example.net {\n\tbackend 192.0.2.1:443, " + backend + "\n\tretries 1\n}\n",
+			1,
+			[]string{ "192.0.2.1:443", backend },
+			true,
+		},
+	}
+
+	for _, test := range(tests) {
+		var mu sync.Mutex
+		var dialed []string
+		p := &Proxy{
+			Dialer: func(network, address string) (net.Conn, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				dialed = append(dialed, address)
+				if len(dialed) <= test.fail {
+					return nil, errors.New("connection refused")
+				}
+				return net.DialTimeout(network, address, time.Second)
+			},
+		}
+		c := startProxy(t, p, test.conf)
+
+		resp, _ := exchange(t, c, "example.net")
+		if success := strings.HasPrefix(resp, "received"); success != test.success {
+			t.Errorf("%s: wrong outcome, got response %q", test.desc, resp)
+		}
+		mu.Lock()
+		if strings.Join(dialed, " ") != strings.Join(test.dialed, " ") {
+			t.Errorf("%s: dialed %v, wanted %v", test.desc, dialed, test.dialed)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestDialer(t *testing.T) {
+	_, hello := clientHello(t, "example.net")
+
+	// The backend is an in-memory pipe, answering once it got the
+	// ClientHello.
+	var dialed string
+	p := &Proxy{
+		Dialer: func(network, address string) (net.Conn, error) {
+			dialed = address
+			client, backend := net.Pipe()
+			go func() {
+				defer backend.Close()
+				b := make([]byte, len(hello))
+				if _, err := io.ReadFull(backend, b); err == nil {
+					backend.Write([]byte("pong"))
+				}
+			}()
+			return client, nil
+		},
+	}
+	c := startProxy(t, p, "example.net {\n\tbackend backend.invalid:443\n}\n")
+
+	c.Write(hello)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, _ := io.ReadAll(c)
+	if string(resp) != "pong" {
+		t.Errorf("Wrong response: %q", resp)
+	}
+	if dialed != "backend.invalid:443" {
+		t.Errorf("Wrong address dialed: %q", dialed)
+	}
+}
+
+func TestMaxDials(t *testing.T) {
+	release := make(chan struct{})
+	p := &Proxy{
+		MaxDials: 1,
+		DialQueueTimeout: 50 * time.Millisecond,
+		Dialer: func(network, address string) (net.Conn, error) {
+			<-release
+			return nil, errors.New("connection refused")
+		},
+	}
+
+	// The first dial hangs, holding the only slot.
+	done := make(chan error)
+	go func() {
+		_, err := p.dial("tcp", "192.0.2.1:443", &config.Backend{})
+		done <- err
+	}()
+	for len(p.dialSlots()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := p.dial("tcp", "192.0.2.2:443", &config.Backend{})
+	if err == nil || !strings.Contains(err.Error(), "too many dials") {
+		t.Errorf("Dial over the limit did not fail: %v", err)
+	}
+
+	close(release)
+	<-done
+	if _, err := p.dial("tcp", "192.0.2.2:443", &config.Backend{}); err == nil || strings.Contains(err.Error(), "too many dials") {
+		t.Errorf("Dial was not attempted once a slot was freed: %v", err)
+	}
+}
+
+func TestBackendSource(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	p := &Proxy{}
+	backend := &config.Backend{ DialTimeout: time.Second, Source: net.ParseIP("127.0.0.1") }
+	c, err := p.dial("tcp", l.Addr().String(), backend)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer c.Close()
+	if ip := c.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(backend.Source) {
+		t.Errorf("Connection originates from %s", ip)
+	}
+
+	// The source address isn't available on the host.
+	backend.Source = net.ParseIP("192.0.2.1")
+	if _, err := p.dial("tcp", l.Addr().String(), backend); err == nil || !strings.Contains(err.Error(), "from 192.0.2.1") {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+// Copies the data of 100 connections, each of them 64KB long.
+func benchmarkCopy(b *testing.B, copy func(io.Writer, io.Reader) (int64, error)) {
+	data := make([]byte, 64 * 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 100; j++ {
+			copy(plainWriter{ io.Discard }, plainReader{ bytes.NewReader(data) })
+		}
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	benchmarkCopy(b, io.Copy)
+}
+
+func BenchmarkCopyPooled(b *testing.B) {
+	pool := newBufferPool(defaultBufferSize)
+	benchmarkCopy(b, func(dst io.Writer, src io.Reader) (int64, error) {
+		return copyBuffered(dst, src, pool)
+	})
+}
+
+// Reader failing after some data was read.
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("read error")
+	}
+	r.n--
+	return len(b), nil
+}
+
+func TestCopyBuffered(t *testing.T) {
+	allocated := 0
+	pool := &sync.Pool{
+		New: func() any {
+			allocated++
+			b := make([]byte, 16)
+			return &b
+		},
+	}
+
+	var out bytes.Buffer
+	n, err := copyBuffered(&out, plainReader{ strings.NewReader("Hello, world! Hello, world!") }, pool)
+	if err != nil || n != 27 || out.String() != "Hello, world! Hello, world!" {
+		t.Errorf("Wrong copy: %d %q (%v)", n, out.String(), err)
+	}
+
+	// Buffers are returned to the pool on errors too.
+	if _, err := copyBuffered(io.Discard, &failingReader{ 2 }, pool); err == nil {
+		t.Errorf("Read error was not reported")
+	}
+	copyBuffered(io.Discard, &failingReader{ 2 }, pool)
+	if allocated > 1 {
+		t.Errorf("Buffers were not reused: %d allocated", allocated)
+	}
+}
+
+// GeoIP database recording when it is closed.
+type closingGeoIP chan struct{}
+
+func (closingGeoIP) Country(ip net.IP) (string, error) { return "", nil }
+func (db closingGeoIP) Close() error {
+	close(db)
+	return nil
+}
+
+func TestSetConfigGeoIP(t *testing.T) {
+	p := &Proxy{ HandshakeTimeout: 50 * time.Millisecond }
+	db := make(closingGeoIP)
+	p.SetConfig(&config.Config{ GeoIP: db })
+
+	// The database is kept while used by the new configuration.
+	p.SetConfig(&config.Config{ GeoIP: db })
+	start := time.Now()
+	p.SetConfig(&config.Config{})
+	select {
+	case <-db:
+		if time.Since(start) < p.HandshakeTimeout {
+			t.Errorf("GeoIP database closed before the handshake timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("GeoIP database was not closed")
+	}
+}
+
+func TestCopyBufferedTCP(t *testing.T) {
+	var buf *[]byte
+	pool := &sync.Pool{
+		New: func() any {
+			b := make([]byte, 4)
+			buf = &b
+			return buf
+		},
+	}
+
+	// Copies between TCP connections go through the pooled buffer, instead
+	// of using their io.ReaderFrom implementation.
+	src, srcPeer := tcpPair(t)
+	dst, dstPeer := tcpPair(t)
+	go func() {
+		srcPeer.Write([]byte("Hello, world!"))
+		srcPeer.Close()
+	}()
+	n, err := copyBuffered(dst, src, pool)
+	dst.Close()
+	out, _ := io.ReadAll(dstPeer)
+	if err != nil || n != 13 || string(out) != "Hello, world!" {
+		t.Errorf("Wrong copy: %d %q (%v)", n, out, err)
+	}
+	if buf == nil || bytes.Equal(*buf, make([]byte, 4)) {
+		t.Errorf("Pooled buffer was not used")
+	}
+}
+
+// Returns both ends of a TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close(); peer.Close() })
+	return c.(*net.TCPConn), peer.(*net.TCPConn)
+}
+
+func TestThrottledReader(t *testing.T) {
+	const rate = 200 * 1024
+	const size = 100 * 1024
+
+	r := newThrottledReader(bytes.NewReader(make([]byte, size)), rate)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	elapsed := time.Since(start)
+	if err != nil || n != size {
+		t.Fatalf("Wrong copy: %d bytes (%v)", n, err)
+	}
+
+	// The first burst is read right away, the rest at the limited rate.
+	burst := r.limiter.Burst()
+	if got := float64(size - burst) / elapsed.Seconds(); got > rate * 1.05 {
+		t.Errorf("Throughput is over the limit: %.0f B/s, wanted at most %d B/s", got, rate)
+	}
+}
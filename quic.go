@@ -0,0 +1,464 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atenart/sniproxy/clienthello"
+	"github.com/atenart/sniproxy/config"
+	"github.com/atenart/sniproxy/quic"
+)
+
+// Time after which QUIC sessions without traffic are forgotten.
+const quicIdleTimeout = 2 * time.Minute
+
+// Maximum number of datagrams, and of bytes, buffered for a client while its
+// ClientHello is being received and routed.
+const quicMaxPending = 16
+const quicMaxPendingBytes = 64 * 1024
+
+// Maximum number of QUIC sessions. Datagrams can come from spoofed addresses,
+// the number of sessions is bounded whatever the connection limits.
+const quicMaxSessions = 4096
+
+// Maximum size of a UDP datagram.
+const maxDatagramSize = 65535
+
+// Relays QUIC connections accepted on a UDP socket.
+type quicServer struct {
+	p *Proxy
+	l *net.UDPConn
+
+	mu          sync.Mutex
+	sessions    map[string]*quicSession
+	maxSessions int
+	// Set once the server stops, sessions being routed must not start
+	// relaying datagrams.
+	closed      atomic.Bool
+}
+
+// A QUIC connection, identified by the client address.
+type quicSession struct {
+	client  *net.UDPAddr
+	config  *config.Config
+	entry   *AccessEntry
+	metrics Metrics
+	// Routes can disable access logging.
+	log     bool
+	// Last time a datagram was received from the client, in nanoseconds.
+	last    atomic.Int64
+	// Slot of the global connection limit, and whether the session is
+	// counted in the connections of its client IP.
+	slots   chan struct{}
+	perIP   bool
+
+	// Protected by mu.
+	mu       sync.Mutex
+	// Datagrams received until the session is routed, and the handshake
+	// data they hold.
+	pending  [][]byte
+	buffered int
+	hello    quic.Assembler
+	// Whether the session was handed to a goroutine routing or ending it.
+	routing  bool
+	upstream net.Conn
+	done     bool
+}
+
+// Listen for QUIC connections on a UDP address and route them using the SNI of
+// their ClientHello, sharing the routes of TCP connections. Datagrams are
+// relayed to the backends over UDP, on the port of their address.
+func (p *Proxy) ListenAndServeQUIC(bind string) error {
+	addr, err := net.ResolveUDPAddr("udp", bind)
+	if err != nil {
+		return err
+	}
+	l, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return err
+	}
+	return p.ServeQUIC(l)
+}
+
+// Serves the QUIC connections received on a UDP socket, which is closed once
+// done.
+func (p *Proxy) ServeQUIC(l *net.UDPConn) error {
+	defer l.Close()
+
+	if !p.trackListener(l, true) {
+		return ErrProxyClosed
+	}
+	defer p.trackListener(l, false)
+	p.startHealthChecks()
+
+	s := &quicServer{
+		p: p,
+		l: l,
+		sessions: make(map[string]*quicSession),
+		maxSessions: quicMaxSessions,
+	}
+	defer s.closeAll()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := l.ReadFromUDP(buf)
+		if err != nil {
+			if p.shuttingDown() {
+				return ErrProxyClosed
+			}
+			return err
+		}
+		s.handle(client, append([]byte{}, buf[:n]...))
+	}
+}
+
+// Handles a datagram received from a client. This must not block, as it runs
+// in the loop reading datagrams.
+func (s *quicServer) handle(client *net.UDPAddr, b []byte) {
+	sess := s.session(client, b)
+	if sess == nil {
+		return
+	}
+	sess.last.Store(time.Now().UnixNano())
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.done {
+		return
+	}
+	if sess.upstream != nil {
+		n, _ := sess.upstream.Write(b)
+		sess.metrics.BytesProxied(int64(n), 0)
+		sess.entry.BytesSent += int64(n)
+		return
+	}
+
+	if len(sess.pending) >= quicMaxPending || sess.buffered + len(b) > quicMaxPendingBytes {
+		return
+	}
+	sess.pending = append(sess.pending, b)
+	sess.buffered += len(b)
+	if sess.routing {
+		return
+	}
+
+	// Packets other than Initial ones (eg. 0-RTT) are only buffered.
+	initial, err := quic.ParseInitial(b)
+	if err != nil {
+		return
+	}
+	if err := sess.hello.Add(initial.Frames); err != nil {
+		sess.logf("%s", err)
+		sess.routing = true
+		go s.finish(sess, "invalid handshake")
+		return
+	}
+	if msg := sess.hello.ClientHello(); msg != nil {
+		sess.routing = true
+		go s.route(sess, msg)
+	}
+}
+
+// Returns the session of a client, creating it if the datagram can start a
+// QUIC connection. Returns nil if the datagram must be dropped.
+func (s *quicServer) session(client *net.UDPAddr, b []byte) *quicSession {
+	key := client.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.sessions[key]; sess != nil {
+		return sess
+	}
+	if !quic.IsLongHeader(b) {
+		return nil
+	}
+
+	c := s.p.currentConfig()
+	metrics := s.p.metrics()
+	if len(s.sessions) >= s.maxSessions {
+		metrics.ConnsLimited()
+		return nil
+	}
+	if limiter := c.RateLimit; limiter != nil && !limiter.Allow(client.IP) {
+		metrics.RateLimited()
+		return nil
+	}
+
+	// Enforce the connection limits shared with TCP connections. Datagrams
+	// can't wait for a slot, max-connections pause mode doesn't apply.
+	slots := s.p.connSlots(c)
+	if !s.p.acquireSlot(context.Background(), slots, false) {
+		return nil
+	}
+	if max := c.MaxConnsPerIP; max > 0 && !s.p.perIP.acquire(client.IP, max) {
+		releaseSlot(slots)
+		metrics.ConnsLimited()
+		return nil
+	}
+
+	sess := &quicSession{
+		client: client,
+		config: c,
+		entry: &AccessEntry{
+			Client: client.IP.String(),
+			Start: time.Now(),
+			Reason: "closed",
+		},
+		metrics: metrics,
+		log: true,
+		slots: slots,
+		perIP: c.MaxConnsPerIP > 0,
+	}
+	s.sessions[key] = sess
+	metrics.ConnAccepted()
+	metrics.ActiveConns(1)
+
+	// Give up on clients not sending their ClientHello in time.
+	time.AfterFunc(s.p.handshakeTimeout(), func() {
+		if sess.claim() {
+			s.finish(sess, "handshake timeout")
+		}
+	})
+	return sess
+}
+
+// Routes a session given its ClientHello, and relays the datagrams of the
+// backend until the session ends.
+func (s *quicServer) route(sess *quicSession, msg []byte) {
+	entry := sess.entry
+	reason := "closed"
+	defer func() { s.finish(sess, reason) }()
+
+	info, err := clienthello.ParseMessage(msg)
+	if err != nil {
+		sess.metrics.SNIFailed()
+		sess.logf("%s", err)
+		reason = "invalid handshake"
+		return
+	}
+	entry.SNI = info.SNI
+	entry.TLSVersion = info.VersionName()
+	sess.metrics.ClientVersion(entry.TLSVersion)
+	if info.Hello != nil {
+		entry.setHello(info.Hello)
+	}
+
+	var debugf func(format string, v ...interface{})
+	if s.p.Debug {
+		debugf = sess.logf
+	}
+	port := s.l.LocalAddr().(*net.UDPAddr).Port
+	route, pattern, sni, rerr := matchRoute(sess.config, info, port, debugf)
+	if rerr != nil {
+		if rerr.reason == "invalid sni" {
+			sess.metrics.InvalidSNI()
+		}
+		sess.logf("%s", rerr)
+		reason = rerr.reason
+		return
+	}
+	sess.metrics.ConnRouted(pattern)
+	entry.Route = pattern
+	sess.log = route.Log
+
+	if route.Maintenance {
+		sess.logf("Route %q is in maintenance", pattern)
+		reason = "maintenance"
+		return
+	}
+
+	if route.RateLimit != nil && !route.RateLimit.Allow(sess.client.IP) {
+		sess.metrics.RateLimited()
+		reason = "rate limited"
+		return
+	}
+	if !checkACL(sess.config, route, pattern, sess.client.IP, sess.metrics, debugf) ||
+	   !route.AllowedJA3(entry.Fingerprint) {
+		sess.logf("Denied %s / %s access", sess.client.IP, sni)
+		reason = "denied"
+		return
+	}
+	// QUIC connections can only be passed through.
+	if route.TLSBackend != nil {
+		sess.logf("Route %q re-encrypts connections, which is not supported over QUIC", pattern)
+		reason = "unsupported"
+		return
+	}
+
+	backend := route.AcquireBackend(false, sess.client.IP, info.ALPN)
+	if backend == nil {
+		sess.logf("No backend available for %s", sni)
+		reason = "no backend"
+		return
+	}
+	defer backend.Release()
+	entry.Backend = backend.Address
+
+	network, address := backend.DialAddress(sni)
+	if network != "tcp" {
+		sess.logf("Backend %s can't be reached over UDP", backend.Address)
+		reason = "unsupported"
+		return
+	}
+	upstream, err := s.p.connect("udp", address, backend)
+	if err != nil {
+		sess.metrics.DialFailed()
+		sess.logf("%s", err)
+		reason = "backend unreachable"
+		return
+	}
+	defer upstream.Close()
+
+	// Send the datagrams received so far, the following ones being
+	// relayed as they come.
+	sess.mu.Lock()
+	if s.closed.Load() {
+		sess.mu.Unlock()
+		return
+	}
+	for _, b := range(sess.pending) {
+		n, _ := upstream.Write(b)
+		sess.metrics.BytesProxied(int64(n), 0)
+		entry.BytesSent += int64(n)
+	}
+	sess.pending = nil
+	sess.buffered = 0
+	sess.upstream = upstream
+	sess.mu.Unlock()
+
+	sess.logf("Routing %s to %s over QUIC", sni, backend.Address)
+
+	// Sessions lasting too long are ended, whatever their activity.
+	var expiry time.Time
+	if route.MaxDuration > 0 {
+		expiry = time.Now().Add(route.MaxDuration)
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		deadline := time.Now().Add(quicIdleTimeout)
+		if !expiry.IsZero() && expiry.Before(deadline) {
+			deadline = expiry
+		}
+		upstream.SetReadDeadline(deadline)
+		n, err := upstream.Read(buf)
+		if err != nil {
+			if isTimeout(err) && !expiry.IsZero() && !time.Now().Before(expiry) {
+				reason = "max-duration exceeded"
+				return
+			}
+			// The session is still active if the client sent data
+			// recently.
+			if isTimeout(err) && time.Since(time.Unix(0, sess.last.Load())) < quicIdleTimeout {
+				continue
+			}
+			if isTimeout(err) {
+				reason = "idle timeout"
+			}
+			return
+		}
+
+		if _, err := s.l.WriteToUDP(buf[:n], sess.client); err != nil {
+			return
+		}
+		sess.metrics.BytesProxied(0, int64(n))
+		entry.BytesReceived += int64(n)
+	}
+}
+
+// Ends a session, once.
+func (s *quicServer) finish(sess *quicSession, reason string) {
+	sess.mu.Lock()
+	if sess.done {
+		sess.mu.Unlock()
+		return
+	}
+	sess.done = true
+	sess.pending = nil
+	if sess.upstream != nil {
+		sess.upstream.Close()
+	}
+	sess.mu.Unlock()
+
+	s.mu.Lock()
+	delete(s.sessions, sess.client.String())
+	s.mu.Unlock()
+
+	releaseSlot(sess.slots)
+	if sess.perIP {
+		s.p.perIP.release(sess.client.IP)
+	}
+
+	entry := sess.entry
+	entry.Reason = reason
+	entry.Duration = time.Since(entry.Start)
+	sess.metrics.ActiveConns(-1)
+	sess.metrics.ConnClosed(entry.Duration)
+	routeStats.record(entry)
+	s.p.Tracer.trace(entry)
+	if sess.log {
+		s.p.accessLogger().LogAccess(entry)
+	}
+}
+
+// Ends all the sessions. Sessions being routed end once their connection to
+// the backend is closed.
+func (s *quicServer) closeAll() {
+	s.closed.Store(true)
+
+	s.mu.Lock()
+	var sessions []*quicSession
+	for _, sess := range(s.sessions) {
+		sessions = append(sessions, sess)
+	}
+	s.mu.Unlock()
+
+	for _, sess := range(sessions) {
+		if sess.claim() {
+			s.finish(sess, "closed")
+			continue
+		}
+		sess.mu.Lock()
+		if sess.upstream != nil {
+			sess.upstream.Close()
+		}
+		sess.mu.Unlock()
+	}
+}
+
+// Hands a session not being routed to the caller, which must end it. Returns
+// false if the session is already being routed or ended.
+func (sess *quicSession) claim() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.routing {
+		return false
+	}
+	sess.routing = true
+	return true
+}
+
+func (sess *quicSession) logf(format string, v ...interface{}) {
+	log.Printf("%s %s", sess.client, fmt.Sprintf(format, v...))
+}
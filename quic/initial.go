@@ -0,0 +1,361 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package quic extracts the TLS ClientHello carried in the Initial packets of
+// QUIC connections (RFC 9000 and RFC 9001), so they can be routed by SNI
+// without being terminated. Only QUIC version 1 is supported.
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// QUIC version 1.
+const Version1 = 0x00000001
+
+// Salt used to derive the Initial packets keys of QUIC version 1.
+var initialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// Returned when a packet is not a QUIC Initial packet.
+var ErrNotInitial = errors.New("Not a QUIC Initial packet")
+
+// Maximum length of a connection ID.
+const maxConnIDLength = 20
+
+// Maximum length of a ClientHello spanning multiple packets.
+const maxHelloLength = 64 * 1024
+
+// Initial holds the content of a client Initial packet.
+type Initial struct {
+	// Connection IDs chosen by the client.
+	DCID   []byte
+	SCID   []byte
+	// Data of the CRYPTO frames.
+	Frames []Frame
+}
+
+// Data of a CRYPTO frame, at a given offset of the handshake stream.
+type Frame struct {
+	Offset uint64
+	Data   []byte
+}
+
+// Reports whether a datagram starts with a long header packet, which is the
+// case for the packets starting a QUIC connection.
+func IsLongHeader(packet []byte) bool {
+	return len(packet) > 0 && packet[0] & 0x80 != 0
+}
+
+// Parses and decrypts the first packet of a datagram, which must be a client
+// Initial packet. Packets coalesced after it are ignored.
+func ParseInitial(packet []byte) (*Initial, error) {
+	if len(packet) < 7 || !IsLongHeader(packet) {
+		return nil, ErrNotInitial
+	}
+	version := binary.BigEndian.Uint32(packet[1:5])
+	if version != Version1 {
+		return nil, fmt.Errorf("QUIC version not supported (%#x)", version)
+	}
+	if packet[0] & 0x30 != 0 {
+		return nil, ErrNotInitial
+	}
+
+	initial := &Initial{}
+	b := packet[5:]
+	var err error
+	if initial.DCID, b, err = readConnID(b); err != nil {
+		return nil, err
+	}
+	if initial.SCID, b, err = readConnID(b); err != nil {
+		return nil, err
+	}
+
+	// Token.
+	tokenLen, b, err := readVarint(b)
+	if err != nil || tokenLen > uint64(len(b)) {
+		return nil, fmt.Errorf("Could not read QUIC Initial token")
+	}
+	b = b[tokenLen:]
+
+	// Length of the packet number and the payload.
+	length, b, err := readVarint(b)
+	if err != nil || length > uint64(len(b)) {
+		return nil, fmt.Errorf("QUIC Initial packet is truncated")
+	}
+	// The header protection sample starts 4 bytes after the packet number
+	// and is 16 bytes long.
+	if length < 20 {
+		return nil, fmt.Errorf("QUIC Initial packet is too short")
+	}
+	pnOffset := len(packet) - len(b)
+	end := pnOffset + int(length)
+
+	keys, err := clientKeys(initial.DCID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the header protection, from a copy of the header as the
+	// packet must not be modified.
+	header := append([]byte{}, packet[:pnOffset + 4]...)
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, packet[pnOffset + 4:pnOffset + 20])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0] & 0x03) + 1
+
+	// Client Initial packet numbers are small enough for the truncated
+	// packet number to be the full one.
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset + i] ^= mask[1 + i]
+		pn = pn << 8 | uint64(header[pnOffset + i])
+	}
+	header = header[:pnOffset + pnLen]
+
+	nonce := append([]byte{}, keys.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce) - 1 - i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := keys.aead.Open(nil, nonce, packet[pnOffset + pnLen:end], header)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt QUIC Initial packet (%s)", err)
+	}
+
+	if initial.Frames, err = parseFrames(payload); err != nil {
+		return nil, err
+	}
+	return initial, nil
+}
+
+// Reads a connection ID, prefixed by its length.
+func readConnID(b []byte) ([]byte, []byte, error) {
+	if len(b) < 1 || int(b[0]) > len(b[1:]) {
+		return nil, nil, fmt.Errorf("QUIC connection ID is truncated")
+	}
+	if b[0] > maxConnIDLength {
+		return nil, nil, fmt.Errorf("QUIC connection ID is too long (%d)", b[0])
+	}
+	return b[1:1 + b[0]], b[1 + b[0]:], nil
+}
+
+// Reads a variable-length integer and returns it along with the remaining
+// bytes.
+func readVarint(b []byte) (uint64, []byte, error) {
+	if len(b) < 1 {
+		return 0, nil, fmt.Errorf("QUIC integer is truncated")
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, nil, fmt.Errorf("QUIC integer is truncated")
+	}
+
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v << 8 | uint64(b[i])
+	}
+	return v, b[n:], nil
+}
+
+// Parses the frames of a decrypted Initial packet payload and returns the
+// CRYPTO ones. Other frames allowed in client Initial packets are skipped.
+func parseFrames(b []byte) ([]Frame, error) {
+	var frames []Frame
+	for len(b) > 0 {
+		var frameType uint64
+		var err error
+		if frameType, b, err = readVarint(b); err != nil {
+			return nil, err
+		}
+
+		switch (frameType) {
+		// PADDING and PING.
+		case 0x00, 0x01:
+			break
+		// ACK, with ECN counts for 0x03.
+		case 0x02, 0x03:
+			var count uint64
+			// Largest acknowledged, delay and range count.
+			for i := 0; i < 3 && err == nil; i++ {
+				count, b, err = readVarint(b)
+			}
+			// First range, then gap and length of each range.
+			n := 1 + 2 * count
+			if frameType == 0x03 {
+				n += 3
+			}
+			for i := uint64(0); i < n && err == nil; i++ {
+				_, b, err = readVarint(b)
+			}
+			break
+		// CRYPTO.
+		case 0x06:
+			var offset, length uint64
+			if offset, b, err = readVarint(b); err != nil {
+				break
+			}
+			if length, b, err = readVarint(b); err != nil {
+				break
+			}
+			if length > uint64(len(b)) {
+				return nil, fmt.Errorf("QUIC CRYPTO frame is truncated")
+			}
+			frames = append(frames, Frame{ offset, b[:length] })
+			b = b[length:]
+			break
+		// CONNECTION_CLOSE.
+		case 0x1c:
+			var length uint64
+			// Error code and frame type.
+			for i := 0; i < 2 && err == nil; i++ {
+				_, b, err = readVarint(b)
+			}
+			if err == nil {
+				length, b, err = readVarint(b)
+			}
+			if err == nil && length > uint64(len(b)) {
+				err = fmt.Errorf("QUIC CONNECTION_CLOSE frame is truncated")
+			}
+			if err == nil {
+				b = b[length:]
+			}
+			break
+		default:
+			return nil, fmt.Errorf("Unexpected QUIC frame in Initial packet (%#x)", frameType)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return frames, nil
+}
+
+// Reassembles the handshake data carried in CRYPTO frames, which can span
+// several Initial packets and arrive out of order.
+type Assembler struct {
+	frames []Frame
+	size   int
+}
+
+// Adds CRYPTO frames to the handshake data.
+func (a *Assembler) Add(frames []Frame) error {
+	for _, f := range(frames) {
+		if f.Offset + uint64(len(f.Data)) > maxHelloLength {
+			return fmt.Errorf("ClientHello length exceed maximum (%d)", maxHelloLength)
+		}
+		a.size += len(f.Data)
+		if a.size > maxHelloLength {
+			return fmt.Errorf("ClientHello length exceed maximum (%d)", maxHelloLength)
+		}
+		a.frames = append(a.frames, f)
+	}
+	return nil
+}
+
+// Returns the ClientHello handshake message, or nil if it wasn't fully
+// received yet.
+func (a *Assembler) ClientHello() []byte {
+	sort.SliceStable(a.frames, func(i, j int) bool {
+		return a.frames[i].Offset < a.frames[j].Offset
+	})
+
+	// Build the contiguous data from the start of the stream. Frames can
+	// overlap when packets are retransmitted.
+	var data []byte
+	for _, f := range(a.frames) {
+		if f.Offset > uint64(len(data)) {
+			break
+		}
+		if end := f.Offset + uint64(len(f.Data)); end > uint64(len(data)) {
+			data = append(data, f.Data[uint64(len(data)) - f.Offset:]...)
+		}
+	}
+
+	if len(data) < 4 {
+		return nil
+	}
+	length := int(data[1]) << 16 | int(data[2]) << 8 | int(data[3])
+	if len(data) < 4 + length {
+		return nil
+	}
+	return data[:4 + length]
+}
+
+// Keys protecting the client Initial packets.
+type initialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// Derives the keys protecting the client Initial packets of a connection,
+// from the destination connection ID chosen by the client.
+func clientKeys(dcid []byte) (*initialKeys, error) {
+	secret := hkdfExpandLabel(hkdfExtract(initialSalt, dcid), "client in", sha256.Size)
+
+	block, err := aes.NewCipher(hkdfExpandLabel(secret, "quic key", 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(secret, "quic hp", 16))
+	if err != nil {
+		return nil, err
+	}
+
+	return &initialKeys{
+		aead: aead,
+		iv: hkdfExpandLabel(secret, "quic iv", 12),
+		hp: hp,
+	}, nil
+}
+
+// HKDF-Extract (RFC 5869), using SHA-256.
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// HKDF-Expand-Label (RFC 8446), using SHA-256 and an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{ byte(length >> 8), byte(length), byte(len(label)) }
+	info = append(info, label...)
+	info = append(info, 0)
+
+	var out, prev []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{ i })
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
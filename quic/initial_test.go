@@ -0,0 +1,224 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package quic
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/atenart/sniproxy/clienthello"
+)
+
+// Returns the handshake message of a ClientHello sent by a Go TLS client.
+func clientHello(t *testing.T, sni string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{ ServerName: sni, NextProtos: []string{"h3"} }).Handshake()
+		client.Close()
+	}()
+
+	_, raw, err := clienthello.Parse(server)
+	if err != nil {
+		t.Fatalf("Could not parse the ClientHello (%s)", err)
+	}
+	// Strip the TLS record header.
+	return raw[5:]
+}
+
+// Returns a CRYPTO frame.
+func cryptoFrame(offset int, data []byte) []byte {
+	return append([]byte{ 0x06, 0x80 | byte(offset >> 24), byte(offset >> 16), byte(offset >> 8), byte(offset),
+			      0x40 | byte(len(data) >> 8), byte(len(data)) }, data...)
+}
+
+// Builds a client Initial packet holding the given frames, padded to 1200
+// bytes.
+func seal(t *testing.T, dcid []byte, pn uint16, frames []byte) []byte {
+	keys, err := clientKeys(dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two bytes packet numbers.
+	header := []byte{ 0xc1, 0, 0, 0, 1, byte(len(dcid)) }
+	header = append(header, dcid...)
+	header = append(header, 0, 0)
+	length := 1200 - len(header) - 2
+	header = append(header, 0x40 | byte(length >> 8), byte(length), byte(pn >> 8), byte(pn))
+	pnOffset := len(header) - 2
+
+	plain := make([]byte, length - 2 - keys.aead.Overhead())
+	copy(plain, frames)
+	nonce := append([]byte{}, keys.iv...)
+	nonce[10] ^= byte(pn >> 8)
+	nonce[11] ^= byte(pn)
+	packet := keys.aead.Seal(append([]byte{}, header...), nonce, plain, header)
+
+	mask := make([]byte, 16)
+	keys.hp.Encrypt(mask, packet[pnOffset + 4:pnOffset + 20])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset + 1] ^= mask[2]
+	return packet
+}
+
+// Test vectors from RFC 9001, appendix A.1.
+func TestClientKeys(t *testing.T) {
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	secret := hkdfExpandLabel(hkdfExtract(initialSalt, dcid), "client in", 32)
+
+	tests := []struct {
+		desc  string
+		label string
+		len   int
+		out   string
+	}{
+		{ "Key", "quic key", 16, "1f369613dd76d5467730efcbe3b1a22d" },
+		{ "IV", "quic iv", 12, "fa044b2f42a3fd3b46fb255c" },
+		{ "Header protection", "quic hp", 16, "9f50449e04a0e810283a1e9933adedd2" },
+	}
+
+	for _, test := range(tests) {
+		if out := hex.EncodeToString(hkdfExpandLabel(secret, test.label, test.len)); out != test.out {
+			t.Errorf("%s: got %s, wanted %s", test.desc, out, test.out)
+		}
+	}
+}
+
+func TestParseInitial(t *testing.T) {
+	dcid := []byte{ 1, 2, 3, 4, 5, 6, 7, 8 }
+	hello := clientHello(t, "example.net")
+	first, second := hello[:100], hello[100:]
+
+	tests := []struct {
+		desc    string
+		packets [][]byte
+		sni     string
+	}{
+		{
+			"Single packet",
+			[][]byte{ seal(t, dcid, 0, cryptoFrame(0, hello)) },
+			"example.net",
+		},
+		{
+			"ClientHello spanning two packets",
+			[][]byte{
+				seal(t, dcid, 0, cryptoFrame(0, first)),
+				seal(t, dcid, 1, cryptoFrame(len(first), second)),
+			},
+			"example.net",
+		},
+		{
+			"Out of order packets, with PING and ACK frames",
+			[][]byte{
+				seal(t, dcid, 1, append([]byte{ 0x01, 0x02, 0, 0, 0, 0 }, cryptoFrame(len(first), second)...)),
+				seal(t, dcid, 0, cryptoFrame(0, first)),
+			},
+			"example.net",
+		},
+		{
+			"Missing packet",
+			[][]byte{ seal(t, dcid, 1, cryptoFrame(len(first), second)) },
+			"",
+		},
+	}
+
+	for _, test := range(tests) {
+		var a Assembler
+		for _, packet := range(test.packets) {
+			initial, err := ParseInitial(packet)
+			if err != nil {
+				t.Fatalf("%s: unexpected error (%s)", test.desc, err)
+			}
+			if !bytes.Equal(initial.DCID, dcid) {
+				t.Errorf("%s: wrong DCID %x", test.desc, initial.DCID)
+			}
+			if err := a.Add(initial.Frames); err != nil {
+				t.Fatalf("%s: unexpected error (%s)", test.desc, err)
+			}
+		}
+
+		msg := a.ClientHello()
+		if test.sni == "" {
+			if msg != nil {
+				t.Errorf("%s: incomplete ClientHello returned", test.desc)
+			}
+			continue
+		}
+		info, err := clienthello.ParseMessage(msg)
+		if err != nil {
+			t.Errorf("%s: could not parse the ClientHello (%s)", test.desc, err)
+			continue
+		}
+		if info.SNI != test.sni {
+			t.Errorf("%s: got SNI %q, wanted %q", test.desc, info.SNI, test.sni)
+		}
+	}
+}
+
+func TestParseInitialErrors(t *testing.T) {
+	packet := seal(t, []byte{ 1, 2, 3, 4 }, 0, cryptoFrame(0, []byte("hello")))
+	corrupted := append([]byte{}, packet...)
+	corrupted[100] ^= 1
+	handshake := append([]byte{}, packet...)
+	handshake[0] |= 0x20
+
+	tests := []struct {
+		desc string
+		in   []byte
+	}{
+		{ "Empty datagram", []byte{} },
+		{ "Short header packet", []byte{ 0x40, 0, 0, 0, 1, 0, 0, 0 } },
+		{ "Unsupported version", []byte{ 0xc0, 0, 0, 0, 2, 0, 0, 0 } },
+		{ "Handshake packet", handshake },
+		{ "Truncated packet", packet[:100] },
+		{ "Corrupted payload", corrupted },
+	}
+
+	for _, test := range(tests) {
+		if _, err := ParseInitial(test.in); err == nil {
+			t.Errorf("%s: expected an error", test.desc)
+		}
+	}
+}
+
+func TestFixture(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "initial.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial, err := ParseInitial(b)
+	if err != nil {
+		t.Fatalf("Unexpected error (%s)", err)
+	}
+
+	var a Assembler
+	a.Add(initial.Frames)
+	info, err := clienthello.ParseMessage(a.ClientHello())
+	if err != nil {
+		t.Fatalf("Could not parse the ClientHello (%s)", err)
+	}
+	if info.SNI != "example.net" || len(info.ALPN) != 1 || info.ALPN[0] != "h3" {
+		t.Errorf("Wrong ClientHello: %q %v", info.SNI, info.ALPN)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Starts a UDP backend echoing the datagrams it receives.
+func startUDPBackend(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+// Starts a QUIC proxy and returns a UDP socket connected to it.
+func startQUICProxy(t *testing.T, p *Proxy, conf string) net.Conn {
+	path := filepath.Join(t.TempDir(), "sniproxy.conf")
+	os.WriteFile(path, []byte(conf), 0644)
+	if err := p.Reload(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{ IP: net.IPv4(127, 0, 0, 1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.ServeQUIC(l)
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+
+	c, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestQUIC(t *testing.T) {
+	initial, err := os.ReadFile(filepath.Join("quic", "testdata", "initial.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := startUDPBackend(t)
+
+	tests := []struct {
+		desc   string
+		conf   string
+		routed bool
+		reason string
+	}{
+		{
+			"Routed",
+			"example.net {\n\tbackend " + backend + "\n}\n",
+			true,
+			"closed",
+		},
+		{
+			"No route",
+			"example.org {\n\tbackend " + backend + "\n}\n",
+			false,
+			"no route",
+		},
+		{
+			"Denied",
+			"example.net {\n\tbackend " + backend + "\n\tdeny 127.0.0.0/8\n}\n",
+			false,
+			"denied",
+		},
+	}
+
+	for _, test := range(tests) {
+		entries := make(entryLogger, 1)
+		p := &Proxy{ AccessLog: entries }
+		c := startQUICProxy(t, p, test.conf)
+
+		// The Initial packet is relayed, and so are the following
+		// datagrams.
+		buf := make([]byte, maxDatagramSize)
+		for _, out := range([][]byte{ initial, []byte{ 0x40, 1, 2, 3 } }) {
+			c.Write(out)
+			c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, err := c.Read(buf)
+			if test.routed && (err != nil || !bytes.Equal(buf[:n], out)) {
+				t.Errorf("%s: datagram was not relayed (%v)", test.desc, err)
+			}
+			if !test.routed && err == nil {
+				t.Errorf("%s: datagram was relayed", test.desc)
+			}
+			if !test.routed {
+				break
+			}
+		}
+
+		p.Shutdown(context.Background())
+		select {
+		case e := <-entries:
+			if e.Reason != test.reason || e.SNI != "example.net" || e.TLSVersion != "TLS 1.3" || e.Fingerprint == "" ||
+			   len(e.SignatureAlgorithms) == 0 || len(e.KeyShares) == 0 {
+				t.Errorf("%s: wrong access log entry %+v", test.desc, e)
+			}
+			if test.routed && (e.BytesSent != int64(len(initial) + 4) || e.BytesReceived != e.BytesSent) {
+				t.Errorf("%s: wrong byte counts %d/%d", test.desc, e.BytesSent, e.BytesReceived)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no access log entry", test.desc)
+		}
+	}
+}
+
+// Counts the accepted and limited connections.
+type countMetrics struct {
+	promMetrics
+	accepted int
+	limited  int
+}
+
+func (m *countMetrics) ConnAccepted() { m.accepted++ }
+func (m *countMetrics) ConnsLimited() { m.limited++ }
+func (m *countMetrics) RateLimited()  { m.limited++ }
+
+func TestQUICLimits(t *testing.T) {
+	initial, err := os.ReadFile(filepath.Join("quic", "testdata", "initial.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc        string
+		conf        string
+		maxSessions int
+		clients     []string
+		sessions    int
+	}{
+		{
+			"No limit",
+			"",
+			10,
+			[]string{ "10.0.0.1:1", "10.0.0.1:2", "10.0.0.2:1" },
+			3,
+		},
+		{
+			"Sessions cap",
+			"",
+			2,
+			[]string{ "10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1" },
+			2,
+		},
+		{
+			"max-connections",
+			"max-connections 1\n",
+			10,
+			[]string{ "10.0.0.1:1", "10.0.0.2:1" },
+			1,
+		},
+		{
+			"max-conns-per-ip",
+			"max-conns-per-ip 2\n",
+			10,
+			[]string{ "10.0.0.1:1", "10.0.0.1:2", "10.0.0.1:3", "10.0.0.2:1" },
+			3,
+		},
+		{
+			"rate-limit",
+			"rate-limit 0.01 1\n",
+			10,
+			[]string{ "10.0.0.1:1", "10.0.0.1:2" },
+			1,
+		},
+		{
+			"Datagrams of a session",
+			"max-conns-per-ip 1\n",
+			10,
+			[]string{ "10.0.0.1:1", "10.0.0.1:1" },
+			1,
+		},
+	}
+
+	for _, test := range(tests) {
+		path := filepath.Join(t.TempDir(), "sniproxy.conf")
+		os.WriteFile(path, []byte(test.conf + "example.net {\n\tbackend 127.0.0.1:443\n}\n"), 0644)
+		m := &countMetrics{}
+		p := &Proxy{ Metrics: m, HandshakeTimeout: time.Hour }
+		if err := p.Reload(path); err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+		s := &quicServer{
+			p: p,
+			sessions: make(map[string]*quicSession),
+			maxSessions: test.maxSessions,
+		}
+
+		for _, client := range(test.clients) {
+			addr, _ := net.ResolveUDPAddr("udp", client)
+			s.session(addr, initial)
+		}
+		if len(s.sessions) != test.sessions || m.accepted != test.sessions ||
+		   m.limited != len(test.clients) - test.sessions - duplicates(test.clients) {
+			t.Errorf("%s: wrong sessions %d, accepted %d, limited %d",
+				 test.desc, len(s.sessions), m.accepted, m.limited)
+		}
+
+		// Ended sessions give their slots back.
+		for _, sess := range(s.sessions) {
+			s.finish(sess, "closed")
+		}
+		if len(p.perIP.conns) != 0 || len(p.slots) != 0 {
+			t.Errorf("%s: slots not released", test.desc)
+		}
+	}
+}
+
+// Returns the number of repeated entries of a list.
+func duplicates(list []string) int {
+	seen := make(map[string]bool)
+	n := 0
+	for _, s := range(list) {
+		if seen[s] {
+			n++
+		}
+		seen[s] = true
+	}
+	return n
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+// Package ratelimit limits the rate of new connections per client IP, using
+// one token bucket per client.
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Buckets not used for this long are evicted.
+const idleTimeout = 10 * time.Minute
+
+// Limiter limits the rate of events per IP address.
+type Limiter struct {
+	// Events per second, and maximum burst size.
+	Rate  rate.Limit
+	Burst int
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastEvict time.Time
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Returns a new Limiter allowing r events per second and per IP, with bursts of
+// at most burst events.
+func New(r float64, burst int) *Limiter {
+	return &Limiter{
+		Rate: rate.Limit(r),
+		Burst: burst,
+		clients: make(map[string]*client),
+		lastEvict: time.Now(),
+	}
+}
+
+// Reports whether an event from a given IP may happen now.
+func (l *Limiter) Allow(ip net.IP) bool {
+	return l.allowAt(ip, time.Now())
+}
+
+func (l *Limiter) allowAt(ip net.IP, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Periodically drop the buckets of clients not seen recently, so
+	// memory doesn't grow unbounded.
+	if now.Sub(l.lastEvict) > idleTimeout {
+		l.evict(now)
+	}
+
+	key := ip.String()
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{ limiter: rate.NewLimiter(l.Rate, l.Burst) }
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+
+	return c.limiter.AllowN(now, 1)
+}
+
+// Removes idle buckets. Must be called with mu held.
+func (l *Limiter) evict(now time.Time) {
+	for key, c := range(l.clients) {
+		if now.Sub(c.lastSeen) > idleTimeout {
+			delete(l.clients, key)
+		}
+	}
+	l.lastEvict = now
+}
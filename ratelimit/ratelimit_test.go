@@ -0,0 +1,58 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	l := New(1, 2)
+	now := time.Now()
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	if !l.allowAt(a, now) || !l.allowAt(a, now) {
+		t.Errorf("Burst was not allowed")
+	}
+	if l.allowAt(a, now) {
+		t.Errorf("Event allowed past the burst")
+	}
+	if !l.allowAt(b, now) {
+		t.Errorf("Clients do not have their own bucket")
+	}
+	if !l.allowAt(a, now.Add(time.Second)) {
+		t.Errorf("Bucket was not refilled")
+	}
+}
+
+func TestEvict(t *testing.T) {
+	l := New(1, 1)
+	now := l.lastEvict
+
+	l.allowAt(net.ParseIP("10.0.0.1"), now)
+	l.allowAt(net.ParseIP("10.0.0.2"), now.Add(idleTimeout))
+	if len(l.clients) != 2 {
+		t.Fatalf("Wrong number of buckets: got %d, wanted 2", len(l.clients))
+	}
+
+	// Only the bucket idle for too long is evicted.
+	l.allowAt(net.ParseIP("10.0.0.2"), now.Add(idleTimeout + time.Minute))
+	if _, ok := l.clients["10.0.0.1"]; ok || len(l.clients) != 1 {
+		t.Errorf("Idle bucket was not evicted")
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+)
+
+// Sizes of the socket buffers of proxied TCP connections, 0 to keep the OS
+// default. Sizes clamped by the OS are only reported once.
+type sockBuffers struct {
+	snd     int
+	rcv     int
+	clamped sync.Once
+}
+
+// Sets the buffer sizes of a socket, before it connects or listens so the TCP
+// window scaling negotiated matches them. Sockets accepted on a listener
+// inherit its sizes. Can be used as the Control function of a net.Dialer or
+// net.ListenConfig; nothing is done if b is nil.
+func (b *sockBuffers) control(network, address string, c syscall.RawConn) error {
+	if b == nil {
+		return nil
+	}
+	if err := setSocketBuffers(c, b.snd, b.rcv); err != nil {
+		return fmt.Errorf("Could not set the socket buffer sizes of %s (%s)", address, err)
+	}
+
+	// The sizes in use can't be read back on all platforms.
+	snd, rcv, err := socketBuffers(c)
+	if err != nil {
+		return nil
+	}
+	if snd < b.snd || rcv < b.rcv {
+		b.clamped.Do(func() {
+			log.Printf("Socket buffers clamped by the OS: send %d (%d requested), receive %d (%d requested)",
+				   snd, b.snd, rcv, b.rcv)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// Returns the buffer sizes of a TCP connection.
+func connBuffers(t *testing.T, c net.Conn) (int, int) {
+	raw, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snd, rcv, err := socketBuffers(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snd, rcv
+}
+
+func TestSocketBuffers(t *testing.T) {
+	// Sizes of sockets left to the OS defaults.
+	var defaultSnd, defaultRcv int
+	{
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defaultSnd, defaultRcv = connBuffers(t, c)
+		c.Close()
+		l.Close()
+	}
+
+	tests := []struct {
+		desc string
+		snd  int
+		rcv  int
+	}{
+		{ "Send buffer", 32 * 1024, 0 },
+		{ "Receive buffer", 0, 48 * 1024 },
+		{ "Both buffers", 64 * 1024, 96 * 1024 },
+		{ "Unset", 0, 0 },
+	}
+
+	for _, test := range(tests) {
+		p := &Proxy{ SendBuffer: test.snd, ReceiveBuffer: test.rcv }
+		snd, rcv := test.snd, test.rcv
+		if snd == 0 {
+			snd = defaultSnd
+		}
+		if rcv == 0 {
+			rcv = defaultRcv
+		}
+
+		// Accepted connections inherit the sizes of the listener, and
+		// backend connections get them before connecting.
+		l, err := listen("127.0.0.1:0", "tcp", false, p.listenConfig())
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+		dialer := &net.Dialer{ Control: p.sockBuffers().control }
+		c, err := dialer.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.desc, err)
+		}
+
+		for _, conn := range([]net.Conn{ c, accepted }) {
+			if s, r := connBuffers(t, conn); s != snd || r != rcv {
+				t.Errorf("%s: wrong sizes: send %d, receive %d", test.desc, s, r)
+			}
+		}
+		c.Close()
+		accepted.Close()
+		l.Close()
+	}
+
+	// Sizes above the system limits are clamped.
+	p := &Proxy{ SendBuffer: 1 << 30, ReceiveBuffer: 1 << 30 }
+	l, err := listen("127.0.0.1:0", "tcp", false, p.listenConfig())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if snd, rcv := connBuffers(t, accepted); snd >= p.SendBuffer || rcv >= p.ReceiveBuffer {
+		t.Errorf("Sizes not clamped: send %d, receive %d", snd, rcv)
+	}
+}
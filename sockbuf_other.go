@@ -0,0 +1,33 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Sets the send and receive buffer sizes of a socket, if not 0.
+func setSocketBuffers(c syscall.RawConn, snd, rcv int) error {
+	return errors.New("Socket buffer sizes can't be set on this platform")
+}
+
+// Returns the send and receive buffer sizes of a socket.
+func socketBuffers(c syscall.RawConn) (int, int, error) {
+	return 0, 0, errors.New("Socket buffer sizes can't be read on this platform")
+}
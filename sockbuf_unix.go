@@ -0,0 +1,62 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sets the send and receive buffer sizes of a socket, if not 0.
+func setSocketBuffers(c syscall.RawConn, snd, rcv int) error {
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		if snd > 0 {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, snd); err != nil {
+				return
+			}
+		}
+		if rcv > 0 {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, rcv)
+		}
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
+
+// Returns the send and receive buffer sizes of a socket. Linux reports twice
+// the sizes set, to account for its bookkeeping overhead.
+func socketBuffers(c syscall.RawConn) (int, int, error) {
+	var snd, rcv int
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		if snd, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF); err != nil {
+			return
+		}
+		rcv, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	}); ctrlErr != nil {
+		return 0, 0, ctrlErr
+	}
+	if runtime.GOOS == "linux" {
+		snd, rcv = snd / 2, rcv / 2
+	}
+	return snd, rcv, err
+}
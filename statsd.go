@@ -0,0 +1,153 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Number of packets queued for sending, before new ones get dropped.
+const statsdQueueLen = 1024
+
+// Metrics sink sending events to a statsd server over UDP. Packets are sent by
+// a dedicated goroutine and dropped if it can't keep up or if sending fails, so
+// accounting never slows connections down.
+type StatsdMetrics struct {
+	// Prefix of the metric names.
+	prefix  string
+	// Whether route metrics are tagged, using the DogStatsD format.
+	tags    bool
+	packets chan string
+}
+
+// Returns a sink sending metrics to the statsd server at addr. Metric names are
+// prefixed with prefix. When tags is set, per-route metrics are tagged with
+// the route using the DogStatsD extension, which plain statsd servers don't
+// understand.
+func NewStatsdMetrics(addr, prefix string, tags bool) (*StatsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to statsd %s (%s)", addr, err)
+	}
+
+	s := &StatsdMetrics{
+		prefix: prefix,
+		tags: tags,
+		packets: make(chan string, statsdQueueLen),
+	}
+	go s.send(conn)
+	return s, nil
+}
+
+// Sends the queued packets, ignoring errors.
+func (s *StatsdMetrics) send(conn net.Conn) {
+	defer conn.Close()
+	for packet := range(s.packets) {
+		conn.Write([]byte(packet))
+	}
+}
+
+// Queues a metric, unless the queue is full.
+func (s *StatsdMetrics) emit(name string, value int64, kind string, route string) {
+	// Gauges are updated relatively to their current value when the value
+	// is signed.
+	format := "%s%s:%d|%s"
+	if kind == "g" {
+		format = "%s%s:%+d|%s"
+	}
+	packet := fmt.Sprintf(format, s.prefix, name, value, kind)
+	if s.tags && route != "" {
+		// Characters with a meaning in DogStatsD packets can't be part
+		// of a tag.
+		packet += "|#route:" + strings.NewReplacer("|", "_", ",", "_", "#", "_").Replace(route)
+	}
+
+	select {
+	case s.packets <- packet:
+	default:
+	}
+}
+
+func (s *StatsdMetrics) ConnAccepted() {
+	s.emit("connections.accepted", 1, "c", "")
+}
+
+func (s *StatsdMetrics) ConnRouted(route string) {
+	s.emit("connections.routed", 1, "c", route)
+}
+
+func (s *StatsdMetrics) ConnClosed(duration time.Duration) {
+	s.emit("connections.duration", duration.Milliseconds(), "ms", "")
+}
+
+func (s *StatsdMetrics) ActiveConns(delta int) {
+	s.emit("connections.active", int64(delta), "g", "")
+}
+
+func (s *StatsdMetrics) BytesProxied(in, out int64) {
+	if in > 0 {
+		s.emit("bytes.in", in, "c", "")
+	}
+	if out > 0 {
+		s.emit("bytes.out", out, "c", "")
+	}
+}
+
+func (s *StatsdMetrics) DialFailed() {
+	s.emit("backend.dial_failures", 1, "c", "")
+}
+
+func (s *StatsdMetrics) DialsInFlight(delta int) {
+	s.emit("backend.dials_in_flight", int64(delta), "g", "")
+}
+
+func (s *StatsdMetrics) SNIFailed() {
+	s.emit("sni.parse_failures", 1, "c", "")
+}
+
+func (s *StatsdMetrics) HandshakeTooLarge() {
+	s.emit("sni.too_large", 1, "c", "")
+}
+
+func (s *StatsdMetrics) InvalidSNI() {
+	s.emit("sni.invalid", 1, "c", "")
+}
+
+// Versions are reported as eg. tls_versions.tls1_3.
+func (s *StatsdMetrics) ClientVersion(version string) {
+	name := strings.NewReplacer(" ", "", ".", "_").Replace(strings.ToLower(versionLabel(version)))
+	s.emit("tls_versions." + name, 1, "c", "")
+}
+
+func (s *StatsdMetrics) RateLimited() {
+	s.emit("connections.rate_limited", 1, "c", "")
+}
+
+func (s *StatsdMetrics) ConnsLimited() {
+	s.emit("connections.limited", 1, "c", "")
+}
+
+// Decisions are reported as eg. route.acl.default_deny.
+func (s *StatsdMetrics) ACLDecision(route, decision string) {
+	s.emit("route.acl." + strings.ReplaceAll(decision, "-", "_"), 1, "c", route)
+}
+
+func (s *StatsdMetrics) CopyEnded(peer, reason string) {
+	s.emit("copy_ends." + peer + "." + reason, 1, "c", "")
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdMetrics(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		desc string
+		tags bool
+		emit func(m Metrics)
+		out  []string
+	}{
+		{
+			"Counter",
+			false,
+			func(m Metrics) { m.ConnAccepted() },
+			[]string{ "test.connections.accepted:1|c" },
+		},
+		{
+			"Bytes",
+			false,
+			func(m Metrics) { m.BytesProxied(10, 0); m.BytesProxied(0, 20) },
+			[]string{ "test.bytes.in:10|c", "test.bytes.out:20|c" },
+		},
+		{
+			"Timer",
+			false,
+			func(m Metrics) { m.ConnClosed(1500 * time.Millisecond) },
+			[]string{ "test.connections.duration:1500|ms" },
+		},
+		{
+			"Gauge",
+			false,
+			func(m Metrics) { m.ActiveConns(1); m.ActiveConns(-1) },
+			[]string{ "test.connections.active:+1|g", "test.connections.active:-1|g" },
+		},
+		{
+			"Dials in flight",
+			false,
+			func(m Metrics) { m.DialsInFlight(1) },
+			[]string{ "test.backend.dials_in_flight:+1|g" },
+		},
+		{
+			"Handshake too large",
+			false,
+			func(m Metrics) { m.HandshakeTooLarge() },
+			[]string{ "test.sni.too_large:1|c" },
+		},
+		{
+			"TLS version",
+			false,
+			func(m Metrics) { m.ClientVersion("TLS 1.3") },
+			[]string{ "test.tls_versions.tls1_3:1|c" },
+		},
+		{
+			"Unknown TLS version",
+			false,
+			func(m Metrics) { m.ClientVersion("0x1234") },
+			[]string{ "test.tls_versions.other:1|c" },
+		},
+		{
+			"Untagged route",
+			false,
+			func(m Metrics) { m.ConnRouted("*.example.net") },
+			[]string{ "test.connections.routed:1|c" },
+		},
+		{
+			"ACL decision",
+			true,
+			func(m Metrics) { m.ACLDecision("example.net", "default-deny") },
+			[]string{ "test.route.acl.default_deny:1|c|#route:example.net" },
+		},
+		{
+			"Tagged route",
+			true,
+			func(m Metrics) { m.ConnRouted("~a|b") },
+			[]string{ "test.connections.routed:1|c|#route:~a_b" },
+		},
+	}
+
+	for _, tt := range(tests) {
+		m, err := NewStatsdMetrics(server.LocalAddr().String(), "test.", tt.tags)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.desc, err)
+		}
+		// The Prometheus sink is fed as well.
+		tt.emit(NewMultiMetrics(PrometheusMetrics(), m))
+
+		buf := make([]byte, 512)
+		for _, want := range(tt.out) {
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("%s: no packet received (%s)", tt.desc, err)
+			}
+			if got := string(buf[:n]); got != want {
+				t.Errorf("%s: got %q, wanted %q", tt.desc, got, want)
+			}
+		}
+	}
+}
+
+func TestStatsdDrop(t *testing.T) {
+	// Nothing reads the queue, emitting must not block once it's full.
+	m := &StatsdMetrics{ packets: make(chan string, 1) }
+	done := make(chan struct{})
+	go func() {
+		m.ConnAccepted()
+		m.ConnAccepted()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Emitting blocked on a full queue")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Default maximum number of connections held in the tarpit.
+const defaultTarpitMax = 1000
+
+// Holds denied connections open for a while before closing them, to slow
+// scanners down. Held connections are closed by timers and don't keep a
+// goroutine around.
+type tarpit struct {
+	delay time.Duration
+	max   int
+
+	mu    sync.Mutex
+	conns map[*net.TCPConn]*time.Timer
+}
+
+// Holds c open for the tarpit delay, after which it is closed. Returns false if
+// c can't be held, eg. when the tarpit is full, in which case the caller must
+// close it.
+func (t *tarpit) hold(c *net.TCPConn) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.conns) >= t.max {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = make(map[*net.TCPConn]*time.Timer)
+	}
+	t.conns[c] = time.AfterFunc(t.delay, func() {
+		t.release(c)
+	})
+	return true
+}
+
+// Closes a held connection.
+func (t *tarpit) release(c *net.TCPConn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+
+	c.Close()
+}
+
+// Closes all the held connections right away.
+func (t *tarpit) closeAll() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c, timer := range(t.conns) {
+		timer.Stop()
+		c.Close()
+		delete(t.conns, c)
+	}
+}
+
+// Reports whether connections closed for a given reason are held in the
+// tarpit. Only connections denied before reaching a backend are, including the
+// ones matching a route in maintenance.
+func tarpitReason(reason string) bool {
+	switch (reason) {
+	case "no sni", "invalid sni", "no route", "denied", "maintenance":
+		return true
+	}
+	return false
+}
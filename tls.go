@@ -0,0 +1,84 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/atenart/sniproxy/config"
+)
+
+// Terminates the TLS connection of a client, whose handshake was already read,
+// and originates a new one to the backend over upstream. The backend is offered
+// the protocols the client advertised, and the one it picks is used with the
+// client. Both handshakes must complete within timeout.
+func reencrypt(client, upstream net.Conn, hello []byte, alpn []string, sni string,
+	       t *config.TLSBackend, timeout time.Duration) (*tls.Conn, *tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	serverName := t.ServerName
+	if serverName == "" {
+		serverName = sni
+	}
+	backend := tls.Client(upstream, &tls.Config{
+		ServerName: serverName,
+		RootCAs: t.RootCAs,
+		InsecureSkipVerify: t.Insecure,
+		NextProtos: alpn,
+	})
+	if err := backend.HandshakeContext(ctx); err != nil {
+		return nil, nil, fmt.Errorf("Could not complete the TLS handshake with the backend (%s)", err)
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{ t.Certificate },
+	}
+	if proto := backend.ConnectionState().NegotiatedProtocol; proto != "" {
+		conf.NextProtos = []string{ proto }
+	}
+	front := tls.Server(&replayConn{ client, io.MultiReader(bytes.NewReader(hello), client) }, conf)
+	if err := front.HandshakeContext(ctx); err != nil {
+		return nil, nil, fmt.Errorf("Could not complete the TLS handshake with the client (%s)", err)
+	}
+	return front, backend, nil
+}
+
+// Connection replaying data already read before reading from the network.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Propagates a half-close to the end data was written to: TLS connections send
+// a close_notify alert, then the underlying connection is shut down for
+// writing.
+func closeWrite(end net.Conn, raw upstreamConn) {
+	if t, ok := end.(*tls.Conn); ok {
+		t.CloseWrite()
+	}
+	raw.CloseWrite()
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2019-2021 Antoine Tenart <antoine.tenart@ack.tf>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for a domain and its key to a directory.
+// Returns their paths.
+func writeCertificate(t *testing.T, dir, domain string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames: []string{ domain },
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, domain + ".pem")
+	keyPath := filepath.Join(dir, domain + ".key")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der }), 0644)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{ Type: "PRIVATE KEY", Bytes: keyDER }), 0600)
+	return certPath, keyPath
+}
+
+// Starts a TLS backend replying with the number of bytes received and the
+// negotiated protocol once the client is done sending.
+func startTLSBackend(t *testing.T, certPath, keyPath string) string {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{ cert },
+		NextProtos: []string{ "h2", "http/1.1" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				n, _ := io.Copy(io.Discard, c)
+				proto := c.(*tls.Conn).ConnectionState().NegotiatedProtocol
+				fmt.Fprintf(c, "received %d bytes (%s)", n, proto)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTLSBackend(t *testing.T) {
+	dir := t.TempDir()
+	frontCert, frontKey := writeCertificate(t, dir, "example.net")
+	backCert, backKey := writeCertificate(t, dir, "origin.example.net")
+	backend := startTLSBackend(t, backCert, backKey)
+
+	c := startProxy(t, &Proxy{}, fmt.Sprintf(`
+example.net {
+	backend %s
+	tls-backend %s %s {
+		ca %s
+		server-name origin.example.net
+	}
+}
+`, backend, frontCert, frontKey, backCert))
+
+	pem, _ := os.ReadFile(frontCert)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(pem)
+	client := tls.Client(c, &tls.Config{
+		ServerName: "example.net",
+		RootCAs: roots,
+		NextProtos: []string{ "h2" },
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Could not complete the TLS handshake (%s)", err)
+	}
+	if proto := client.ConnectionState().NegotiatedProtocol; proto != "h2" {
+		t.Errorf("Wrong negotiated protocol: %q", proto)
+	}
+
+	io.WriteString(client, "request")
+	client.CloseWrite()
+	resp, _ := io.ReadAll(client)
+	if string(resp) != "received 7 bytes (h2)" {
+		t.Errorf("Wrong response: %q", resp)
+	}
+}
+
+func TestTLSBackendUntrusted(t *testing.T) {
+	dir := t.TempDir()
+	frontCert, frontKey := writeCertificate(t, dir, "example.net")
+	backCert, backKey := writeCertificate(t, dir, "example.net.origin")
+	backend := startTLSBackend(t, backCert, backKey)
+
+	// The backend certificate isn't trusted, the client never completes
+	// its handshake.
+	entries := make(entryLogger, 1)
+	c := startProxy(t, &Proxy{ AccessLog: entries }, fmt.Sprintf(
+		"example.net {\n\tbackend %s\n\ttls-backend %s %s\n}\n", backend, frontCert, frontKey))
+	client := tls.Client(c, &tls.Config{ ServerName: "example.net", InsecureSkipVerify: true })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := client.Handshake(); err == nil {
+		t.Errorf("Handshake succeeded with an untrusted backend")
+	}
+
+	select {
+	case e := <-entries:
+		if e.Reason != "tls error" {
+			t.Errorf("Wrong reason: %q", e.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("No access log entry")
+	}
+}
+